@@ -0,0 +1,361 @@
+// Package catalog parses Apple software update catalogs.
+//
+// A catalog, served from swscan.apple.com as a .sucatalog file, is a plist
+// listing every product softwareupdate can install, including the full macOS
+// installers. The build and version of an installer are only listed in its
+// distribution file, which Installers downloads.
+package catalog
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/groob/mackit/latest"
+	"github.com/groob/plist"
+)
+
+// Catalog is a software update catalog.
+type Catalog struct {
+	CatalogVersion int       `plist:"CatalogVersion"`
+	IndexDate      time.Time `plist:"IndexDate"`
+	// Products are keyed by product ID, such as 042-55926.
+	Products map[string]*Product `plist:"Products"`
+}
+
+// Product is a software update product.
+type Product struct {
+	// ID is the key of the product in the catalog.
+	ID                string    `plist:"-"`
+	PostDate          time.Time `plist:"PostDate"`
+	ServerMetadataURL string    `plist:"ServerMetadataURL"`
+	Packages          []Package `plist:"Packages"`
+	// Distributions are the URLs of the distribution files, keyed by
+	// language, such as English or en.
+	Distributions    map[string]string `plist:"Distributions"`
+	ExtendedMetaInfo ExtendedMetaInfo  `plist:"ExtendedMetaInfo"`
+}
+
+// Package is a package of a product.
+type Package struct {
+	URL               string `plist:"URL"`
+	MetadataURL       string `plist:"MetadataURL"`
+	Digest            string `plist:"Digest"`
+	Size              int64  `plist:"Size"`
+	IntegrityDataURL  string `plist:"IntegrityDataURL"`
+	IntegrityDataSize int64  `plist:"IntegrityDataSize"`
+}
+
+// ExtendedMetaInfo is the extra information of a product.
+type ExtendedMetaInfo struct {
+	// InstallAssistantPackageIdentifiers are set for full macOS installers,
+	// such as com.apple.pkg.InstallAssistant.macOSSonoma for SharedSupport.
+	InstallAssistantPackageIdentifiers map[string]string `plist:"InstallAssistantPackageIdentifiers"`
+}
+
+// Open parses the catalog file at path.
+func Open(path string) (*Catalog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// Parse parses a catalog from r. Gzip compressed catalogs, as served to
+// clients which accept them, are decompressed.
+func Parse(r io.Reader) (*Catalog, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("catalog: decompress: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	var c Catalog
+	if err := plist.NewXMLDecoder(r).Decode(&c); err != nil {
+		return nil, fmt.Errorf("catalog: decode: %w", err)
+	}
+	for id, p := range c.Products {
+		if p == nil {
+			delete(c.Products, id)
+			continue
+		}
+		p.ID = id
+	}
+	return &c, nil
+}
+
+// IsInstaller reports whether the product is a full macOS installer.
+func (p *Product) IsInstaller() bool {
+	return len(p.ExtendedMetaInfo.InstallAssistantPackageIdentifiers) > 0
+}
+
+// DistributionURL returns the URL of the English distribution file, or of
+// any other language if the product has no English one.
+func (p *Product) DistributionURL() string {
+	for _, lang := range []string{"English", "en"} {
+		if url, ok := p.Distributions[lang]; ok {
+			return url
+		}
+	}
+	langs := make([]string, 0, len(p.Distributions))
+	for lang := range p.Distributions {
+		langs = append(langs, lang)
+	}
+	if len(langs) == 0 {
+		return ""
+	}
+	sort.Strings(langs)
+	return p.Distributions[langs[0]]
+}
+
+// Option customizes how Installers downloads distribution files.
+type Option func(*fetcher)
+
+type fetcher struct {
+	ctx         context.Context
+	client      *http.Client
+	concurrency int
+}
+
+// WithContext sets the context of the downloads.
+func WithContext(ctx context.Context) Option {
+	return func(f *fetcher) {
+		f.ctx = ctx
+	}
+}
+
+// WithHTTPClient sets the client of the downloads. The default is
+// http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(f *fetcher) {
+		f.client = client
+	}
+}
+
+// WithConcurrency sets how many distribution files are downloaded at once.
+// The default is 4.
+func WithConcurrency(n int) Option {
+	return func(f *fetcher) {
+		f.concurrency = n
+	}
+}
+
+// ProductError is an error downloading or parsing the distribution file of a
+// product.
+type ProductError struct {
+	ProductID string
+	Err       error
+}
+
+func (e *ProductError) Error() string {
+	return fmt.Sprintf("catalog: product %s: %s", e.ProductID, e.Err)
+}
+
+func (e *ProductError) Unwrap() error { return e.Err }
+
+// InstallerErrors is returned by Installers when the distribution files of
+// some products can't be read. It lists the skipped products, in the order of
+// their IDs.
+type InstallerErrors []*ProductError
+
+func (e InstallerErrors) Error() string {
+	switch len(e) {
+	case 0:
+		return "catalog: no errors"
+	case 1:
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0], len(e)-1)
+}
+
+// Unwrap returns the errors of the products, for errors.Is and errors.As.
+func (e InstallerErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// Installer is a full macOS installer.
+type Installer struct {
+	Product *Product
+	// Title is the name of the installer, such as macOS Sonoma.
+	Title   string
+	Build   string
+	Version string
+}
+
+// Installers returns the full macOS installers of the catalog, from the
+// newest build to the oldest, in the order of latest.Sorted. Installers
+// without a valid build are listed last. Their distribution files are
+// downloaded concurrently to read their build and version.
+//
+// Products whose distribution file can't be downloaded or parsed are skipped.
+// The other installers are returned along with an InstallerErrors listing
+// the skipped products.
+func (c *Catalog) Installers(opts ...Option) ([]Installer, error) {
+	f := &fetcher{ctx: context.Background(), client: http.DefaultClient, concurrency: 4}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.concurrency < 1 {
+		f.concurrency = 1
+	}
+
+	var ids []string
+	for id, p := range c.Products {
+		if p.IsInstaller() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	dists := make([]*Distribution, len(ids))
+	errs := make([]error, len(ids))
+	sem := make(chan struct{}, f.concurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		url := c.Products[id].DistributionURL()
+		if url == "" {
+			errs[i] = errors.New("no distribution")
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, url string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			dists[i], errs[i] = f.distribution(url)
+		}(i, url)
+	}
+	wg.Wait()
+
+	var installers []Installer
+	var failed InstallerErrors
+	for i, id := range ids {
+		if errs[i] != nil {
+			failed = append(failed, &ProductError{ProductID: id, Err: errs[i]})
+			continue
+		}
+		installers = append(installers, Installer{
+			Product: c.Products[id],
+			Title:   dists[i].Title,
+			Build:   dists[i].Build,
+			Version: dists[i].Version,
+		})
+	}
+	sortInstallers(installers)
+	if len(failed) > 0 {
+		return installers, failed
+	}
+	return installers, nil
+}
+
+// sortInstallers sorts installers in the order of latest.Sorted, keeping the
+// order of the product IDs for equal builds.
+func sortInstallers(installers []Installer) {
+	builds := make([]string, len(installers))
+	for i, inst := range installers {
+		builds[i] = inst.Build
+	}
+	rank := make(map[string]int)
+	for i, build := range latest.Sorted(builds...) {
+		if _, ok := rank[build]; !ok {
+			rank[build] = i
+		}
+	}
+	sort.SliceStable(installers, func(i, j int) bool {
+		ri, iok := rank[installers[i].Build]
+		rj, jok := rank[installers[j].Build]
+		if iok != jok {
+			return iok
+		}
+		return ri < rj
+	})
+}
+
+func (f *fetcher) distribution(url string) (*Distribution, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req.WithContext(f.ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get %s: %s", url, resp.Status)
+	}
+	return ParseDistribution(resp.Body)
+}
+
+// Distribution is the information of a distribution file.
+type Distribution struct {
+	// Title is the localized title, such as macOS Sonoma.
+	Title   string
+	Build   string
+	Version string
+}
+
+type distributionXML struct {
+	Title   string `xml:"title"`
+	AuxInfo struct {
+		Dict []byte `xml:",innerxml"`
+	} `xml:"auxinfo"`
+	Strings []string `xml:"localization>strings"`
+}
+
+// localizedString matches the lines of a strings file, such as
+// "SU_TITLE" = "macOS Sonoma";
+var localizedString = regexp.MustCompile(`"([^"]+)"\s*=\s*"([^"]*)";`)
+
+// ParseDistribution parses the build, the version and the title of a
+// distribution file.
+func ParseDistribution(r io.Reader) (*Distribution, error) {
+	var dx distributionXML
+	if err := xml.NewDecoder(r).Decode(&dx); err != nil {
+		return nil, fmt.Errorf("catalog: decode distribution: %w", err)
+	}
+	dist := &Distribution{Title: dx.Title}
+	for _, s := range dx.Strings {
+		for _, m := range localizedString.FindAllStringSubmatch(s, -1) {
+			if m[1] == dx.Title {
+				dist.Title = m[2]
+			}
+		}
+	}
+
+	if len(bytes.TrimSpace(dx.AuxInfo.Dict)) == 0 {
+		return dist, nil
+	}
+	var aux struct {
+		Build   string `plist:"BUILD"`
+		Version string `plist:"VERSION"`
+	}
+	if err := plist.Unmarshal(dx.AuxInfo.Dict, &aux); err != nil {
+		return nil, fmt.Errorf("catalog: decode distribution auxinfo: %w", err)
+	}
+	dist.Build, dist.Version = aux.Build, aux.Version
+	return dist, nil
+}
@@ -0,0 +1,354 @@
+package catalog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testCatalog = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>CatalogVersion</key>
+	<integer>2</integer>
+	<key>IndexDate</key>
+	<date>2023-12-12T18:00:00Z</date>
+	<key>Products</key>
+	<dict>
+		<key>042-55926</key>
+		<dict>
+			<key>ServerMetadataURL</key>
+			<string>https://swcdn.apple.com/042-55926/042-55926.smd</string>
+			<key>Packages</key>
+			<array>
+				<dict>
+					<key>Digest</key>
+					<string>b0f3b5c3d1e3</string>
+					<key>Size</key>
+					<integer>13324385236</integer>
+					<key>MetadataURL</key>
+					<string>https://swdist.apple.com/042-55926/InstallAssistant.pkm</string>
+					<key>URL</key>
+					<string>https://swcdn.apple.com/042-55926/InstallAssistant.pkg</string>
+					<key>IntegrityDataURL</key>
+					<string>https://swcdn.apple.com/042-55926/InstallAssistant.pkg.integrityDataV1</string>
+					<key>IntegrityDataSize</key>
+					<integer>52040</integer>
+				</dict>
+			</array>
+			<key>PostDate</key>
+			<date>2023-09-26T17:03:14Z</date>
+			<key>Distributions</key>
+			<dict>
+				<key>English</key>
+				<string>%[1]s/042-55926.English.dist</string>
+				<key>fr</key>
+				<string>%[1]s/042-55926.fr.dist</string>
+			</dict>
+			<key>ExtendedMetaInfo</key>
+			<dict>
+				<key>InstallAssistantPackageIdentifiers</key>
+				<dict>
+					<key>OSInstall</key>
+					<string>com.apple.mpkg.OSInstall</string>
+					<key>SharedSupport</key>
+					<string>com.apple.pkg.InstallAssistant.macOSSonoma</string>
+				</dict>
+			</dict>
+		</dict>
+		<key>042-43686</key>
+		<dict>
+			<key>PostDate</key>
+			<date>2023-07-24T17:00:00Z</date>
+			<key>Distributions</key>
+			<dict>
+				<key>en</key>
+				<string>%[1]s/042-43686.en.dist</string>
+			</dict>
+			<key>ExtendedMetaInfo</key>
+			<dict>
+				<key>InstallAssistantPackageIdentifiers</key>
+				<dict>
+					<key>SharedSupport</key>
+					<string>com.apple.pkg.InstallAssistant.macOSVentura</string>
+				</dict>
+			</dict>
+		</dict>
+		<key>052-15153</key>
+		<dict>
+			<key>PostDate</key>
+			<date>2023-11-15T17:00:00Z</date>
+			<key>Distributions</key>
+			<dict>
+				<key>English</key>
+				<string>%[1]s/052-15153.English.dist</string>
+			</dict>
+			<key>ExtendedMetaInfo</key>
+			<dict>
+				<key>InstallAssistantPackageIdentifiers</key>
+				<dict>
+					<key>SharedSupport</key>
+					<string>com.apple.pkg.InstallAssistant.Seed.macOSSonoma</string>
+				</dict>
+			</dict>
+		</dict>
+		<key>041-91758</key>
+		<dict>
+			<key>PostDate</key>
+			<date>2023-06-01T17:00:00Z</date>
+			<key>Packages</key>
+			<array>
+				<dict>
+					<key>Size</key>
+					<integer>1024</integer>
+					<key>URL</key>
+					<string>https://swcdn.apple.com/041-91758/Safari.pkg</string>
+				</dict>
+			</array>
+			<key>Distributions</key>
+			<dict>
+				<key>English</key>
+				<string>%[1]s/041-91758.English.dist</string>
+			</dict>
+		</dict>
+	</dict>
+</dict>
+</plist>
+`
+
+const testDistribution = `<?xml version="1.0" encoding="utf-8"?>
+<installer-gui-script minSpecVersion="2">
+	<title>SU_TITLE</title>
+	<options hostArchitectures="x86_64,arm64"/>
+	<script><![CDATA[
+function installationCheck() { return my.target.systemVersion.ProductVersion < "99"; }
+]]></script>
+	<auxinfo>
+		<dict>
+			<key>BUILD</key>
+			<string>%s</string>
+			<key>VERSION</key>
+			<string>%s</string>
+		</dict>
+	</auxinfo>
+	<localization>
+		<strings language="English"><![CDATA["SU_TITLE" = "%s";
+"SU_VERS" = "%[2]s";
+]]></strings>
+	</localization>
+</installer-gui-script>
+`
+
+func TestParse(t *testing.T) {
+	c, err := Parse(strings.NewReader(fmt.Sprintf(testCatalog, "https://swdist.apple.com")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := c.CatalogVersion, 2; have != want {
+		t.Errorf("have version %d, want %d", have, want)
+	}
+	if have, want := c.IndexDate, time.Date(2023, 12, 12, 18, 0, 0, 0, time.UTC); !have.Equal(want) {
+		t.Errorf("have index date %s, want %s", have, want)
+	}
+	if have, want := len(c.Products), 4; have != want {
+		t.Fatalf("have %d products, want %d", have, want)
+	}
+
+	p := c.Products["042-55926"]
+	if p.ID != "042-55926" {
+		t.Errorf("have ID %q, want %q", p.ID, "042-55926")
+	}
+	if have, want := p.PostDate, time.Date(2023, 9, 26, 17, 3, 14, 0, time.UTC); !have.Equal(want) {
+		t.Errorf("have post date %s, want %s", have, want)
+	}
+	if have, want := p.ServerMetadataURL, "https://swcdn.apple.com/042-55926/042-55926.smd"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	wantPkgs := []Package{{
+		URL:               "https://swcdn.apple.com/042-55926/InstallAssistant.pkg",
+		MetadataURL:       "https://swdist.apple.com/042-55926/InstallAssistant.pkm",
+		Digest:            "b0f3b5c3d1e3",
+		Size:              13324385236,
+		IntegrityDataURL:  "https://swcdn.apple.com/042-55926/InstallAssistant.pkg.integrityDataV1",
+		IntegrityDataSize: 52040,
+	}}
+	if !reflect.DeepEqual(p.Packages, wantPkgs) {
+		t.Errorf("have %+v, want %+v", p.Packages, wantPkgs)
+	}
+	if have, want := p.ExtendedMetaInfo.InstallAssistantPackageIdentifiers["SharedSupport"], "com.apple.pkg.InstallAssistant.macOSSonoma"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have, want := p.DistributionURL(), "https://swdist.apple.com/042-55926.English.dist"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have, want := c.Products["042-43686"].DistributionURL(), "https://swdist.apple.com/042-43686.en.dist"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	for id, want := range map[string]bool{"042-55926": true, "042-43686": true, "052-15153": true, "041-91758": false} {
+		if have := c.Products[id].IsInstaller(); have != want {
+			t.Errorf("%s: have installer %v, want %v", id, have, want)
+		}
+	}
+}
+
+func TestParseGzip(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	fmt.Fprintf(zw, testCatalog, "https://swdist.apple.com")
+	zw.Close()
+
+	c, err := Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(c.Products), 4; have != want {
+		t.Errorf("have %d products, want %d", have, want)
+	}
+
+	if _, err := Parse(strings.NewReader("not a catalog")); err == nil {
+		t.Error("expected an error for an invalid catalog")
+	}
+}
+
+func TestInstallers(t *testing.T) {
+	dists := map[string]string{
+		"/042-55926.English.dist": fmt.Sprintf(testDistribution, "23A344", "14.0", "macOS Sonoma"),
+		"/042-43686.en.dist":      fmt.Sprintf(testDistribution, "22G120", "13.5", "macOS Ventura"),
+		"/052-15153.English.dist": fmt.Sprintf(testDistribution, "23C5030f", "14.2", "macOS Sonoma beta"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dist, ok := dists[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, dist)
+	}))
+	defer srv.Close()
+
+	c, err := Parse(strings.NewReader(fmt.Sprintf(testCatalog, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	installers, err := c.Installers(WithHTTPClient(srv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type result struct{ id, title, build, version string }
+	var have []result
+	for _, inst := range installers {
+		have = append(have, result{inst.Product.ID, inst.Title, inst.Build, inst.Version})
+	}
+	want := []result{
+		{"052-15153", "macOS Sonoma beta", "23C5030f", "14.2"},
+		{"042-55926", "macOS Sonoma", "23A344", "14.0"},
+		{"042-43686", "macOS Ventura", "22G120", "13.5"},
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// a missing distribution only skips its product.
+	delete(dists, "/042-43686.en.dist")
+	installers, err = c.Installers(WithHTTPClient(srv.Client()), WithConcurrency(1))
+	var errs InstallerErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].ProductID != "042-43686" {
+		t.Fatalf("have err %v, want an error for 042-43686", err)
+	}
+	if have, want := len(installers), 2; have != want {
+		t.Errorf("have %d installers, want %d", have, want)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	installers, err = c.Installers(WithHTTPClient(srv.Client()), WithContext(ctx))
+	if !errors.As(err, &errs) || len(errs) != 3 || len(installers) != 0 {
+		t.Errorf("have %d installers, err %v, want errors for all the products", len(installers), err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("have %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestInstallersConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	var running, max int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		fmt.Fprintf(w, testDistribution, "23A344", "14.0", "macOS Sonoma")
+	}))
+	defer srv.Close()
+
+	c, err := Parse(strings.NewReader(fmt.Sprintf(testCatalog, srv.URL)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	installers, err := c.Installers(WithHTTPClient(srv.Client()), WithConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(installers), 3; have != want {
+		t.Errorf("have %d installers, want %d", have, want)
+	}
+	if max > 2 {
+		t.Errorf("have %d concurrent downloads, want at most 2", max)
+	}
+}
+
+func TestParseDistribution(t *testing.T) {
+	dist, err := ParseDistribution(strings.NewReader(fmt.Sprintf(testDistribution, "22G120", "13.5", "macOS Ventura")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Distribution{Title: "macOS Ventura", Build: "22G120", Version: "13.5"}
+	if !reflect.DeepEqual(dist, want) {
+		t.Errorf("have %+v, want %+v", dist, want)
+	}
+
+	// distributions of other products have no auxinfo or localization.
+	dist, err = ParseDistribution(strings.NewReader(`<installer-gui-script><title>Safari</title></installer-gui-script>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&Distribution{Title: "Safari"}); !reflect.DeepEqual(dist, want) {
+		t.Errorf("have %+v, want %+v", dist, want)
+	}
+}
+
+func Test_sortInstallers(t *testing.T) {
+	installers := []Installer{
+		{Build: "invalid"},
+		{Build: "22G120"},
+		{Build: "23A344"},
+		{Build: "22G120"},
+		{Build: "23B74"},
+	}
+	sortInstallers(installers)
+	var have []string
+	for _, inst := range installers {
+		have = append(have, inst.Build)
+	}
+	if want := []string{"23B74", "23A344", "22G120", "22G120", "invalid"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
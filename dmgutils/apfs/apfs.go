@@ -0,0 +1,682 @@
+// Package apfs reads unencrypted APFS volumes, without mounting them.
+//
+// The container superblock is read from the latest valid checkpoint, and
+// the file system tree of the volume is read through the object maps of the
+// container and the volume. Resource forks are available at
+// file/..namedfork/rsrc.
+// Based on Apple's File System Reference.
+package apfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"time"
+
+	"github.com/groob/mackit/internal/diskfs"
+)
+
+// ErrNotAPFS is returned by Open when r isn't an APFS container.
+var ErrNotAPFS = errors.New("apfs: not an APFS container")
+
+// object types.
+const (
+	objectTypeMask     = 0x0000ffff
+	objectNXSuperblock = 0x1
+	objectBtree        = 0x2
+	objectBtreeNode    = 0x3
+	objectOmap         = 0xb
+	objectFS           = 0xd
+)
+
+// file system record types.
+const (
+	typeInode      = 3
+	typeXattr      = 4
+	typeFileExtent = 8
+	typeDirRec     = 9
+)
+
+const (
+	objIDMask     = 0x0fffffffffffffff
+	objTypeShift  = 60
+	rootDirInode  = 2
+	maxFSObjects  = 100
+	maxTreeHeight = 16
+)
+
+const (
+	fsUnencrypted = 0x1
+
+	incompatCaseInsensitive          = 0x1
+	incompatNormalizationInsensitive = 0x8
+
+	xattrDataStream   = 0x1
+	xattrDataEmbedded = 0x2
+
+	inoExtTypeDstream = 8
+
+	ufCompressed = 0x20
+)
+
+const (
+	symlinkXattr      = "com.apple.fs.symlink"
+	resourceForkXattr = "com.apple.ResourceFork"
+)
+
+// Stat is the Sys value of the file infos of the volume.
+type Stat struct {
+	// Inode is the inode number of the file.
+	Inode      uint64
+	UID        uint32
+	GID        uint32
+	Flags      uint32
+	Nlink      int32
+	CreateTime time.Time
+}
+
+type container struct {
+	r         io.ReaderAt
+	blockSize int64
+	xid       uint64
+}
+
+type volume struct {
+	c      *container
+	omap   uint64 // physical address of the volume object map tree
+	root   uint64 // physical address of the file system tree
+	hashed bool   // directory records have hashed names
+}
+
+// inode is a decoded j_inode_val_t.
+type inode struct {
+	id         uint64
+	parent     uint64
+	privateID  uint64
+	createTime uint64
+	modTime    uint64
+	nlink      int32
+	bsdFlags   uint32
+	uid        uint32
+	gid        uint32
+	mode       uint16
+	size       int64
+}
+
+type fileExtent struct {
+	logical int64
+	length  int64
+	block   uint64
+}
+
+// Open reads the first volume of the APFS container in r. The returned file
+// system also implements fs.StatFS and fs.ReadDirFS.
+func Open(r io.ReaderAt) (fs.FS, error) {
+	c, sb, err := openContainer(r)
+	if err != nil {
+		return nil, err
+	}
+	omapTree, err := c.omapTree(binary.LittleEndian.Uint64(sb[160:]))
+	if err != nil {
+		return nil, fmt.Errorf("apfs: container object map: %s", err)
+	}
+	for i := 0; i < maxFSObjects; i++ {
+		oid := binary.LittleEndian.Uint64(sb[184+8*i:])
+		if oid == 0 {
+			continue
+		}
+		addr, err := c.omapLookup(omapTree, oid, c.xid)
+		if err != nil {
+			return nil, fmt.Errorf("apfs: volume %d: %s", i, err)
+		}
+		v, err := c.openVolume(addr)
+		if err != nil {
+			return nil, err
+		}
+		return diskfs.New(v), nil
+	}
+	return nil, errors.New("apfs: container has no volumes")
+}
+
+// openContainer finds the latest valid container superblock. The superblock
+// at block 0 is a copy, which may be out of date.
+func openContainer(r io.ReaderAt) (*container, []byte, error) {
+	c := &container{r: r, blockSize: 4096}
+	sb := make([]byte, c.blockSize)
+	if _, err := r.ReadAt(sb, 0); err != nil {
+		return nil, nil, ErrNotAPFS
+	}
+	if string(sb[32:36]) != "NXSB" {
+		return nil, nil, ErrNotAPFS
+	}
+	if !validChecksum(sb) {
+		return nil, nil, errors.New("apfs: invalid container superblock checksum")
+	}
+	c.blockSize = int64(binary.LittleEndian.Uint32(sb[36:]))
+	if c.blockSize < 4096 || c.blockSize > 65536 || c.blockSize&(c.blockSize-1) != 0 {
+		return nil, nil, fmt.Errorf("apfs: invalid block size %d", c.blockSize)
+	}
+	if c.blockSize != 4096 {
+		sb = make([]byte, c.blockSize)
+		if _, err := r.ReadAt(sb, 0); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	descBlocks := binary.LittleEndian.Uint32(sb[104:])
+	descBase := binary.LittleEndian.Uint64(sb[112:])
+	latest := sb
+	// the checkpoint descriptor area is contiguous unless its high bit is
+	// set; then the latest superblock can't be found without a b-tree, and
+	// the copy at block 0 is used.
+	if descBlocks&0x80000000 == 0 && descBlocks <= 1<<16 {
+		for i := uint64(0); i < uint64(descBlocks); i++ {
+			b, err := c.readObject(descBase + i)
+			if err != nil {
+				continue
+			}
+			if binary.LittleEndian.Uint32(b[24:])&objectTypeMask != objectNXSuperblock || string(b[32:36]) != "NXSB" {
+				continue
+			}
+			if xid(b) > xid(latest) {
+				latest = b
+			}
+		}
+	}
+	c.xid = xid(latest)
+	return c, latest, nil
+}
+
+func xid(obj []byte) uint64 { return binary.LittleEndian.Uint64(obj[16:]) }
+
+// readObject reads the object at a physical block address, verifying its
+// checksum.
+func (c *container) readObject(addr uint64) ([]byte, error) {
+	b := make([]byte, c.blockSize)
+	if addr > uint64(1<<63-1)/uint64(c.blockSize) {
+		return nil, fmt.Errorf("invalid block address %d", addr)
+	}
+	if _, err := c.r.ReadAt(b, int64(addr)*c.blockSize); err != nil {
+		return nil, fmt.Errorf("read block %d: %s", addr, err)
+	}
+	if !validChecksum(b) {
+		return nil, fmt.Errorf("invalid checksum for block %d", addr)
+	}
+	return b, nil
+}
+
+// validChecksum verifies the Fletcher-64 checksum at the start of an object.
+func validChecksum(obj []byte) bool {
+	return binary.LittleEndian.Uint64(obj) == fletcher64(obj[8:])
+}
+
+func fletcher64(b []byte) uint64 {
+	const mod = 0xffffffff
+	var sum1, sum2 uint64
+	for i := 0; i+4 <= len(b); i += 4 {
+		sum1 = (sum1 + uint64(binary.LittleEndian.Uint32(b[i:]))) % mod
+		sum2 = (sum2 + sum1) % mod
+	}
+	c1 := mod - (sum1+sum2)%mod
+	c2 := mod - (sum1+c1)%mod
+	return c2<<32 | c1
+}
+
+// omapTree returns the address of the root node of the tree of an object
+// map.
+func (c *container) omapTree(addr uint64) (uint64, error) {
+	omap, err := c.readObject(addr)
+	if err != nil {
+		return 0, err
+	}
+	if binary.LittleEndian.Uint32(omap[24:])&objectTypeMask != objectOmap {
+		return 0, errors.New("invalid object map")
+	}
+	return binary.LittleEndian.Uint64(omap[48:]), nil
+}
+
+// omapLookup returns the physical address of the latest version of the
+// virtual object oid, which isn't newer than xid.
+func (c *container) omapLookup(tree, oid, maxXID uint64) (uint64, error) {
+	// keys are an object ID and a transaction ID.
+	before := func(key []byte) bool {
+		koid, kxid := binary.LittleEndian.Uint64(key), binary.LittleEndian.Uint64(key[8:])
+		return koid < oid || (koid == oid && kxid <= maxXID)
+	}
+	addr := tree
+	for depth := 0; depth < maxTreeHeight; depth++ {
+		block, err := c.readObject(addr)
+		if err != nil {
+			return 0, err
+		}
+		n, err := parseNode(block, 16, 16)
+		if err != nil {
+			return 0, err
+		}
+		// the last entry before or at the searched key.
+		found := -1
+		for i := 0; i < int(n.nkeys); i++ {
+			key, _, err := n.entry(i)
+			if err != nil {
+				return 0, err
+			}
+			if len(key) < 16 || !before(key) {
+				break
+			}
+			found = i
+		}
+		if found < 0 {
+			break
+		}
+		if !n.leaf() {
+			if addr, err = n.child(found); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		key, val, err := n.entry(found)
+		if err != nil {
+			return 0, err
+		}
+		if binary.LittleEndian.Uint64(key) != oid || len(val) < 16 {
+			break
+		}
+		return binary.LittleEndian.Uint64(val[8:]), nil
+	}
+	return 0, fmt.Errorf("object %d not found", oid)
+}
+
+func (c *container) openVolume(addr uint64) (*volume, error) {
+	sb, err := c.readObject(addr)
+	if err != nil {
+		return nil, fmt.Errorf("apfs: volume superblock: %s", err)
+	}
+	if string(sb[32:36]) != "APSB" || binary.LittleEndian.Uint32(sb[24:])&objectTypeMask != objectFS {
+		return nil, errors.New("apfs: invalid volume superblock")
+	}
+	if binary.LittleEndian.Uint64(sb[264:])&fsUnencrypted == 0 {
+		return nil, errors.New("apfs: encrypted volumes are not supported")
+	}
+	incompat := binary.LittleEndian.Uint64(sb[56:])
+	v := &volume{
+		c:      c,
+		hashed: incompat&(incompatCaseInsensitive|incompatNormalizationInsensitive) != 0,
+	}
+	if v.omap, err = c.omapTree(binary.LittleEndian.Uint64(sb[128:])); err != nil {
+		return nil, fmt.Errorf("apfs: volume object map: %s", err)
+	}
+	if v.root, err = c.omapLookup(v.omap, binary.LittleEndian.Uint64(sb[136:]), c.xid); err != nil {
+		return nil, fmt.Errorf("apfs: file system tree: %s", err)
+	}
+	return v, nil
+}
+
+// scan calls fn with the key and value of every record of the file system
+// object oid with type typ.
+func (v *volume) scan(oid uint64, typ uint8, fn func(key, val []byte) error) error {
+	return v.scanNode(v.root, oid, typ, 0, fn)
+}
+
+func (v *volume) scanNode(addr, oid uint64, typ uint8, depth int, fn func(key, val []byte) error) error {
+	if depth > maxTreeHeight {
+		return errors.New("file system tree is too deep")
+	}
+	block, err := v.c.readObject(addr)
+	if err != nil {
+		return err
+	}
+	n, err := parseNode(block, 0, 0)
+	if err != nil {
+		return err
+	}
+	// cmp compares the object ID and type of a key with the searched ones.
+	cmp := func(key []byte) int {
+		hdr := binary.LittleEndian.Uint64(key)
+		kid, ktyp := hdr&objIDMask, uint8(hdr>>objTypeShift)
+		switch {
+		case kid < oid || (kid == oid && ktyp < typ):
+			return -1
+		case kid == oid && ktyp == typ:
+			return 0
+		}
+		return 1
+	}
+
+	keys := make([][]byte, n.nkeys)
+	for i := range keys {
+		key, _, err := n.entry(i)
+		if err != nil {
+			return err
+		}
+		if len(key) < 8 {
+			return errors.New("corrupt file system record")
+		}
+		keys[i] = key
+	}
+	for i, key := range keys {
+		c := cmp(key)
+		if n.leaf() {
+			if c > 0 {
+				break
+			} else if c < 0 {
+				continue
+			}
+			_, val, err := n.entry(i)
+			if err != nil {
+				return err
+			}
+			if val == nil {
+				continue
+			}
+			if err := fn(key, val); err != nil {
+				return err
+			}
+			continue
+		}
+		// the child holds the keys from its key up to the next one.
+		if c > 0 {
+			break
+		}
+		if i+1 < len(keys) && cmp(keys[i+1]) < 0 {
+			continue
+		}
+		childOID, err := n.child(i)
+		if err != nil {
+			return err
+		}
+		child, err := v.c.omapLookup(v.omap, childOID, v.c.xid)
+		if err != nil {
+			return err
+		}
+		if err := v.scanNode(child, oid, typ, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Root returns the root directory.
+func (v *volume) Root() (diskfs.Inode, error) {
+	ino, err := v.inode(rootDirInode)
+	if err != nil {
+		return diskfs.Inode{}, err
+	}
+	return v.diskInode(ino), nil
+}
+
+// ReadDir returns the entries of a directory.
+func (v *volume) ReadDir(dir diskfs.Inode) ([]diskfs.Entry, error) {
+	var entries []diskfs.Entry
+	err := v.scan(dir.ID, typeDirRec, func(key, val []byte) error {
+		name, err := v.dirRecName(key)
+		if err != nil {
+			return err
+		}
+		if len(val) < 18 {
+			return errors.New("corrupt directory record")
+		}
+		ino, err := v.inode(binary.LittleEndian.Uint64(val))
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+		entries = append(entries, diskfs.Entry{Name: name, Inode: v.diskInode(ino)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// Open returns a fork of a file. The data fork of a symlink is its target.
+func (v *volume) Open(f diskfs.Inode, which diskfs.Fork) (io.ReaderAt, int64, error) {
+	ino := f.Node.(*inode)
+	if which == diskfs.ResourceFork {
+		return v.xattr(ino.id, resourceForkXattr)
+	}
+	switch {
+	case f.Mode&fs.ModeSymlink != 0:
+		r, size, err := v.xattr(ino.id, symlinkXattr)
+		if err != nil {
+			return nil, 0, err
+		}
+		// the target is NUL terminated.
+		buf := make([]byte, size)
+		if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		buf = bytes.TrimRight(buf, "\x00")
+		return bytes.NewReader(buf), int64(len(buf)), nil
+	case f.Mode.IsDir():
+		return nil, 0, errors.New("is a directory")
+	case ino.bsdFlags&ufCompressed != 0:
+		return nil, 0, errors.New("compressed files are not supported")
+	}
+	r, err := v.stream(ino.privateID, ino.size)
+	return r, ino.size, err
+}
+
+func (v *volume) dirRecName(key []byte) (string, error) {
+	var name []byte
+	if v.hashed {
+		if len(key) < 12 {
+			return "", errors.New("corrupt directory record")
+		}
+		n := int(binary.LittleEndian.Uint32(key[8:]) & 0x3ff)
+		if 12+n > len(key) {
+			return "", errors.New("corrupt directory record")
+		}
+		name = key[12 : 12+n]
+	} else {
+		if len(key) < 10 {
+			return "", errors.New("corrupt directory record")
+		}
+		n := int(binary.LittleEndian.Uint16(key[8:]))
+		if 10+n > len(key) {
+			return "", errors.New("corrupt directory record")
+		}
+		name = key[10 : 10+n]
+	}
+	return string(bytes.TrimRight(name, "\x00")), nil
+}
+
+func (v *volume) inode(id uint64) (*inode, error) {
+	var ino *inode
+	err := v.scan(id, typeInode, func(key, val []byte) error {
+		if len(val) < 92 {
+			return errors.New("corrupt inode")
+		}
+		ino = &inode{
+			id:         id,
+			parent:     binary.LittleEndian.Uint64(val),
+			privateID:  binary.LittleEndian.Uint64(val[8:]),
+			createTime: binary.LittleEndian.Uint64(val[16:]),
+			modTime:    binary.LittleEndian.Uint64(val[24:]),
+			nlink:      int32(binary.LittleEndian.Uint32(val[56:])),
+			bsdFlags:   binary.LittleEndian.Uint32(val[68:]),
+			uid:        binary.LittleEndian.Uint32(val[72:]),
+			gid:        binary.LittleEndian.Uint32(val[76:]),
+			mode:       binary.LittleEndian.Uint16(val[80:]),
+		}
+		if dstream := extendedField(val[92:], inoExtTypeDstream); len(dstream) >= 8 {
+			ino.size = int64(binary.LittleEndian.Uint64(dstream))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ino == nil {
+		return nil, fmt.Errorf("inode %d not found", id)
+	}
+	return ino, nil
+}
+
+// extendedField returns the value of an extended field of an inode.
+func extendedField(b []byte, typ uint8) []byte {
+	if len(b) < 4 {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint16(b))
+	if 4+4*count > len(b) {
+		return nil
+	}
+	data := 4 + 4*count
+	for i := 0; i < count; i++ {
+		xtype := b[4+4*i]
+		size := int(binary.LittleEndian.Uint16(b[4+4*i+2:]))
+		if data+size > len(b) {
+			return nil
+		}
+		if xtype == typ {
+			return b[data : data+size]
+		}
+		// values are aligned to 8 bytes.
+		data += (size + 7) &^ 7
+	}
+	return nil
+}
+
+func (v *volume) diskInode(ino *inode) diskfs.Inode {
+	inode := diskfs.Inode{
+		ID:      ino.id,
+		Mode:    diskfs.UnixMode(ino.mode),
+		ModTime: time.Unix(0, int64(ino.modTime)),
+		Sys: &Stat{
+			Inode:      ino.id,
+			UID:        ino.uid,
+			GID:        ino.gid,
+			Flags:      ino.bsdFlags,
+			Nlink:      ino.nlink,
+			CreateTime: time.Unix(0, int64(ino.createTime)),
+		},
+		Node: ino,
+	}
+	if inode.Mode.IsRegular() {
+		inode.Size = ino.size
+	}
+	return inode
+}
+
+// xattr returns the value of an extended attribute.
+func (v *volume) xattr(id uint64, name string) (io.ReaderAt, int64, error) {
+	var r io.ReaderAt
+	var size int64
+	err := v.scan(id, typeXattr, func(key, val []byte) error {
+		if r != nil || len(key) < 10 {
+			return nil
+		}
+		n := int(binary.LittleEndian.Uint16(key[8:]))
+		if 10+n > len(key) || string(bytes.TrimRight(key[10:10+n], "\x00")) != name {
+			return nil
+		}
+		if len(val) < 4 {
+			return errors.New("corrupt extended attribute")
+		}
+		flags := binary.LittleEndian.Uint16(val)
+		data := val[4:]
+		if n := int(binary.LittleEndian.Uint16(val[2:])); n <= len(data) {
+			data = data[:n]
+		}
+		switch {
+		case flags&xattrDataEmbedded != 0:
+			r, size = bytes.NewReader(data), int64(len(data))
+		case flags&xattrDataStream != 0:
+			if len(data) < 16 {
+				return errors.New("corrupt extended attribute")
+			}
+			size = int64(binary.LittleEndian.Uint64(data[8:]))
+			stream, err := v.stream(binary.LittleEndian.Uint64(data), size)
+			if err != nil {
+				return err
+			}
+			r = stream
+		default:
+			return errors.New("corrupt extended attribute")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if r == nil {
+		return nil, 0, fs.ErrNotExist
+	}
+	return r, size, nil
+}
+
+// stream returns a reader for the extents of a data stream.
+func (v *volume) stream(id uint64, size int64) (io.ReaderAt, error) {
+	var extents []fileExtent
+	err := v.scan(id, typeFileExtent, func(key, val []byte) error {
+		if len(key) < 16 || len(val) < 16 {
+			return errors.New("corrupt file extent")
+		}
+		extents = append(extents, fileExtent{
+			logical: int64(binary.LittleEndian.Uint64(key[8:])),
+			length:  int64(binary.LittleEndian.Uint64(val) & 0x00ffffffffffffff),
+			block:   binary.LittleEndian.Uint64(val[8:]),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].logical < extents[j].logical })
+	return &extentReader{c: v.c, size: size, extents: extents}, nil
+}
+
+type extentReader struct {
+	c       *container
+	size    int64
+	extents []fileExtent
+}
+
+// ReadAt reads the stream. Ranges without an extent, and sparse extents,
+// read as zeros.
+func (er *extentReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= er.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if int64(len(p)) > er.size-off {
+		p, eof = p[:er.size-off], io.EOF
+	}
+	var n int
+	for n < len(p) {
+		chunk := p[n:]
+		i := sort.Search(len(er.extents), func(i int) bool {
+			return er.extents[i].logical+er.extents[i].length > off
+		})
+		if i == len(er.extents) || off < er.extents[i].logical {
+			if i < len(er.extents) && int64(len(chunk)) > er.extents[i].logical-off {
+				chunk = chunk[:er.extents[i].logical-off]
+			}
+			zero(chunk)
+		} else {
+			e := er.extents[i]
+			if rest := e.logical + e.length - off; int64(len(chunk)) > rest {
+				chunk = chunk[:rest]
+			}
+			if e.block == 0 {
+				zero(chunk)
+			} else if m, err := er.c.r.ReadAt(chunk, int64(e.block)*er.c.blockSize+off-e.logical); err != nil && !(err == io.EOF && m == len(chunk)) {
+				return n + m, err
+			}
+		}
+		n += len(chunk)
+		off += int64(len(chunk))
+	}
+	return n, eof
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
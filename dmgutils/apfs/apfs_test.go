@@ -0,0 +1,284 @@
+package apfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"sort"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOpen(t *testing.T) {
+	fsys, err := Open(bytes.NewReader(buildContainer()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "hello.txt", "link", "sub/big.bin", "sub/hard.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name()+" "+e.Type().String())
+	}
+	want := []string{"hello.txt ----------", "link L---------", "sub d---------"}
+	if !equal(names, want) {
+		t.Errorf("have entries %q, want %q", names, want)
+	}
+
+	var files = []struct {
+		name string
+		want []byte
+	}{
+		{"hello.txt", []byte("hello, world\n")},
+		{"link", []byte("hello, world\n")},
+		{"sub/hard.txt", []byte("hello, world\n")},
+		{"hello.txt/..namedfork/rsrc", []byte("RSRC")},
+		{"sub/big.bin", bytes.Join([][]byte{
+			bytes.Repeat([]byte("A"), 4096), make([]byte, 4096), bytes.Repeat([]byte("B"), 100),
+		}, nil)},
+	}
+	for _, tt := range files {
+		have, err := fs.ReadFile(fsys, tt.name)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(have, tt.want) {
+			t.Errorf("%s: have %q, want %q", tt.name, truncate(have), truncate(tt.want))
+		}
+	}
+
+	target, err := fsys.(interface {
+		ReadLink(string) (string, error)
+	}).ReadLink("link")
+	if err != nil || target != "hello.txt" {
+		t.Errorf("have link target %q, %v, want hello.txt", target, err)
+	}
+
+	fi, err := fs.Stat(fsys, "sub/hard.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*Stat); st.Inode != 16 || st.Nlink != 2 || st.UID != 501 {
+		t.Errorf("have stat %+v", st)
+	}
+	if _, err := fs.Stat(fsys, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("have %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestOpenNotAPFS(t *testing.T) {
+	if _, err := Open(bytes.NewReader(make([]byte, 8192))); err != ErrNotAPFS {
+		t.Errorf("have %v, want %v", err, ErrNotAPFS)
+	}
+}
+
+func truncate(b []byte) []byte {
+	if len(b) > 32 {
+		return b[:32]
+	}
+	return b
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const testBlockSize = 4096
+
+// le encodes fixed size values in little endian.
+func le(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+type kv struct{ key, val []byte }
+
+// object sets the header of an object and its checksum.
+func object(block []byte, oid, xid uint64, typ uint32) []byte {
+	copy(block[8:], le(oid, xid, typ, uint32(0)))
+	binary.LittleEndian.PutUint64(block, fletcher64(block[8:]))
+	return block
+}
+
+// node builds a b-tree node. Fixed size nodes store the key and value sizes
+// of the tree in the table of contents.
+func node(flags, level uint16, entries []kv, fixed bool) []byte {
+	b := make([]byte, testBlockSize)
+	tocLen := 8 * len(entries)
+	if fixed {
+		tocLen = 4 * len(entries)
+	}
+	copy(b[32:], le(flags, level, uint32(len(entries)), uint16(0), uint16(tocLen)))
+	keyBase := btnodeHeaderSize + tocLen
+	valEnd := testBlockSize
+	if flags&btnodeRoot != 0 {
+		valEnd -= btreeInfoSize
+	}
+	var koff, voff int
+	for i, e := range entries {
+		copy(b[keyBase+koff:], e.key)
+		voff += len(e.val)
+		copy(b[valEnd-voff:], e.val)
+		if fixed {
+			copy(b[btnodeHeaderSize+4*i:], le(uint16(koff), uint16(voff)))
+		} else {
+			copy(b[btnodeHeaderSize+8*i:], le(uint16(koff), uint16(len(e.key)), uint16(voff), uint16(len(e.val))))
+		}
+		koff += len(e.key)
+	}
+	return b
+}
+
+func jkey(oid uint64, typ uint8, rest ...interface{}) []byte {
+	return append(le(oid|uint64(typ)<<objTypeShift), le(rest...)...)
+}
+
+func inodeRecord(id, parent, private uint64, nlink int32, mode uint16, size int64) kv {
+	val := le(parent, private,
+		uint64(1e18), uint64(1.5e18), uint64(0), uint64(0), uint64(0),
+		nlink, uint32(0), uint32(0), uint32(0), uint32(501), uint32(20), mode, uint16(0), uint64(0))
+	if size >= 0 {
+		// a single dstream extended field.
+		val = append(val, le(uint16(1), uint16(40), uint8(inoExtTypeDstream), uint8(0), uint16(40))...)
+		val = append(val, le(uint64(size), uint64(size), uint64(0), uint64(0), uint64(0))...)
+	}
+	return kv{jkey(id, typeInode), val}
+}
+
+func dirRecord(dir uint64, name string, id uint64, dtype uint16) kv {
+	n := append([]byte(name), 0)
+	key := append(jkey(dir, typeDirRec, uint32(len(n))|0xabcd<<10), n...)
+	return kv{key, le(id, uint64(0), dtype)}
+}
+
+func xattrRecord(id uint64, name string, data []byte) kv {
+	n := append([]byte(name), 0)
+	key := append(jkey(id, typeXattr, uint16(len(n))), n...)
+	return kv{key, append(le(uint16(xattrDataEmbedded), uint16(len(data))), data...)}
+}
+
+func extentRecord(id uint64, logical, length, block uint64) kv {
+	return kv{jkey(id, typeFileExtent, logical), le(length, block, uint64(0))}
+}
+
+// buildContainer builds a container with a case insensitive volume:
+//
+//	hello.txt     a file with a resource fork
+//	link -> hello.txt
+//	sub/big.bin   a file with a hole
+//	sub/hard.txt  a hard link to hello.txt
+func buildContainer() []byte {
+	const (
+		xid       = 2
+		volumeOID = 1026
+		rootOID   = 1028
+		leafA     = 1030
+		leafB     = 1031
+	)
+	img := make([]byte, 14*testBlockSize)
+	block := func(n int) []byte { return img[n*testBlockSize : (n+1)*testBlockSize] }
+	put := func(n int, b []byte) { copy(block(n), b) }
+
+	// block 0 is an out of date copy of the superblock, pointing to an
+	// invalid object map. The latest superblock is in the checkpoint area.
+	superblock := func(xid uint64, omap uint64) []byte {
+		b := make([]byte, testBlockSize)
+		copy(b[32:], "NXSB")
+		copy(b[36:], le(uint32(testBlockSize), uint64(14)))
+		copy(b[104:], le(uint32(2)))
+		copy(b[112:], le(uint64(1)))
+		copy(b[160:], le(omap))
+		copy(b[184:], le(uint64(volumeOID)))
+		return object(b, 1, xid, 0x80000000|objectNXSuperblock)
+	}
+	put(0, superblock(1, 2))
+	put(1, superblock(xid, 3))
+
+	omap := func(tree uint64) []byte {
+		b := make([]byte, testBlockSize)
+		copy(b[48:], le(tree))
+		return object(b, 0, xid, 0x40000000|objectOmap)
+	}
+	omapEntry := func(oid, addr uint64) kv {
+		return kv{le(oid, uint64(xid)), le(uint32(0), uint32(testBlockSize), addr)}
+	}
+	put(3, omap(4))
+	put(4, object(node(btnodeRoot|btnodeLeaf|btnodeFixedSize, 0, []kv{omapEntry(volumeOID, 5)}, true), 4, xid, 0x40000000|objectBtree))
+
+	apsb := make([]byte, testBlockSize)
+	copy(apsb[32:], "APSB")
+	copy(apsb[56:], le(uint64(incompatCaseInsensitive)))
+	copy(apsb[128:], le(uint64(6), uint64(rootOID)))
+	copy(apsb[264:], le(uint64(fsUnencrypted)))
+	put(5, object(apsb, volumeOID, xid, objectFS))
+
+	put(6, omap(7))
+	put(7, object(node(btnodeRoot|btnodeLeaf|btnodeFixedSize, 0, []kv{
+		omapEntry(rootOID, 8), omapEntry(leafA, 9), omapEntry(leafB, 10),
+	}, true), 7, xid, 0x40000000|objectBtree))
+
+	const (
+		dtDir = 4
+		dtReg = 8
+		dtLnk = 10
+	)
+	records := []kv{
+		inodeRecord(2, 1, 2, 3, 040755, -1),
+		dirRecord(2, "hello.txt", 16, dtReg),
+		dirRecord(2, "link", 17, dtLnk),
+		dirRecord(2, "sub", 18, dtDir),
+		inodeRecord(16, 2, 16, 2, 0100644, 13),
+		xattrRecord(16, resourceForkXattr, []byte("RSRC")),
+		extentRecord(16, 0, testBlockSize, 13),
+		inodeRecord(17, 2, 17, 1, 0120755, -1),
+		xattrRecord(17, symlinkXattr, []byte("hello.txt\x00")),
+		inodeRecord(18, 2, 18, 2, 040755, -1),
+		dirRecord(18, "big.bin", 19, dtReg),
+		dirRecord(18, "hard.txt", 16, dtReg),
+		inodeRecord(19, 18, 19, 1, 0100600, 2*testBlockSize+100),
+		extentRecord(19, 0, testBlockSize, 11),
+		extentRecord(19, 2*testBlockSize, testBlockSize, 12),
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		hi, hj := binary.LittleEndian.Uint64(records[i].key), binary.LittleEndian.Uint64(records[j].key)
+		if hi&objIDMask != hj&objIDMask {
+			return hi&objIDMask < hj&objIDMask
+		}
+		return hi>>objTypeShift < hj>>objTypeShift
+	})
+	// split the records between two leaves, in the middle of the records of
+	// inode 16.
+	split := 6
+	put(8, object(node(btnodeRoot, 1, []kv{
+		{records[0].key, le(uint64(leafA))},
+		{records[split].key, le(uint64(leafB))},
+	}, false), rootOID, xid, objectBtree))
+	put(9, object(node(btnodeLeaf, 0, records[:split], false), leafA, xid, objectBtreeNode))
+	put(10, object(node(btnodeLeaf, 0, records[split:], false), leafB, xid, objectBtreeNode))
+
+	put(11, bytes.Repeat([]byte("A"), testBlockSize))
+	put(12, bytes.Repeat([]byte("B"), testBlockSize))
+	put(13, []byte("hello, world\n"))
+	return img
+}
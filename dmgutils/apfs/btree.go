@@ -0,0 +1,119 @@
+package apfs
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// B-tree nodes are objects. The table of contents follows the node header,
+// and points to the keys, which are stored after it, and to the values,
+// which are stored from the end of the node. Root nodes end with the
+// btree_info_t of the tree.
+
+const (
+	btnodeRoot      = 0x1
+	btnodeLeaf      = 0x2
+	btnodeFixedSize = 0x4
+
+	btnodeHeaderSize = 56
+	btreeInfoSize    = 40
+
+	// offsets of deleted entries.
+	btoffInvalid = 0xffff
+)
+
+type btnode struct {
+	flags   uint16
+	level   uint16
+	nkeys   uint32
+	block   []byte
+	toc     []byte
+	keyBase int
+	valEnd  int
+
+	// the sizes of the keys and values of fixed size nodes.
+	keySize int
+	valSize int
+}
+
+func (n *btnode) leaf() bool { return n.flags&btnodeLeaf != 0 }
+
+// parseNode parses a B-tree node. keySize and valSize are the sizes of the
+// entries of trees with fixed size keys and values.
+func parseNode(block []byte, keySize, valSize int) (*btnode, error) {
+	if len(block) < btnodeHeaderSize {
+		return nil, fmt.Errorf("corrupt b-tree node")
+	}
+	n := &btnode{
+		flags:   binary.LittleEndian.Uint16(block[32:]),
+		level:   binary.LittleEndian.Uint16(block[34:]),
+		nkeys:   binary.LittleEndian.Uint32(block[36:]),
+		block:   block,
+		keySize: keySize,
+		valSize: valSize,
+	}
+	tocOff := int(binary.LittleEndian.Uint16(block[40:]))
+	tocLen := int(binary.LittleEndian.Uint16(block[42:]))
+	n.keyBase = btnodeHeaderSize + tocOff + tocLen
+	n.valEnd = len(block)
+	if n.flags&btnodeRoot != 0 {
+		n.valEnd -= btreeInfoSize
+	}
+	if n.keyBase > n.valEnd {
+		return nil, fmt.Errorf("corrupt b-tree node")
+	}
+	n.toc = block[btnodeHeaderSize+tocOff : n.keyBase]
+	entrySize := 8
+	if n.flags&btnodeFixedSize != 0 {
+		entrySize = 4
+	}
+	if uint64(len(n.toc)) < uint64(n.nkeys)*uint64(entrySize) {
+		return nil, fmt.Errorf("corrupt b-tree node")
+	}
+	if !n.leaf() {
+		// index nodes hold the object IDs of their children.
+		n.valSize = 8
+	}
+	return n, nil
+}
+
+// entry returns the key and the value of entry i. Deleted entries have a nil
+// value.
+func (n *btnode) entry(i int) (key, val []byte, err error) {
+	var koff, klen, voff, vlen int
+	if n.flags&btnodeFixedSize != 0 {
+		koff = int(binary.LittleEndian.Uint16(n.toc[4*i:]))
+		voff = int(binary.LittleEndian.Uint16(n.toc[4*i+2:]))
+		klen, vlen = n.keySize, n.valSize
+	} else {
+		koff = int(binary.LittleEndian.Uint16(n.toc[8*i:]))
+		klen = int(binary.LittleEndian.Uint16(n.toc[8*i+2:]))
+		voff = int(binary.LittleEndian.Uint16(n.toc[8*i+4:]))
+		vlen = int(binary.LittleEndian.Uint16(n.toc[8*i+6:]))
+	}
+	kstart := n.keyBase + koff
+	if kstart+klen > n.valEnd {
+		return nil, nil, fmt.Errorf("corrupt b-tree entry")
+	}
+	key = n.block[kstart : kstart+klen]
+	if voff == btoffInvalid {
+		return key, nil, nil
+	}
+	vstart := n.valEnd - voff
+	if vstart < n.keyBase || vstart+vlen > n.valEnd {
+		return nil, nil, fmt.Errorf("corrupt b-tree entry")
+	}
+	return key, n.block[vstart : vstart+vlen], nil
+}
+
+// child returns the object ID stored in entry i of an index node.
+func (n *btnode) child(i int) (uint64, error) {
+	_, val, err := n.entry(i)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) < 8 {
+		return 0, fmt.Errorf("corrupt b-tree index entry")
+	}
+	return binary.LittleEndian.Uint64(val), nil
+}
@@ -0,0 +1,128 @@
+package dmgutils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WithProgress calls progress with the completion percentage of Convert,
+// Resize and Compact, as reported by hdiutil -puppetstrings. A negative
+// percentage means hdiutil can't estimate the progress of the current step.
+func WithProgress(progress func(percent float64)) Option {
+	return func(o *hdiutil) {
+		o.progress = progress
+	}
+}
+
+// Overwrite lets Convert replace an existing destination image.
+func Overwrite() Option {
+	return func(o *hdiutil) {
+		o.overwrite = true
+	}
+}
+
+// Convert converts the image at src to a new image at dst with the format,
+// such as converting a read/write UDRW image to a compressed UDZO or ULFO
+// image for distribution. Encrypted images are unlocked with the passphrase
+// or keychain options.
+func Convert(src, dst string, format Format, opts ...Option) error {
+	args := []string{src, "-format", string(format), "-o", dst}
+	o := new(hdiutil)
+	if err := o.apply(opts...); err != nil {
+		return err
+	}
+	if o.overwrite {
+		args = append(args, "-ov")
+	}
+	return o.runProgress("convert", append(args, o.unlockArgs()...)...)
+}
+
+// Resize resizes the image at dmgpath to size bytes, rounded up to a whole
+// number of sectors. The file system of the image is resized with it.
+func Resize(dmgpath string, size int64, opts ...Option) error {
+	sectors := (size + sectorSize - 1) / sectorSize
+	o := new(hdiutil)
+	if err := o.apply(opts...); err != nil {
+		return err
+	}
+	args := []string{"-sectors", strconv.FormatInt(sectors, 10), dmgpath}
+	return o.runProgress("resize", append(args, o.unlockArgs()...)...)
+}
+
+// Compact reclaims the unused space of a sparse image or sparse bundle.
+func Compact(dmgpath string, opts ...Option) error {
+	o := new(hdiutil)
+	if err := o.apply(opts...); err != nil {
+		return err
+	}
+	return o.runProgress("compact", append([]string{dmgpath}, o.unlockArgs()...)...)
+}
+
+// runProgress runs an hdiutil verb with -puppetstrings, reporting its
+// progress until it exits. Canceling the context kills hdiutil, and returns
+// the error of the context.
+func (o *hdiutil) runProgress(verb string, args ...string) error {
+	if o.ctx == nil {
+		o.ctx = context.Background()
+	}
+	if _, ok := o.ctx.Deadline(); !ok {
+		var cancel func()
+		o.ctx, cancel = context.WithTimeout(o.ctx, 1*time.Hour)
+		defer cancel()
+	}
+
+	args = append(append([]string{verb}, args...), "-puppetstrings")
+	cmd := exec.CommandContext(o.ctx, hdiutilPath, append(args, o.args...)...)
+	cmd.Stdin = o.stdin()
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	parsePuppetStrings(stdout, o.progress)
+	err = cmd.Wait()
+	if ctxErr := o.ctx.Err(); err != nil && ctxErr != nil {
+		return ctxErr
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	if err != nil {
+		return hdiutilError(verb, err)
+	}
+	return nil
+}
+
+// parsePuppetStrings reads the output of hdiutil -puppetstrings, calling
+// progress for each PERCENT line:
+//
+//	PERCENT:-1.000000
+//	MESSAGE:Reading whole disk (Apple_HFS : 0)…
+//	PERCENT:42.500000
+func parsePuppetStrings(r io.Reader, progress func(percent float64)) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, "PERCENT:") || progress == nil {
+			continue
+		}
+		percent, err := strconv.ParseFloat(strings.TrimPrefix(line, "PERCENT:"), 64)
+		if err != nil {
+			continue
+		}
+		progress(percent)
+	}
+	// drain the output if a line was too long, so hdiutil doesn't block.
+	io.Copy(ioutil.Discard, r)
+}
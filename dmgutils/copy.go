@@ -0,0 +1,180 @@
+package dmgutils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// CopyBundle copies the bundle or file at src to dst, like ditto. Permissions,
+// modification times and extended attributes, which include the resource
+// forks on macOS, are preserved. Ownership is preserved when running as root.
+// dst must not exist.
+func CopyBundle(dst, src string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("dmgutils: copy %s: %s already exists", src, dst)
+	}
+	// directories are created writable, and get their mode and times once
+	// their contents are copied.
+	var dirs []string
+	err := filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			if err := os.Mkdir(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, rel)
+			return nil
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			if err := copyFile(target, path); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("dmgutils: copy %s: unsupported file type %s", path, mode.Type())
+		}
+		return copyMetadata(target, path, fi)
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(src, dirs[i])
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if err := copyMetadata(filepath.Join(dst, dirs[i]), path, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// copyMetadata copies the extended attributes, the owner, the mode and the
+// modification time of src to dst.
+func copyMetadata(dst, src string, fi os.FileInfo) error {
+	if err := copyXattrs(dst, src); err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		err := os.Lchown(dst, int(st.Uid), int(st.Gid))
+		if err != nil && os.Geteuid() == 0 {
+			return err
+		}
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	mode := fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	if err := os.Chmod(dst, mode); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// copyXattrs copies the extended attributes of src to dst. File systems
+// which don't support extended attributes are ignored.
+func copyXattrs(dst, src string) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, name, value, 0); err != nil && !xattrUnsupported(err) {
+			return fmt.Errorf("dmgutils: set %s on %s: %w", name, dst, err)
+		}
+	}
+	return nil
+}
+
+func xattrUnsupported(err error) bool {
+	// Linux only allows user attributes on regular files and directories.
+	return err == unix.ENOTSUP || err == unix.EOPNOTSUPP || err == unix.EPERM
+}
+
+func listXattrs(path string) ([]string, error) {
+	buf, err := readXattr(func(buf []byte) (int, error) { return unix.Llistxattr(path, buf) })
+	if xattrUnsupported(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("dmgutils: list attributes of %s: %w", path, err)
+	}
+	var names []string
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(path, name string) ([]byte, error) {
+	buf, err := readXattr(func(buf []byte) (int, error) { return unix.Lgetxattr(path, name, buf) })
+	if err != nil {
+		return nil, fmt.Errorf("dmgutils: get %s of %s: %w", name, path, err)
+	}
+	return buf, nil
+}
+
+// readXattr calls read with a nil buffer to get the size of the data, then
+// with a buffer of that size, retrying if the data grew in between.
+func readXattr(read func([]byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := read(buf)
+		if err == unix.ERANGE {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
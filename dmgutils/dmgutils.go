@@ -4,7 +4,10 @@ package dmgutils
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"os/exec"
+	"regexp"
 	"strings"
 	"time"
 
@@ -17,8 +20,20 @@ type Option func(*hdiutil)
 type hdiutil struct {
 	ctx              context.Context
 	args             []string
+	mountPoint       string
 	randomMountPoint bool
+	mountRoot        string
 	useShadow        bool
+	shadowPath       string
+	readOnly         bool
+	noVerify         bool
+	noAutoOpen       bool
+	owners           *bool
+	passphrase       []byte
+	recoverKeychain  string
+	acceptLicense    bool
+	progress         func(percent float64)
+	overwrite        bool
 	appliedOpts      bool
 }
 
@@ -42,16 +57,163 @@ func WithContext(ctx context.Context) Option {
 	}
 }
 
+// WithMountPoint mounts the image at path instead of in /Volumes.
+func WithMountPoint(path string) Option {
+	return func(o *hdiutil) {
+		o.mountPoint = path
+		o.randomMountPoint = false
+	}
+}
+
+// WithRandomMountPoint mounts the image in a randomly named directory created
+// in root. This avoids collisions between images with the same volume name.
+func WithRandomMountPoint(root string) Option {
+	return func(o *hdiutil) {
+		o.randomMountPoint = true
+		o.mountRoot = root
+		o.mountPoint = ""
+	}
+}
+
+// WithShadow attaches the image with a shadow file, which receives all the
+// writes to the image. The original image is never modified.
+// If path is empty, hdiutil creates the shadow file next to the image.
+func WithShadow(path string) Option {
+	return func(o *hdiutil) {
+		o.useShadow = true
+		o.shadowPath = path
+	}
+}
+
+// ReadOnly attaches the image read-only.
+func ReadOnly() Option {
+	return func(o *hdiutil) {
+		o.readOnly = true
+	}
+}
+
+// NoVerify skips verifying the image checksums before attaching.
+func NoVerify() Option {
+	return func(o *hdiutil) {
+		o.noVerify = true
+	}
+}
+
+// NoAutoOpen stops the Finder from opening the mounted volumes.
+func NoAutoOpen() Option {
+	return func(o *hdiutil) {
+		o.noAutoOpen = true
+	}
+}
+
+// WithOwners enables or disables owners on the mounted volumes.
+func WithOwners(enabled bool) Option {
+	return func(o *hdiutil) {
+		o.owners = &enabled
+	}
+}
+
+// WithPassphrase unlocks an encrypted image with passphrase. The passphrase is
+// written to the standard input of hdiutil, never to its arguments or
+// environment.
+func WithPassphrase(passphrase string) Option {
+	return func(o *hdiutil) {
+		o.passphrase = []byte(passphrase)
+	}
+}
+
+// WithRecoveryKeychain unlocks an image which was encrypted with a certificate,
+// using the private key stored in keychain.
+func WithRecoveryKeychain(keychain string) Option {
+	return func(o *hdiutil) {
+		o.recoverKeychain = keychain
+	}
+}
+
+// WithExtraArgs appends arguments to the hdiutil command, after the arguments
+// set by the other options, such as "-quiet" or "-debug". Use it for flags
+// without an option.
+func WithExtraArgs(args ...string) Option {
+	return func(o *hdiutil) {
+		o.args = append(o.args, args...)
+	}
+}
+
+// stdin returns the standard input for hdiutil, which holds the passphrase
+// when one is set, followed by the answer to the license agreement prompt when
+// the license is accepted.
+func (o *hdiutil) stdin() io.Reader {
+	var in []byte
+	if o.passphrase != nil {
+		// -stdinpass reads a null terminated passphrase.
+		in = append(append(in, o.passphrase...), 0)
+	}
+	if o.acceptLicense {
+		in = append(in, "Y\n"...)
+	}
+	if in == nil {
+		return nil
+	}
+	return bytes.NewReader(in)
+}
+
+// unlockArgs returns the arguments for the passphrase and keychain options.
+func (o *hdiutil) unlockArgs() []string {
+	var args []string
+	if o.passphrase != nil {
+		args = append(args, "-stdinpass")
+	}
+	if o.recoverKeychain != "" {
+		args = append(args, "-recover", o.recoverKeychain)
+	}
+	return args
+}
+
+// attachArgs returns the hdiutil attach arguments for the options.
+func (o *hdiutil) attachArgs() []string {
+	var args []string
+	switch {
+	case o.mountPoint != "":
+		args = append(args, "-mountpoint", o.mountPoint)
+	case o.randomMountPoint:
+		args = append(args, "-mountrandom", o.mountRoot)
+	}
+	if o.useShadow {
+		args = append(args, "-shadow")
+		if o.shadowPath != "" {
+			args = append(args, o.shadowPath)
+		}
+	}
+	if o.readOnly {
+		args = append(args, "-readonly")
+	}
+	if o.noVerify {
+		args = append(args, "-noverify")
+	}
+	if o.noAutoOpen {
+		args = append(args, "-noautoopen")
+	}
+	if o.owners != nil {
+		if *o.owners {
+			args = append(args, "-owners", "on")
+		} else {
+			args = append(args, "-owners", "off")
+		}
+	}
+	args = append(args, o.unlockArgs()...)
+	return append(args, o.args...)
+}
+
 func mountcmd(ctx context.Context, dmgpath string, extraArgs ...string) *exec.Cmd {
-	hdiutil := "/usr/bin/hdiutil"
 	args := []string{"attach", dmgpath, "-nobrowse", "-plist"}
-	return exec.CommandContext(ctx, hdiutil, args...)
+	args = append(args, extraArgs...)
+	return exec.CommandContext(ctx, hdiutilPath, args...)
 }
 
 func unmountcmd(ctx context.Context, dmgpath string, extraArgs ...string) *exec.Cmd {
-	hdiutil := "/usr/bin/hdiutil"
 	args := []string{"detach", dmgpath}
-	return exec.CommandContext(ctx, hdiutil, args...)
+	args = append(args, extraArgs...)
+	return exec.CommandContext(ctx, hdiutilPath, args...)
 }
 
 type dmgAttachHeader struct {
@@ -63,11 +225,12 @@ type systemEntities struct {
 }
 
 type mounts struct {
-	ContentHint         string `plist:"content-hint"`
-	DevEntry            string `plist:"dev-entry"`
-	MountPoint          string `plist:"mount-point"`
-	UnmappedContentHint string `plist:"unmapped-content-hint"`
-	VolumeKind          string `plist:"volume-kind"`
+	ContentHint          string `plist:"content-hint"`
+	DevEntry             string `plist:"dev-entry"`
+	MountPoint           string `plist:"mount-point"`
+	PotentiallyMountable bool   `plist:"potentially-mountable"`
+	UnmappedContentHint  string `plist:"unmapped-content-hint"`
+	VolumeKind           string `plist:"volume-kind"`
 }
 
 func (p *systemEntities) UnmarshalPlist(f func(i interface{}) error) error {
@@ -80,10 +243,96 @@ func (p *systemEntities) UnmarshalPlist(f func(i interface{}) error) error {
 	return nil
 }
 
-// MountDMG mounts a macOS dmg, returning a mount path on success.
-func MountDMG(dmgpath string, opts ...Option) (mountedpaths []string, err error) {
-	o := new(hdiutil)
+// Image is an attached disk image.
+type Image struct {
+	// Path is the path of the image file.
+	Path string
+	// Entities are the device nodes created for the image, in the order
+	// hdiutil reported them. The whole disk comes first, followed by its
+	// partitions. APFS images also list the synthesized container disk and
+	// its volumes.
+	Entities []Entity
+}
+
+// Entity is a device node of an attached image.
+type Entity struct {
+	// DevEntry is the device node, such as /dev/disk4s1.
+	DevEntry string
+	// ContentHint is the partition type, such as Apple_HFS or
+	// GUID_partition_scheme for the whole disk.
+	ContentHint string
+	// UnmappedContentHint is the raw partition type GUID, if any.
+	UnmappedContentHint string
+	// VolumeKind is the filesystem, such as hfs or apfs.
+	VolumeKind string
+	// MountPoint is empty if the entity wasn't mounted.
+	MountPoint           string
+	PotentiallyMountable bool
+}
+
+var wholeDisk = regexp.MustCompile(`^/dev/disk[0-9]+$`)
+
+// Device returns the whole disk device of the image, such as /dev/disk4.
+// Detaching this device detaches all the partitions and volumes of the image.
+func (img *Image) Device() string {
+	for _, e := range img.Entities {
+		if wholeDisk.MatchString(e.DevEntry) {
+			return e.DevEntry
+		}
+	}
+	return ""
+}
+
+// MountPoints returns the paths of the mounted volumes of the image.
+func (img *Image) MountPoints() []string {
 	mountpoints := []string{}
+	for _, e := range img.Entities {
+		if e.MountPoint != "" {
+			mountpoints = append(mountpoints, e.MountPoint)
+		}
+	}
+	return mountpoints
+}
+
+func parseAttach(dmgpath string, out []byte) (*Image, error) {
+	// when a license agreement is accepted, hdiutil prints the license
+	// before the plist.
+	for _, start := range []string{"<?xml", "<plist"} {
+		if i := bytes.Index(out, []byte(start)); i >= 0 {
+			out = out[i:]
+			break
+		}
+	}
+	var p dmgAttachHeader
+	if err := plist.NewDecoder(bytes.NewReader(out)).Decode(&p); err != nil {
+		return nil, err
+	}
+
+	return &Image{Path: dmgpath, Entities: parseEntities(p.SystemEntities)}, nil
+}
+
+func parseEntities(elements []systemEntities) []Entity {
+	var entities []Entity
+	for _, element := range elements {
+		if element.mounts == nil {
+			continue
+		}
+		entities = append(entities, Entity{
+			DevEntry:             strings.TrimSpace(element.mounts.DevEntry),
+			ContentHint:          element.mounts.ContentHint,
+			UnmappedContentHint:  element.mounts.UnmappedContentHint,
+			VolumeKind:           element.mounts.VolumeKind,
+			MountPoint:           strings.TrimSpace(element.mounts.MountPoint),
+			PotentiallyMountable: element.mounts.PotentiallyMountable,
+		})
+	}
+	return entities
+}
+
+// Attach attaches a disk image, returning all the device nodes and mount
+// points hdiutil created for it.
+func Attach(dmgpath string, opts ...Option) (*Image, error) {
+	o := new(hdiutil)
 	o.ctx = context.Background()
 	if err := o.apply(opts...); err != nil {
 		return nil, err
@@ -95,26 +344,42 @@ func MountDMG(dmgpath string, opts ...Option) (mountedpaths []string, err error)
 		defer cancel()
 	}
 
-	cmd := mountcmd(o.ctx, dmgpath, o.args...)
+	if !o.acceptLicense {
+		// if the check fails, leave it to hdiutil to report the problem.
+		if sla, err := HasLicenseAgreement(dmgpath); err == nil && sla {
+			return nil, ErrLicenseAgreement
+		}
+	}
+
+	cmd := mountcmd(o.ctx, dmgpath, o.attachArgs()...)
+	cmd.Stdin = o.stdin()
 
 	out, err := cmd.Output()
 	if err != nil {
-		return nil, err
+		return nil, hdiutilError("attach", err)
 	}
-	buf := bytes.NewBuffer(out)
+	return parseAttach(dmgpath, out)
+}
 
-	var p dmgAttachHeader
-	if err := plist.NewDecoder(buf).Decode(&p); err != nil {
-		return nil, err
+// Detach detaches an image attached with Attach. The image is detached by its
+// whole disk device, which also removes any partitions or APFS containers of
+// the image. Will attempt to force detach if normal detach is unsuccessful.
+func Detach(img *Image, opts ...Option) error {
+	dev := img.Device()
+	if dev == "" {
+		return fmt.Errorf("dmgutils: no whole disk device for %s", img.Path)
 	}
+	_, err := UnmountDMG(dev, opts...)
+	return err
+}
 
-	for _, element := range p.SystemEntities {
-		if element.mounts.MountPoint != "" {
-			mountpoints = append(mountpoints, strings.TrimSpace(element.mounts.MountPoint))
-		}
+// MountDMG mounts a macOS dmg, returning a mount path on success.
+func MountDMG(dmgpath string, opts ...Option) (mountedpaths []string, err error) {
+	img, err := Attach(dmgpath, opts...)
+	if err != nil {
+		return nil, err
 	}
-
-	return mountpoints, nil
+	return img.MountPoints(), nil
 }
 
 // UnmountDMG unmounts a macOS dmg, returns bool for success/failure
@@ -135,7 +400,8 @@ func UnmountDMG(dmgpath string, opts ...Option) (result bool, err error) {
 	cmd := unmountcmd(o.ctx, dmgpath, o.args...)
 	if _, err := cmd.Output(); err != nil {
 		// ordinary unmount unsuccessful, try forcing
-		cmd := unmountcmd(o.ctx, dmgpath, "-force")
+		args := append(append([]string{}, o.args...), "-force")
+		cmd := unmountcmd(o.ctx, dmgpath, args...)
 		_, err := cmd.Output()
 		if err != nil {
 			return false, err
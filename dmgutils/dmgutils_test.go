@@ -0,0 +1,1294 @@
+package dmgutils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	plist "github.com/groob/plist"
+	"golang.org/x/sys/unix"
+
+	"github.com/groob/mackit/install/pkg"
+)
+
+func Test_mountcmd(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		want []string
+	}{
+		{
+			name: "default",
+			want: []string{"/usr/bin/hdiutil", "attach", "/tmp/foo.dmg", "-nobrowse", "-plist"},
+		},
+		{
+			name: "mount point",
+			opts: []Option{WithMountPoint("/tmp/mnt"), ReadOnly(), NoVerify(), NoAutoOpen()},
+			want: []string{"/usr/bin/hdiutil", "attach", "/tmp/foo.dmg", "-nobrowse", "-plist",
+				"-mountpoint", "/tmp/mnt", "-readonly", "-noverify", "-noautoopen"},
+		},
+		{
+			name: "random mount point replaces mount point",
+			opts: []Option{WithMountPoint("/tmp/mnt"), WithRandomMountPoint("/tmp/root"), WithOwners(false)},
+			want: []string{"/usr/bin/hdiutil", "attach", "/tmp/foo.dmg", "-nobrowse", "-plist",
+				"-mountrandom", "/tmp/root", "-owners", "off"},
+		},
+		{
+			name: "shadow",
+			opts: []Option{WithShadow("/tmp/foo.shadow"), WithOwners(true)},
+			want: []string{"/usr/bin/hdiutil", "attach", "/tmp/foo.dmg", "-nobrowse", "-plist",
+				"-shadow", "/tmp/foo.shadow", "-owners", "on"},
+		},
+		{
+			name: "default shadow",
+			opts: []Option{WithShadow("")},
+			want: []string{"/usr/bin/hdiutil", "attach", "/tmp/foo.dmg", "-nobrowse", "-plist", "-shadow"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := new(hdiutil)
+			if err := o.apply(tt.opts...); err != nil {
+				t.Fatal(err)
+			}
+			cmd := mountcmd(context.Background(), "/tmp/foo.dmg", o.attachArgs()...)
+			if !reflect.DeepEqual(cmd.Args, tt.want) {
+				t.Errorf("have %v, want %v", cmd.Args, tt.want)
+			}
+		})
+	}
+}
+
+func Test_unmountcmd(t *testing.T) {
+	want := []string{"/usr/bin/hdiutil", "detach", "/Volumes/foo", "-force"}
+	cmd := unmountcmd(context.Background(), "/Volumes/foo", "-force")
+	if !reflect.DeepEqual(cmd.Args, want) {
+		t.Errorf("have %v, want %v", cmd.Args, want)
+	}
+}
+
+func Test_parseAttach(t *testing.T) {
+	out := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>system-entities</key>
+	<array>
+		<dict>
+			<key>content-hint</key>
+			<string>GUID_partition_scheme</string>
+			<key>dev-entry</key>
+			<string>/dev/disk4</string>
+			<key>potentially-mountable</key>
+			<false/>
+			<key>unmapped-content-hint</key>
+			<string>GUID_partition_scheme</string>
+		</dict>
+		<dict>
+			<key>content-hint</key>
+			<string>Apple_APFS</string>
+			<key>dev-entry</key>
+			<string>/dev/disk4s1</string>
+			<key>potentially-mountable</key>
+			<false/>
+			<key>unmapped-content-hint</key>
+			<string>7C3457EF-0000-11AA-AA11-00306543ECAC</string>
+		</dict>
+		<dict>
+			<key>content-hint</key>
+			<string>EF57347C-0000-11AA-AA11-00306543ECAC</string>
+			<key>dev-entry</key>
+			<string>/dev/disk5</string>
+			<key>potentially-mountable</key>
+			<false/>
+			<key>unmapped-content-hint</key>
+			<string>EF57347C-0000-11AA-AA11-00306543ECAC</string>
+		</dict>
+		<dict>
+			<key>content-hint</key>
+			<string>41504653-0000-11AA-AA11-00306543ECAC</string>
+			<key>dev-entry</key>
+			<string>/dev/disk5s1</string>
+			<key>mount-point</key>
+			<string>/Volumes/Foo</string>
+			<key>potentially-mountable</key>
+			<true/>
+			<key>unmapped-content-hint</key>
+			<string>41504653-0000-11AA-AA11-00306543ECAC</string>
+			<key>volume-kind</key>
+			<string>apfs</string>
+		</dict>
+	</array>
+</dict>
+</plist>`)
+
+	img, err := parseAttach("/tmp/foo.dmg", out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(img.Entities), 4; have != want {
+		t.Fatalf("have %d entities, want %d", have, want)
+	}
+	if have, want := img.Device(), "/dev/disk4"; have != want {
+		t.Errorf("have device %s, want %s", have, want)
+	}
+	if have, want := img.MountPoints(), []string{"/Volumes/Foo"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have mount points %v, want %v", have, want)
+	}
+	volume := img.Entities[3]
+	if volume.VolumeKind != "apfs" || !volume.PotentiallyMountable || volume.DevEntry != "/dev/disk5s1" {
+		t.Errorf("unexpected volume entity %+v", volume)
+	}
+	if have, want := img.Entities[1].ContentHint, "Apple_APFS"; have != want {
+		t.Errorf("have content hint %s, want %s", have, want)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	o := new(hdiutil)
+	if err := o.apply(WithPassphrase("secret"), WithRecoveryKeychain("/tmp/recovery.keychain")); err != nil {
+		t.Fatal(err)
+	}
+	args := o.attachArgs()
+	for _, arg := range args {
+		if strings.Contains(arg, "secret") {
+			t.Fatalf("passphrase in arguments: %v", args)
+		}
+	}
+	if want := []string{"-stdinpass", "-recover", "/tmp/recovery.keychain"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("have %v, want %v", args, want)
+	}
+	stdin, err := ioutil.ReadAll(o.stdin())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(stdin), "secret\x00"; have != want {
+		t.Errorf("have stdin %q, want %q", have, want)
+	}
+
+	if new(hdiutil).stdin() != nil {
+		t.Error("expected no stdin without a passphrase")
+	}
+}
+
+func TestWithExtraArgs(t *testing.T) {
+	o := new(hdiutil)
+	if err := o.apply(ReadOnly(), WithExtraArgs("-quiet"), WithExtraArgs("-drivekey", "a=b")); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := o.attachArgs(), []string{"-readonly", "-quiet", "-drivekey", "a=b"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have attach args %v, want %v", have, want)
+	}
+
+	defer func(path string) { hdiutilPath = path }(hdiutilPath)
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	hdiutilPath = filepath.Join(dir, "hdiutil")
+	script := "#!/bin/sh\necho \"$@\" > " + argsPath + "\n"
+	if err := ioutil.WriteFile(hdiutilPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := UnmountDMG("/dev/disk4", WithExtraArgs("-quiet")); err != nil {
+		t.Fatal(err)
+	}
+	args, err := ioutil.ReadFile(argsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.TrimSpace(string(args)), "detach /dev/disk4 -quiet"; have != want {
+		t.Errorf("have detach args %q, want %q", have, want)
+	}
+}
+
+func Test_hdiutilError(t *testing.T) {
+	tests := []struct {
+		stderr string
+		want   error
+	}{
+		{"hdiutil: attach failed - Authentication error", ErrAuthentication},
+		{"hdiutil: attach failed - corrupt image", ErrCorruptImage},
+		{"hdiutil: attach failed - image not recognized", ErrCorruptImage},
+		{"hdiutil: attach failed - no mountable file systems", nil},
+	}
+	for _, tt := range tests {
+		_, err := exec.Command("sh", "-c", "echo '"+tt.stderr+"' >&2; exit 1").Output()
+		err = hdiutilError("attach", err)
+		hdiErr, ok := err.(*Error)
+		if !ok {
+			t.Fatalf("%s: have %T, want *Error", tt.stderr, err)
+		}
+		if have, want := hdiErr.Output, tt.stderr; have != want {
+			t.Errorf("have output %q, want %q", have, want)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: have %v, want %v", tt.stderr, err, tt.want)
+		}
+		if tt.want == nil && (errors.Is(err, ErrAuthentication) || errors.Is(err, ErrCorruptImage)) {
+			t.Errorf("%s: unexpected %v", tt.stderr, err)
+		}
+	}
+}
+
+func TestHasLicenseAgreement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackit-dmg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(f func(string) string) { rsrcForkPath = f }(rsrcForkPath)
+	rsrcForkPath = func(path string) string { return path + ".rsrc" }
+
+	tests := []struct {
+		name      string
+		resources map[string][]udifResource
+		// rsrc is a resource fork stored in the image, and fileRsrc the
+		// resource fork of the image file.
+		rsrc     []byte
+		fileRsrc []byte
+		want     bool
+	}{
+		{
+			name:      "no license",
+			resources: map[string][]udifResource{"plst": {{ID: "0", Name: "", Data: []byte{0}}}},
+		},
+		{
+			name: "license",
+			resources: map[string][]udifResource{
+				"LPic": {{ID: "5000", Name: "", Data: []byte{0, 0, 0, 1, 0, 0, 0, 0}}},
+				"TEXT": {{ID: "5000", Name: "English SLA", Data: []byte("license text")}},
+			},
+			want: true,
+		},
+		{
+			name: "no license in resource fork",
+			rsrc: buildResourceFork(t, "plst", "TEXT"),
+		},
+		{
+			name: "license in resource fork",
+			rsrc: buildResourceFork(t, "LPic", "STR#", "TEXT"),
+			want: true,
+		},
+		{
+			name:     "license in file resource fork",
+			fileRsrc: buildResourceFork(t, "LPic", "TEXT"),
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "test.dmg")
+			img := buildUDIF(t, append(tt.rsrc, "data fork"...), tt.resources)
+			if tt.rsrc != nil {
+				setKoly(t, img, func(k *koly) {
+					k.RsrcForkLength = uint64(len(tt.rsrc))
+				})
+			}
+			if err := ioutil.WriteFile(path, img, 0644); err != nil {
+				t.Fatal(err)
+			}
+			os.Remove(path + ".rsrc")
+			if tt.fileRsrc != nil {
+				if err := ioutil.WriteFile(path+".rsrc", tt.fileRsrc, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			have, err := HasLicenseAgreement(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have != tt.want {
+				t.Errorf("have %v, want %v", have, tt.want)
+			}
+
+			if !tt.want {
+				return
+			}
+			if _, err := Attach(path); err != ErrLicenseAgreement {
+				t.Errorf("have attach error %v, want %v", err, ErrLicenseAgreement)
+			}
+		})
+	}
+
+	t.Run("not udif", func(t *testing.T) {
+		path := filepath.Join(dir, "test.iso")
+		if err := ioutil.WriteFile(path, make([]byte, 4096), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if have, err := HasLicenseAgreement(path); err != nil || have {
+			t.Errorf("have %v, %v, want false, nil", have, err)
+		}
+	})
+}
+
+// buildResourceFork creates a classic resource fork with an empty resource
+// of each type.
+func buildResourceFork(t *testing.T, types ...string) []byte {
+	var m bytes.Buffer
+	m.Write(make([]byte, 24))
+	binary.Write(&m, binary.BigEndian, []uint16{28, uint16(28 + 2 + len(types)*20)})
+	binary.Write(&m, binary.BigEndian, uint16(len(types)-1))
+	for i, typ := range types {
+		m.WriteString(typ)
+		binary.Write(&m, binary.BigEndian, []uint16{0, uint16(2 + len(types)*8 + i*12)})
+	}
+	for i := range types {
+		// the ID, no name, and the attributes and data offset.
+		binary.Write(&m, binary.BigEndian, []uint16{uint16(128 + i), 0xffff})
+		binary.Write(&m, binary.BigEndian, []uint32{0, 0})
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, []uint32{256, 256, 0, uint32(m.Len())}); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(make([]byte, 256-buf.Len()))
+	buf.Write(m.Bytes())
+	return buf.Bytes()
+}
+
+func TestAcceptLicenseStdin(t *testing.T) {
+	o := new(hdiutil)
+	if err := o.apply(WithPassphrase("secret"), AcceptLicense()); err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := ioutil.ReadAll(o.stdin())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(stdin), "secret\x00Y\n"; have != want {
+		t.Errorf("have stdin %q, want %q", have, want)
+	}
+}
+
+func TestAttachAcceptLicense(t *testing.T) {
+	defer func(path string) { hdiutilPath = path }(hdiutilPath)
+	dir := t.TempDir()
+	stdinPath := filepath.Join(dir, "stdin")
+	hdiutilPath = filepath.Join(dir, "hdiutil")
+	// hdiutil pages the license, and prints the plist once it's accepted.
+	script := `#!/bin/sh
+cat > ` + stdinPath + `
+cat <<'EOF'
+Software License Agreement
+
+By using this software, you agree to the terms of this <license>.
+Agree Y/N? <?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>system-entities</key>
+	<array>
+		<dict>
+			<key>dev-entry</key>
+			<string>/dev/disk4</string>
+			<key>content-hint</key>
+			<string>Apple_HFS</string>
+			<key>mount-point</key>
+			<string>/Volumes/Foo</string>
+		</dict>
+	</array>
+</dict>
+</plist>
+EOF
+`
+	if err := ioutil.WriteFile(hdiutilPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := Attach(filepath.Join(dir, "license.dmg"), AcceptLicense())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := img.MountPoints(), []string{"/Volumes/Foo"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have mount points %v, want %v", have, want)
+	}
+	if stdin, err := ioutil.ReadFile(stdinPath); err != nil || string(stdin) != "Y\n" {
+		t.Errorf("have stdin %q, %v, want %q", stdin, err, "Y\n")
+	}
+}
+
+func TestUDIFReader(t *testing.T) {
+	var fork bytes.Buffer
+	chunk := func(typ uint32, sector, count uint64, data []byte) mishChunk {
+		c := mishChunk{
+			Type:             typ,
+			SectorNumber:     sector,
+			SectorCount:      count,
+			CompressedOffset: uint64(fork.Len()),
+			CompressedLength: uint64(len(data)),
+		}
+		fork.Write(data)
+		return c
+	}
+	sector := func(b byte, n int) []byte { return bytes.Repeat([]byte{b}, n*512) }
+
+	var zlibData bytes.Buffer
+	zw := zlib.NewWriter(&zlibData)
+	zw.Write(sector('z', 2))
+	zw.Close()
+	lzfseData := append([]byte("bvx-\x00\x02\x00\x00"), sector('l', 1)...)
+	lzfseData = append(lzfseData, "bvx$"...)
+
+	hfs := buildBlockTable(t, 0, 8, []mishChunk{
+		chunk(chunkRaw, 0, 1, sector('r', 1)),
+		chunk(chunkZlib, 1, 2, zlibData.Bytes()),
+		chunk(chunkZero, 3, 1, nil),
+		chunk(chunkBzip2, 4, 1, bzip2Sector),
+		chunk(chunkLZMA, 5, 1, xzSector),
+		chunk(chunkLZFSE, 6, 1, lzfseData),
+		chunk(chunkIgnore, 7, 1, nil),
+		{Type: chunkComment},
+		{Type: chunkEnd, SectorNumber: 8},
+	})
+	// sector 8 isn't in any table.
+	ddm := buildBlockTable(t, 9, 1, []mishChunk{
+		chunk(chunkRaw, 0, 1, sector('p', 1)),
+		{Type: chunkEnd, SectorNumber: 1},
+	})
+
+	img := buildUDIF(t, fork.Bytes(), map[string][]udifResource{
+		"blkx": {
+			{Name: "disk image (Apple_HFS : 1)", Data: hfs},
+			{Name: "Driver Descriptor Map (DDM : 0)", Data: ddm},
+		},
+	})
+	setKoly(t, img, func(k *koly) {
+		k.SectorCount = 10
+		k.DataChecksumType = checksumCRC32
+		k.DataChecksumSize = 32
+		binary.BigEndian.PutUint32(k.DataChecksum[:], crc32.ChecksumIEEE(fork.Bytes()))
+	})
+
+	path := filepath.Join(t.TempDir(), "test.dmg")
+	if err := ioutil.WriteFile(path, img, 0644); err != nil {
+		t.Fatal(err)
+	}
+	u, err := OpenUDIF(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	if have, want := u.Size(), int64(10*512); have != want {
+		t.Errorf("have size %d, want %d", have, want)
+	}
+	wantParts := []Partition{
+		{Name: "disk image (Apple_HFS : 1)", Type: "Apple_HFS", Offset: 0, Size: 8 * 512},
+		{Name: "Driver Descriptor Map (DDM : 0)", Type: "DDM", Offset: 9 * 512, Size: 512},
+	}
+	if have := u.Partitions(); !reflect.DeepEqual(have, wantParts) {
+		t.Errorf("have partitions %+v, want %+v", have, wantParts)
+	}
+
+	want := bytes.Join([][]byte{
+		sector('r', 1), sector('z', 2), sector(0, 1), sector('b', 1),
+		sector('x', 1), sector('l', 1), sector(0, 2), sector('p', 1),
+	}, nil)
+	have, err := ioutil.ReadAll(io.NewSectionReader(u, 0, u.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("disk image doesn't match")
+	}
+
+	// reads spanning chunks, and past the end of the image.
+	buf := make([]byte, 1024)
+	if n, err := u.ReadAt(buf, 1000); err != nil || !bytes.Equal(buf[:n], want[1000:2024]) {
+		t.Errorf("read across chunks: have %d, %v", n, err)
+	}
+	if n, err := u.ReadAt(buf, u.Size()-10); err != io.EOF || n != 10 {
+		t.Errorf("read past end: have %d, %v, want 10, EOF", n, err)
+	}
+	if _, err := u.FS(); err != ErrNoFileSystem {
+		t.Errorf("have %v, want %v", err, ErrNoFileSystem)
+	}
+
+	t.Run("checksum mismatch", func(t *testing.T) {
+		corrupt := append([]byte(nil), img...)
+		corrupt[0] ^= 0xff
+		if _, err := NewUDIFReader(bytes.NewReader(corrupt), int64(len(corrupt))); err != ErrChecksum {
+			t.Errorf("have %v, want %v", err, ErrChecksum)
+		}
+
+		// the checksum is only verified by Verify.
+		u, err := NewUDIFReader(bytes.NewReader(corrupt), int64(len(corrupt)), SkipChecksum())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := u.Verify(); err != ErrChecksum {
+			t.Errorf("verify: have %v, want %v", err, ErrChecksum)
+		}
+	})
+
+	t.Run("oversized chunk", func(t *testing.T) {
+		// a compressed chunk claiming to hold 1 TiB.
+		table := buildBlockTable(t, 0, 1<<31, []mishChunk{
+			{Type: chunkZlib, SectorCount: 1 << 31, CompressedLength: uint64(zlibData.Len())},
+			{Type: chunkEnd, SectorNumber: 1 << 31},
+		})
+		img := buildUDIF(t, zlibData.Bytes(), map[string][]udifResource{
+			"blkx": {{Name: "disk image (Apple_HFS : 0)", Data: table}},
+		})
+		if _, err := NewUDIFReader(bytes.NewReader(img), int64(len(img))); err == nil || !strings.Contains(err.Error(), "too large") {
+			t.Errorf("have %v, want a chunk size error", err)
+		}
+	})
+}
+
+func TestWriteUDIF(t *testing.T) {
+	// an HFS+ signature, a chunk of zeros and a partial sector.
+	raw := make([]byte, 3*chunkSectors*sectorSize+100)
+	copy(raw[1024:], "H+")
+	for i := chunkSectors * sectorSize; i < len(raw); i++ {
+		if i < 2*chunkSectors*sectorSize || i >= 3*chunkSectors*sectorSize {
+			raw[i] = byte(i % 251)
+		}
+	}
+
+	var tests = []struct {
+		name    string
+		opts    []WriterOption
+		chunk   uint32
+		wantErr bool
+	}{
+		{name: "default", chunk: chunkZlib},
+		{name: "UDBZ", opts: []WriterOption{WithFormat(UDBZ), WithCompressionLevel(9)}, chunk: chunkBzip2},
+		{name: "unsupported format", opts: []WriterOption{WithFormat("ULFO")}, wantErr: true},
+		{name: "invalid level", opts: []WriterOption{WithCompressionLevel(0)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := WriteUDIF(&buf, bytes.NewReader(raw), tt.opts...)
+			if have, want := err != nil, tt.wantErr; have != want {
+				t.Fatalf("have err %v, want error %v", err, want)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			img := buf.Bytes()
+			u, err := NewUDIFReader(bytes.NewReader(img), int64(len(img)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, want := u.Size(), int64(3*chunkSectors+1)*sectorSize; have != want {
+				t.Errorf("have size %d, want %d", have, want)
+			}
+			wantParts := []Partition{{Name: "disk image (Apple_HFS : 0)", Type: "Apple_HFS", Size: u.Size()}}
+			if have := u.Partitions(); !reflect.DeepEqual(have, wantParts) {
+				t.Errorf("have partitions %+v, want %+v", have, wantParts)
+			}
+			have, err := ioutil.ReadAll(io.NewSectionReader(u, 0, u.Size()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append(append([]byte(nil), raw...), make([]byte, sectorSize-100)...)
+			if !bytes.Equal(have, want) {
+				t.Errorf("disk image doesn't match")
+			}
+
+			k, err := readKoly(bytes.NewReader(img), int64(len(img)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resources, err := readResources(bytes.NewReader(img), int64(len(img)), k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			table := resources["blkx"][0].Data
+			var h mishHeader
+			binary.Read(bytes.NewReader(table), binary.BigEndian, &h)
+			if have, want := binary.BigEndian.Uint32(h.Checksum[:]), crc32.ChecksumIEEE(want); have != want {
+				t.Errorf("have block table checksum %x, want %x", have, want)
+			}
+			if have, want := binary.BigEndian.Uint32(k.Checksum[:]), crc32.ChecksumIEEE(h.Checksum[:4]); have != want {
+				t.Errorf("have master checksum %x, want %x", have, want)
+			}
+			var types []uint32
+			for i := 0; i < int(h.ChunkCount); i++ {
+				types = append(types, binary.BigEndian.Uint32(table[204+40*i:]))
+			}
+			if want := []uint32{tt.chunk, tt.chunk, chunkZero, tt.chunk, chunkEnd}; !reflect.DeepEqual(types, want) {
+				t.Errorf("have chunk types %x, want %x", types, want)
+			}
+		})
+	}
+}
+
+func Test_parseImageInfo(t *testing.T) {
+	out := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Checksum Type</key>
+	<string>CRC32</string>
+	<key>Checksum Value</key>
+	<string>$000217E7</string>
+	<key>Class Name</key>
+	<string>CUDIFDiskImage</string>
+	<key>Format</key>
+	<string>UDZO</string>
+	<key>Format Description</key>
+	<string>UDIF read-only compressed (zlib)</string>
+	<key>Properties</key>
+	<dict>
+		<key>Checksummed</key>
+		<true/>
+		<key>Compressed</key>
+		<true/>
+		<key>Encrypted</key>
+		<false/>
+		<key>Partitioned</key>
+		<false/>
+		<key>Software License Agreement</key>
+		<true/>
+	</dict>
+	<key>Size Information</key>
+	<dict>
+		<key>Compressed Bytes</key>
+		<integer>23741</integer>
+		<key>Sector Count</key>
+		<integer>4148</integer>
+		<key>Total Bytes</key>
+		<integer>2123776</integer>
+	</dict>
+	<key>partitions</key>
+	<dict>
+		<key>block-size</key>
+		<integer>512</integer>
+		<key>partition-scheme</key>
+		<string>GUID</string>
+		<key>partitions</key>
+		<array>
+			<dict>
+				<key>partition-hint</key>
+				<string>MBR</string>
+				<key>partition-length</key>
+				<integer>1</integer>
+				<key>partition-name</key>
+				<string>Protective Master Boot Record</string>
+				<key>partition-start</key>
+				<integer>0</integer>
+			</dict>
+			<dict>
+				<key>partition-hint</key>
+				<string>Apple_HFS</string>
+				<key>partition-length</key>
+				<integer>4072</integer>
+				<key>partition-name</key>
+				<string>disk image</string>
+				<key>partition-start</key>
+				<integer>40</integer>
+			</dict>
+		</array>
+	</dict>
+</dict>
+</plist>`)
+
+	have, err := parseImageInfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ImageInfo{
+		Format:          UDZO,
+		PartitionScheme: "GUID",
+		Partitions: []Partition{
+			{Name: "Protective Master Boot Record", Type: "MBR", Offset: 0, Size: 512},
+			{Name: "disk image", Type: "Apple_HFS", Offset: 40 * 512, Size: 4072 * 512},
+		},
+		LicenseAgreement: true,
+		ChecksumType:     "CRC32",
+		Checksum:         "$000217E7",
+		Size:             2123776,
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+}
+
+func TestInfoWithoutHdiutil(t *testing.T) {
+	defer func(path string) { hdiutilPath = path }(hdiutilPath)
+	hdiutilPath = "/nonexistent/hdiutil"
+	dir := t.TempDir()
+
+	// a GUID partitioned disk.
+	raw := make([]byte, 4*sectorSize)
+	copy(raw[sectorSize:], "EFI PART")
+	var img bytes.Buffer
+	if err := WriteUDIF(&img, bytes.NewReader(raw), WithFormat(UDBZ)); err != nil {
+		t.Fatal(err)
+	}
+	udbz := filepath.Join(dir, "test.dmg")
+	if err := ioutil.WriteFile(udbz, img.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	master := binary.BigEndian.Uint32(img.Bytes()[img.Len()-kolySize+0x168:])
+
+	// the master checksum doesn't match the block tables.
+	damaged := append([]byte(nil), img.Bytes()...)
+	binary.BigEndian.PutUint32(damaged[len(damaged)-kolySize+0x168:], master+1)
+	badMaster := filepath.Join(dir, "master.dmg")
+	if err := ioutil.WriteFile(badMaster, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the data fork doesn't match its checksum, which Info doesn't read.
+	damaged = append([]byte(nil), img.Bytes()...)
+	damaged[0] ^= 0xff
+	badData := filepath.Join(dir, "data.dmg")
+	if err := ioutil.WriteFile(badData, damaged, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rawPath := filepath.Join(dir, "test.img")
+	if err := ioutil.WriteFile(rawPath, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	encrypted := filepath.Join(dir, "encrypted.dmg")
+	if err := ioutil.WriteFile(encrypted, []byte("encrcdsa\x00\x00\x00\x02"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		path string
+		want *ImageInfo
+	}{
+		{udbz, &ImageInfo{
+			Format:          UDBZ,
+			PartitionScheme: "GUID",
+			Partitions:      []Partition{{Name: "whole disk (GUID_partition_scheme : 0)", Type: "GUID_partition_scheme", Size: 4 * sectorSize}},
+			ChecksumType:    "CRC32",
+			Checksum:        fmt.Sprintf("$%08X", master),
+			ChecksumValid:   true,
+			Size:            4 * sectorSize,
+		}},
+		{badMaster, &ImageInfo{
+			Format:          UDBZ,
+			PartitionScheme: "GUID",
+			Partitions:      []Partition{{Name: "whole disk (GUID_partition_scheme : 0)", Type: "GUID_partition_scheme", Size: 4 * sectorSize}},
+			ChecksumType:    "CRC32",
+			Checksum:        fmt.Sprintf("$%08X", master+1),
+			Size:            4 * sectorSize,
+		}},
+		{badData, &ImageInfo{
+			Format:          UDBZ,
+			PartitionScheme: "none", // the partition map can't be decompressed.
+			Partitions:      []Partition{{Name: "whole disk (GUID_partition_scheme : 0)", Type: "GUID_partition_scheme", Size: 4 * sectorSize}},
+			ChecksumType:    "CRC32",
+			Checksum:        fmt.Sprintf("$%08X", master),
+			ChecksumValid:   true,
+			Size:            4 * sectorSize,
+		}},
+		{rawPath, &ImageInfo{Format: RAW, Size: 4 * sectorSize}},
+		{encrypted, &ImageInfo{Encrypted: true}},
+	}
+	for _, tt := range tests {
+		have, err := Info(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%s: have %+v, want %+v", filepath.Base(tt.path), have, tt.want)
+		}
+	}
+
+	if err := Verify(udbz); err != nil {
+		t.Errorf("verify: %s", err)
+	}
+	if err := Verify(rawPath); err == nil {
+		t.Error("verify: expected an error for a raw image")
+	}
+
+	// a block table with the wrong checksum.
+	table := buildBlockTable(t, 0, 1, []mishChunk{
+		{Type: chunkRaw, SectorCount: 1, CompressedLength: sectorSize},
+		{Type: chunkEnd, SectorNumber: 1},
+	})
+	binary.BigEndian.PutUint32(table[0x40:], checksumCRC32)
+	binary.BigEndian.PutUint32(table[0x48:], crc32.ChecksumIEEE(make([]byte, sectorSize))+1)
+	corrupt := filepath.Join(dir, "corrupt.dmg")
+	data := buildUDIF(t, make([]byte, sectorSize), map[string][]udifResource{
+		"blkx": {{Name: "disk image (Apple_HFS : 0)", Data: table}},
+	})
+	if err := ioutil.WriteFile(corrupt, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(corrupt); err != ErrChecksum {
+		t.Errorf("have %v, want %v", err, ErrChecksum)
+	}
+}
+
+// buildUDIF creates a UDIF image with the data fork, followed by the resource
+// plist and the koly trailer.
+func buildUDIF(t *testing.T, data []byte, resources map[string][]udifResource) []byte {
+	xml, err := plist.MarshalIndent(udifPlist{ResourceFork: resources}, "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	buf.Write(data)
+	buf.Write(xml)
+	k := koly{
+		Version:        4,
+		HeaderSize:     kolySize,
+		Flags:          1,
+		DataForkLength: uint64(len(data)),
+		XMLOffset:      uint64(len(data)),
+		XMLLength:      uint64(len(xml)),
+		ImageVariant:   1,
+		SectorCount:    uint64(len(data)+511) / 512,
+	}
+	copy(k.Signature[:], "koly")
+	if err := binary.Write(&buf, binary.BigEndian, k); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildBlockTable creates a blkx table for count sectors starting at sector.
+func buildBlockTable(t *testing.T, sector, count uint64, chunks []mishChunk) []byte {
+	h := mishHeader{
+		Version:      1,
+		SectorNumber: sector,
+		SectorCount:  count,
+		ChunkCount:   uint32(len(chunks)),
+	}
+	copy(h.Signature[:], "mish")
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, h); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Write(&buf, binary.BigEndian, chunks); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// setKoly modifies the koly trailer of an image built by buildUDIF.
+func setKoly(t *testing.T, img []byte, modify func(*koly)) {
+	trailer := img[len(img)-kolySize:]
+	var k koly
+	if err := binary.Read(bytes.NewReader(trailer), binary.BigEndian, &k); err != nil {
+		t.Fatal(err)
+	}
+	modify(&k)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, k); err != nil {
+		t.Fatal(err)
+	}
+	copy(trailer, buf.Bytes())
+}
+
+// a sector of 'b' and a sector of 'x', compressed with bzip2 and xz.
+var (
+	bzip2Sector = []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x86\xa0\x3f\x0f\x00\x00\x01\x81\x00\x90\x00\x00\x08\x20\x00\x30\x80\x49\xea\x06\xae\x2e\xe4\x8a\x70\xa1\x21\x0d\x40\x7e\x1e")
+	xzSector    = []byte("\xfd\x37\x7a\x58\x5a\x00\x00\x01\x69\x22\xde\x36\x02\x00\x21\x01\x16\x00\x00\x00\x74\x2f\xe5\xa3\xe0\x01\xff\x00\x08\x5d\x00\x3c\x6f\xfb\xbe\xb2\x5b\xb0\x00\x00\x5d\x6d\x0b\x3b\x00\x01\x20\x80\x04\x00\x00\x00\x2e\xf6\x7d\xfa\x3e\x30\x0d\x8b\x02\x00\x00\x00\x00\x01\x59\x5a")
+)
+
+func Test_parseInfo(t *testing.T) {
+	out := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>framework</key>
+	<string>671.100.2</string>
+	<key>images</key>
+	<array>
+		<dict>
+			<key>autodiskmount</key>
+			<true/>
+			<key>image-encrypted</key>
+			<false/>
+			<key>image-path</key>
+			<string>/var/cache/agent/Foo.dmg</string>
+			<key>image-type</key>
+			<string>read-only disk image</string>
+			<key>system-entities</key>
+			<array>
+				<dict>
+					<key>content-hint</key>
+					<string>GUID_partition_scheme</string>
+					<key>dev-entry</key>
+					<string>/dev/disk4</string>
+					<key>potentially-mountable</key>
+					<false/>
+				</dict>
+				<dict>
+					<key>content-hint</key>
+					<string>Apple_HFS</string>
+					<key>dev-entry</key>
+					<string>/dev/disk4s1</string>
+					<key>mount-point</key>
+					<string>/Volumes/Foo</string>
+					<key>potentially-mountable</key>
+					<true/>
+					<key>volume-kind</key>
+					<string>hfs</string>
+				</dict>
+			</array>
+		</dict>
+		<dict>
+			<key>image-path</key>
+			<string>/Users/me/Downloads/Bar.dmg</string>
+			<key>system-entities</key>
+			<array>
+				<dict>
+					<key>content-hint</key>
+					<string>Apple_HFS</string>
+					<key>dev-entry</key>
+					<string>/dev/disk5</string>
+					<key>mount-point</key>
+					<string>/Volumes/Bar</string>
+				</dict>
+			</array>
+		</dict>
+	</array>
+	<key>revision</key>
+	<string>671.100.2</string>
+</dict>
+</plist>`)
+
+	images, err := parseInfo(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(images), 2; have != want {
+		t.Fatalf("have %d images, want %d", have, want)
+	}
+	var cached []string
+	for _, img := range images {
+		if img.InDir("/var/cache/agent") {
+			cached = append(cached, img.Device())
+		}
+	}
+	if want := []string{"/dev/disk4"}; !reflect.DeepEqual(cached, want) {
+		t.Errorf("have cached images %v, want %v", cached, want)
+	}
+	if have, want := images[1].MountPoints(), []string{"/Volumes/Bar"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have mount points %v, want %v", have, want)
+	}
+}
+
+func TestImageInDir(t *testing.T) {
+	tests := []struct {
+		path string
+		dir  string
+		want bool
+	}{
+		{"/var/cache/agent/Foo.dmg", "/var/cache/agent", true},
+		{"/var/cache/agent/sub/Foo.dmg", "/var/cache/agent/", true},
+		{"/var/cache/agent", "/var/cache/agent", false},
+		{"/var/cache/agent2/Foo.dmg", "/var/cache/agent", false},
+		{"/var/cache/agent/../Foo.dmg", "/var/cache/agent", false},
+	}
+	for _, tt := range tests {
+		if have := (&Image{Path: tt.path}).InDir(tt.dir); have != tt.want {
+			t.Errorf("%s in %s: have %v, want %v", tt.path, tt.dir, have, tt.want)
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	s := NewSession()
+	s.attach = func(dmgpath string, opts ...Option) (*Image, error) {
+		if dmgpath == "missing.dmg" {
+			return nil, errors.New("no such file")
+		}
+		return &Image{Path: dmgpath}, nil
+	}
+	var detached []string
+	s.detach = func(img *Image, opts ...Option) error {
+		if img.Path == "busy.dmg" {
+			return errors.New("resource busy")
+		}
+		detached = append(detached, img.Path)
+		return nil
+	}
+
+	for _, path := range []string{"a.dmg", "busy.dmg", "missing.dmg", "b.dmg"} {
+		s.Attach(path)
+	}
+	s.Adopt(&Image{Path: "found.dmg"})
+	if have, want := len(s.Images()), 4; have != want {
+		t.Fatalf("have %d images, want %d", have, want)
+	}
+
+	if err := s.Close(); err == nil {
+		t.Error("expected an error for the busy image")
+	}
+	if want := []string{"found.dmg", "b.dmg", "a.dmg"}; !reflect.DeepEqual(detached, want) {
+		t.Errorf("have detached %v, want %v", detached, want)
+	}
+	if images := s.Images(); len(images) != 1 || images[0].Path != "busy.dmg" {
+		t.Errorf("have images %v, want only busy.dmg", images)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	defer func(path string) { hdiutilPath = path }(hdiutilPath)
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	hdiutilPath = filepath.Join(dir, "hdiutil")
+	script := `#!/bin/sh
+echo "$@" > ` + argsPath + `
+case "$1" in
+convert)
+	printf 'PERCENT:-1.000000\nMESSAGE:Reading whole disk\nPERCENT:50.000000\nPERCENT:100.000000\n' ;;
+resize)
+	echo "hdiutil: resize failed - image not recognized" >&2
+	exit 1 ;;
+compact)
+	exec sleep 5 ;;
+esac
+`
+	if err := ioutil.WriteFile(hdiutilPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	args := func() string {
+		b, err := ioutil.ReadFile(argsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(b))
+	}
+
+	var progress []float64
+	err := Convert("in.dmg", "out.dmg", ULFO, Overwrite(), WithPassphrase("secret"),
+		WithProgress(func(percent float64) { progress = append(progress, percent) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := args(), "convert in.dmg -format ULFO -o out.dmg -ov -stdinpass -puppetstrings"; have != want {
+		t.Errorf("have args %q, want %q", have, want)
+	}
+	if want := []float64{-1, 50, 100}; !reflect.DeepEqual(progress, want) {
+		t.Errorf("have progress %v, want %v", progress, want)
+	}
+
+	err = Resize("in.dmg", 1<<20+1)
+	if have, want := args(), "resize -sectors 2049 in.dmg -puppetstrings"; have != want {
+		t.Errorf("have args %q, want %q", have, want)
+	}
+	if !errors.Is(err, ErrCorruptImage) {
+		t.Errorf("have %v, want %v", err, ErrCorruptImage)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := Compact("in.sparsebundle", WithContext(ctx)); err != context.DeadlineExceeded {
+		t.Errorf("have %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestCopyBundle(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "Foo.app")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := []struct {
+		path string
+		mode os.FileMode
+		data string
+	}{
+		{"Contents/Info.plist", 0644, "<plist/>"},
+		{"Contents/MacOS/Foo", 0755, "#!/bin/sh\n"},
+		{"Contents/Resources/en.lproj/Localizable.strings", 0600, "strings"},
+	}
+	for _, f := range files {
+		path := filepath.Join(src, f.path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(f.data), f.mode); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	if err := os.Symlink("Contents/MacOS/Foo", filepath.Join(src, "Foo")); err != nil {
+		t.Fatal(err)
+	}
+	withXattr := unix.Setxattr(filepath.Join(src, "Contents/Info.plist"), "user.mackit", []byte("value"), 0) == nil
+	// a read-only directory must still be filled.
+	if err := os.Chmod(filepath.Join(src, "Contents/Resources/en.lproj"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(src, "Contents/Resources/en.lproj"), 0755)
+
+	dst := filepath.Join(dir, "Copy.app")
+	if err := CopyBundle(dst, src); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(dst, "Contents/Resources/en.lproj"), 0755)
+	if err := CopyBundle(dst, src); err == nil {
+		t.Error("expected an error copying to an existing path")
+	}
+
+	for _, f := range files {
+		path := filepath.Join(dst, f.path)
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode() != f.mode || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: have mode %s, mtime %s, want %s, %s", f.path, fi.Mode(), fi.ModTime(), f.mode, mtime)
+		}
+		if data, _ := ioutil.ReadFile(path); string(data) != f.data {
+			t.Errorf("%s: have %q, want %q", f.path, data, f.data)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "Contents/Resources/en.lproj")); err != nil || fi.Mode().Perm() != 0555 {
+		t.Errorf("have directory mode %v, %v, want 0555", fi.Mode(), err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "Foo")); err != nil || link != "Contents/MacOS/Foo" {
+		t.Errorf("have link %q, %v", link, err)
+	}
+	if withXattr {
+		value, err := getXattr(filepath.Join(dst, "Contents/Info.plist"), "user.mackit")
+		if err != nil || string(value) != "value" {
+			t.Errorf("have attribute %q, %v, want value", value, err)
+		}
+	}
+}
+
+func TestInstallFrom(t *testing.T) {
+	newVolume := func(t *testing.T, paths ...string) string {
+		volume := t.TempDir()
+		for _, path := range paths {
+			path = filepath.Join(volume, path)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := os.Symlink("/Applications", filepath.Join(volume, "Applications")); err != nil {
+			t.Fatal(err)
+		}
+		return volume
+	}
+	volume := newVolume(t, "Foo.app/Contents/Info.plist", "Bar.pkg", "Baz.mpkg/Contents/Info.plist", "README.txt")
+	appVolume := newVolume(t, "Foo.app/Contents/Info.plist", "README.txt")
+	pkgVolume := newVolume(t, "Bar.pkg", "README.txt")
+
+	tests := []struct {
+		name     string
+		volumes  []string
+		items    []string
+		apps     []string
+		packages []string
+		wantErr  bool
+		errIs    error
+	}{
+		{name: "single app", volumes: []string{appVolume}, apps: []string{"Foo.app"}},
+		{name: "single package", volumes: []string{pkgVolume}, packages: []string{"Bar.pkg"}},
+		{name: "ambiguous", volumes: []string{volume}, wantErr: true, errIs: ErrAmbiguousItems},
+		{name: "ambiguous volumes", volumes: []string{appVolume, pkgVolume}, wantErr: true, errIs: ErrAmbiguousItems},
+		{name: "by name", volumes: []string{volume}, items: []string{"Foo.app"}, apps: []string{"Foo.app"}},
+		{name: "by glob", volumes: []string{volume}, items: []string{"*.pkg"}, packages: []string{"Bar.pkg"}},
+		{name: "several", volumes: []string{volume}, items: []string{"*.app", "*pkg"}, apps: []string{"Foo.app"}, packages: []string{"Bar.pkg", "Baz.mpkg"}},
+		{name: "no match", volumes: []string{volume}, items: []string{"Qux.app"}, wantErr: true, errIs: ErrNothingToInstall},
+		{name: "unsupported", volumes: []string{volume}, items: []string{"*"}, wantErr: true},
+		{name: "invalid pattern", volumes: []string{volume}, items: []string{"[a-"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := t.TempDir()
+			// an older copy of the app is replaced.
+			old := filepath.Join(dest, "Foo.app/Contents/Old")
+			os.MkdirAll(filepath.Dir(old), 0755)
+			ioutil.WriteFile(old, nil, 0644)
+
+			var installed []string
+			o := newInstallOptions(WithItems(tt.items...), WithDestination(dest))
+			o.installPkg = func(path string, opts ...pkg.Option) (bool, error) {
+				installed = append(installed, filepath.Base(path))
+				return true, nil
+			}
+			result := new(InstallResult)
+			err := installFrom(tt.volumes, o, result)
+			if have, want := err != nil, tt.wantErr; have != want {
+				t.Fatalf("have err %v, want error %v", err, want)
+			}
+			if tt.errIs != nil && !errors.Is(err, tt.errIs) {
+				t.Errorf("have err %v, want %v", err, tt.errIs)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			var apps []string
+			for _, app := range result.Apps {
+				apps = append(apps, filepath.Base(app))
+			}
+			if !reflect.DeepEqual(apps, tt.apps) || !reflect.DeepEqual(result.Packages, tt.packages) {
+				t.Errorf("have apps %v, packages %v, want %v, %v", apps, result.Packages, tt.apps, tt.packages)
+			}
+			if !reflect.DeepEqual(installed, tt.packages) || result.Restart != (len(tt.packages) > 0) {
+				t.Errorf("have installed %v, restart %v", installed, result.Restart)
+			}
+			if len(tt.apps) > 0 {
+				if _, err := os.Stat(old); !os.IsNotExist(err) {
+					t.Errorf("old copy of the app wasn't replaced: %v", err)
+				}
+				if data, err := ioutil.ReadFile(filepath.Join(dest, "Foo.app/Contents/Info.plist")); string(data) != "new" {
+					t.Errorf("have Info.plist %q, %v", data, err)
+				}
+			}
+			if entries, _ := ioutil.ReadDir(dest); len(entries) != 1 {
+				t.Errorf("have %d entries in the destination, want 1", len(entries))
+			}
+		})
+	}
+}
+
+func TestReplaceBundleRestore(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src/Foo.app")
+	dst := filepath.Join(dir, "dst/Foo.app")
+	for path, contents := range map[string]string{
+		filepath.Join(src, "Contents/Info.plist"): "new",
+		filepath.Join(dst, "Contents/Info.plist"): "old",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// moving the new copy into place fails.
+	defer func(orig func(string, string) error) { rename = orig }(rename)
+	var calls int
+	rename = func(oldpath, newpath string) error {
+		calls++
+		if calls == 2 {
+			return errors.New("rename failed")
+		}
+		return os.Rename(oldpath, newpath)
+	}
+	if err := replaceBundle(dst, src); err == nil {
+		t.Fatal("expected an error")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "Contents/Info.plist")); string(data) != "old" {
+		t.Errorf("have Info.plist %q, %v, want the previous copy", data, err)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Dir(dst)); len(entries) != 1 {
+		t.Errorf("have %d entries in the destination, want 1", len(entries))
+	}
+}
@@ -0,0 +1,63 @@
+package dmgutils
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+var (
+	// ErrAuthentication is returned when an encrypted image can't be unlocked
+	// with the passphrase or keychain it was given.
+	ErrAuthentication = errors.New("dmgutils: wrong passphrase or key for encrypted image")
+
+	// ErrCorruptImage is returned when hdiutil can't read an image because it
+	// is damaged or isn't a disk image.
+	ErrCorruptImage = errors.New("dmgutils: corrupt or unrecognized image")
+)
+
+// Error is returned when an hdiutil command fails.
+type Error struct {
+	// Verb is the hdiutil verb, such as attach.
+	Verb string
+	// Output is the error output of hdiutil.
+	Output string
+	// Err is ErrAuthentication or ErrCorruptImage when the output matches
+	// one of those errors, and the *exec.ExitError otherwise.
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := "dmgutils: hdiutil " + e.Verb + " failed"
+	if e.Output != "" {
+		msg += ": " + e.Output
+	}
+	if e.Err != nil && e.Err != ErrAuthentication && e.Err != ErrCorruptImage {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap allows matching ErrAuthentication and ErrCorruptImage with errors.Is.
+func (e *Error) Unwrap() error { return e.Err }
+
+// hdiutilError wraps the error of a failed hdiutil command.
+func hdiutilError(verb string, err error) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return err
+	}
+	output := strings.TrimSpace(string(exitErr.Stderr))
+	e := &Error{Verb: verb, Output: output, Err: err}
+	lower := strings.ToLower(output)
+	switch {
+	case strings.Contains(lower, "authentication error"),
+		strings.Contains(lower, "incorrect passphrase"):
+		e.Err = ErrAuthentication
+	case strings.Contains(lower, "corrupt image"),
+		strings.Contains(lower, "image not recognized"),
+		strings.Contains(lower, "checksum"):
+		e.Err = ErrCorruptImage
+	}
+	return e
+}
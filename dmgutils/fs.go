@@ -0,0 +1,52 @@
+package dmgutils
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+
+	"github.com/groob/mackit/dmgutils/apfs"
+	"github.com/groob/mackit/dmgutils/hfsplus"
+)
+
+// ErrNoFileSystem is returned by FS when no partition of the disk image holds
+// an HFS+ or APFS file system.
+var ErrNoFileSystem = errors.New("dmgutils: no HFS+ or APFS file system in image")
+
+// FS returns a read-only view of the first HFS+ or APFS file system of the
+// disk image, which can be walked without attaching the image:
+//
+//	u, err := dmgutils.OpenUDIF("Installer.dmg")
+//	if err != nil {
+//		return err
+//	}
+//	defer u.Close()
+//	fsys, err := u.FS()
+//	if err != nil {
+//		return err
+//	}
+//	info, err := fs.ReadFile(fsys, "Installer.app/Contents/Info.plist")
+//
+// The files of the returned fs.FS read from u, which must stay open.
+func (u *UDIFReader) FS() (fs.FS, error) {
+	for _, p := range u.Partitions() {
+		fsys, err := openFS(io.NewSectionReader(u, p.Offset, p.Size))
+		if err != ErrNoFileSystem {
+			return fsys, err
+		}
+	}
+	// images without a partition map hold a single file system.
+	return openFS(io.NewSectionReader(u, 0, u.Size()))
+}
+
+func openFS(r io.ReaderAt) (fs.FS, error) {
+	fsys, err := hfsplus.Open(r)
+	if err != hfsplus.ErrNotHFSPlus {
+		return fsys, err
+	}
+	fsys, err = apfs.Open(r)
+	if err != apfs.ErrNotAPFS {
+		return fsys, err
+	}
+	return nil, ErrNoFileSystem
+}
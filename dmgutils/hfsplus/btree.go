@@ -0,0 +1,182 @@
+package hfsplus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// The catalog and extents overflow files are B-trees of fixed size nodes.
+// Node 0 is the header node, and every node starts with a node descriptor
+// and ends with the offsets of its records, in reverse order.
+
+const (
+	nodeLeaf   = -1
+	nodeIndex  = 0
+	nodeHeader = 1
+
+	nodeDescriptorSize = 14
+
+	btVariableIndexKeys = 0x4
+)
+
+type btree struct {
+	r          io.ReaderAt
+	nodeSize   uint16
+	totalNodes uint32
+	rootNode   uint32
+	maxKeyLen  uint16
+	attributes uint32
+}
+
+func openBtree(r io.ReaderAt) (*btree, error) {
+	buf := make([]byte, 512)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, fmt.Errorf("read b-tree header: %s", err)
+	}
+	if int8(buf[8]) != nodeHeader {
+		return nil, fmt.Errorf("invalid b-tree header node")
+	}
+	h := buf[nodeDescriptorSize:]
+	t := &btree{
+		r:          r,
+		rootNode:   binary.BigEndian.Uint32(h[2:]),
+		nodeSize:   binary.BigEndian.Uint16(h[18:]),
+		maxKeyLen:  binary.BigEndian.Uint16(h[20:]),
+		totalNodes: binary.BigEndian.Uint32(h[22:]),
+		attributes: binary.BigEndian.Uint32(h[38:]),
+	}
+	if t.nodeSize < 512 || t.nodeSize&(t.nodeSize-1) != 0 {
+		return nil, fmt.Errorf("invalid b-tree node size %d", t.nodeSize)
+	}
+	return t, nil
+}
+
+type node struct {
+	kind    int8
+	forward uint32
+	records [][]byte
+}
+
+func (t *btree) node(n uint32) (*node, error) {
+	if n >= t.totalNodes {
+		return nil, fmt.Errorf("b-tree node %d out of range", n)
+	}
+	buf := make([]byte, t.nodeSize)
+	if _, err := t.r.ReadAt(buf, int64(n)*int64(t.nodeSize)); err != nil {
+		return nil, fmt.Errorf("read b-tree node %d: %s", n, err)
+	}
+	nd := &node{
+		forward: binary.BigEndian.Uint32(buf),
+		kind:    int8(buf[8]),
+	}
+	count := int(binary.BigEndian.Uint16(buf[10:]))
+	if nodeDescriptorSize+2*(count+1) > len(buf) {
+		return nil, fmt.Errorf("corrupt b-tree node %d", n)
+	}
+	offset := func(i int) int {
+		return int(binary.BigEndian.Uint16(buf[len(buf)-2*(i+1):]))
+	}
+	for i := 0; i < count; i++ {
+		start, end := offset(i), offset(i+1)
+		if start < nodeDescriptorSize || end < start || end > len(buf) {
+			return nil, fmt.Errorf("corrupt b-tree node %d", n)
+		}
+		nd.records = append(nd.records, buf[start:end])
+	}
+	return nd, nil
+}
+
+// split splits a record into its key, without the key length, and its data.
+func (t *btree) split(kind int8, record []byte) (key, data []byte, err error) {
+	if len(record) < 2 {
+		return nil, nil, fmt.Errorf("corrupt b-tree record")
+	}
+	keyLen := int(binary.BigEndian.Uint16(record))
+	if kind == nodeIndex && t.attributes&btVariableIndexKeys == 0 {
+		keyLen = int(t.maxKeyLen)
+	}
+	end := 2 + keyLen
+	if end > len(record) {
+		return nil, nil, fmt.Errorf("corrupt b-tree record")
+	}
+	key = record[2:end]
+	// records are aligned to 2 bytes.
+	end += end & 1
+	if end > len(record) {
+		end = len(record)
+	}
+	return key, record[end:], nil
+}
+
+// search calls fn with the records of the leaf nodes, starting from the leaf
+// which may hold the first key for which less returns false, until fn returns
+// false. less reports whether a key is before the searched keys.
+func (t *btree) search(less func(key []byte) bool, fn func(key, data []byte) (bool, error)) error {
+	n := t.rootNode
+	if n == 0 {
+		// an empty tree.
+		return nil
+	}
+	for depth := 0; ; depth++ {
+		if depth > 16 {
+			return fmt.Errorf("b-tree is too deep")
+		}
+		nd, err := t.node(n)
+		if err != nil {
+			return err
+		}
+		if nd.kind == nodeLeaf {
+			break
+		}
+		if nd.kind != nodeIndex || len(nd.records) == 0 {
+			return fmt.Errorf("corrupt b-tree node %d", n)
+		}
+		// the last child whose first key is before the searched keys.
+		next := uint32(0)
+		for i, rec := range nd.records {
+			key, data, err := t.split(nd.kind, rec)
+			if err != nil {
+				return err
+			}
+			if len(data) < 4 {
+				return fmt.Errorf("corrupt b-tree index record")
+			}
+			if i > 0 && !less(key) {
+				break
+			}
+			next = binary.BigEndian.Uint32(data)
+		}
+		n = next
+	}
+
+	seen := make(map[uint32]bool)
+	for n != 0 {
+		if seen[n] {
+			return fmt.Errorf("b-tree leaf loop at node %d", n)
+		}
+		seen[n] = true
+		nd, err := t.node(n)
+		if err != nil {
+			return err
+		}
+		if nd.kind != nodeLeaf {
+			return fmt.Errorf("corrupt b-tree leaf node %d", n)
+		}
+		for _, rec := range nd.records {
+			key, data, err := t.split(nd.kind, rec)
+			if err != nil {
+				return err
+			}
+			if less(key) {
+				continue
+			}
+			more, err := fn(key, data)
+			if err != nil || !more {
+				return err
+			}
+		}
+		n = nd.forward
+	}
+	return nil
+}
@@ -0,0 +1,515 @@
+// Package hfsplus reads HFS+ and HFSX volumes, without mounting them.
+//
+// Files and directories are read from the catalog B-tree, following the
+// extents overflow file for fragmented files. Hard links are resolved to
+// their inodes, and resource forks are available at file/..namedfork/rsrc.
+// Journaled volumes are read as they are on disk, so the volume should have
+// been unmounted cleanly.
+// Based on Apple's Technical Note TN1150.
+package hfsplus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/groob/mackit/internal/diskfs"
+)
+
+// ErrNotHFSPlus is returned by Open when the volume isn't an HFS+ or HFSX
+// volume.
+var ErrNotHFSPlus = errors.New("hfsplus: not an HFS+ volume")
+
+const volumeHeaderOffset = 1024
+
+// catalog node IDs.
+const (
+	rootFolderID  = 2
+	catalogFileID = 4
+)
+
+// catalog record types.
+const (
+	recordFolder       = 1
+	recordFile         = 2
+	recordFolderThread = 3
+	recordFileThread   = 4
+)
+
+const (
+	forkData     = 0x00
+	forkResource = 0xff
+)
+
+// the names of the directories holding the inodes of hard links.
+const (
+	privateDataDir      = "\x00\x00\x00\x00HFS+ Private Data"
+	privateDirectoryDir = ".HFS+ Private Directory Data\r"
+)
+
+const ufCompressed = 0x20
+
+// hfsEpoch is the start of HFS+ dates.
+var hfsEpoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type extent struct {
+	StartBlock uint32
+	BlockCount uint32
+}
+
+type fork struct {
+	LogicalSize uint64
+	ClumpSize   uint32
+	TotalBlocks uint32
+	Extents     [8]extent
+}
+
+// Stat is the Sys value of the file infos of the volume.
+type Stat struct {
+	// CNID is the catalog node ID of the file.
+	CNID       uint32
+	UID        uint32
+	GID        uint32
+	Flags      uint32
+	CreateTime time.Time
+	// Type and Creator are the Finder type and creator codes of a file.
+	Type    string
+	Creator string
+}
+
+// record is a file or folder record of the catalog.
+type record struct {
+	typ        int16
+	id         uint32
+	createDate uint32
+	modDate    uint32
+	uid        uint32
+	gid        uint32
+	adminFlags uint8
+	ownerFlags uint8
+	mode       uint16
+	special    uint32
+	fileType   uint32
+	creator    uint32
+	data       fork
+	rsrc       fork
+}
+
+type volume struct {
+	r         io.ReaderAt
+	blockSize uint32
+	catalog   *btree
+	extents   *btree
+}
+
+// Open reads the HFS+ or HFSX volume in r. The returned file system also
+// implements fs.StatFS and fs.ReadDirFS.
+func Open(r io.ReaderAt) (fs.FS, error) {
+	vh := make([]byte, 512)
+	if _, err := r.ReadAt(vh, volumeHeaderOffset); err != nil {
+		return nil, ErrNotHFSPlus
+	}
+	switch string(vh[:2]) {
+	case "H+", "HX":
+	case "BD":
+		return nil, errors.New("hfsplus: HFS wrapped volumes are not supported")
+	default:
+		return nil, ErrNotHFSPlus
+	}
+	v := &volume{r: r, blockSize: binary.BigEndian.Uint32(vh[40:])}
+	if v.blockSize < 512 || v.blockSize&(v.blockSize-1) != 0 {
+		return nil, fmt.Errorf("hfsplus: invalid block size %d", v.blockSize)
+	}
+
+	extentsFork := parseFork(vh[192:])
+	catalogFork := parseFork(vh[272:])
+	var err error
+	// the extents file can't have overflow extents.
+	v.extents, err = openBtree(v.forkReader(extentsFork, nil))
+	if err != nil {
+		return nil, fmt.Errorf("hfsplus: extents file: %s", err)
+	}
+	catalog, err := v.forkFile(catalogFileID, forkData, catalogFork)
+	if err != nil {
+		return nil, fmt.Errorf("hfsplus: catalog file: %s", err)
+	}
+	v.catalog, err = openBtree(catalog)
+	if err != nil {
+		return nil, fmt.Errorf("hfsplus: catalog file: %s", err)
+	}
+	return diskfs.New(v), nil
+}
+
+func parseFork(b []byte) fork {
+	f := fork{
+		LogicalSize: binary.BigEndian.Uint64(b),
+		ClumpSize:   binary.BigEndian.Uint32(b[8:]),
+		TotalBlocks: binary.BigEndian.Uint32(b[12:]),
+	}
+	for i := range f.Extents {
+		f.Extents[i] = extent{
+			StartBlock: binary.BigEndian.Uint32(b[16+8*i:]),
+			BlockCount: binary.BigEndian.Uint32(b[20+8*i:]),
+		}
+	}
+	return f
+}
+
+// forkFile returns a reader for a fork, reading the extents which don't fit
+// in the fork data from the extents overflow file.
+func (v *volume) forkFile(id uint32, forkType uint8, f fork) (io.ReaderAt, error) {
+	extents := append([]extent(nil), f.Extents[:]...)
+	var blocks uint32
+	for _, e := range extents {
+		blocks += e.BlockCount
+	}
+	for blocks < f.TotalBlocks {
+		more, err := v.overflowExtents(id, forkType, blocks)
+		if err != nil {
+			return nil, err
+		}
+		if len(more) == 0 {
+			return nil, fmt.Errorf("missing extents for file %d", id)
+		}
+		for _, e := range more {
+			extents = append(extents, e)
+			blocks += e.BlockCount
+		}
+	}
+	return v.forkReader(f, extents), nil
+}
+
+// overflowExtents returns the extents of a fork starting at startBlock.
+func (v *volume) overflowExtents(id uint32, forkType uint8, startBlock uint32) ([]extent, error) {
+	// keys are the fork type, a pad byte, the file ID and the start block.
+	type extentKey struct {
+		forkType   uint8
+		id         uint32
+		startBlock uint32
+	}
+	parse := func(key []byte) extentKey {
+		if len(key) < 10 {
+			return extentKey{}
+		}
+		return extentKey{key[0], binary.BigEndian.Uint32(key[2:]), binary.BigEndian.Uint32(key[6:])}
+	}
+	want := extentKey{forkType, id, startBlock}
+	less := func(key []byte) bool {
+		k := parse(key)
+		if k.id != want.id {
+			return k.id < want.id
+		}
+		if k.forkType != want.forkType {
+			return k.forkType < want.forkType
+		}
+		return k.startBlock < want.startBlock
+	}
+
+	var extents []extent
+	err := v.extents.search(less, func(key, data []byte) (bool, error) {
+		if parse(key) != want {
+			return false, nil
+		}
+		if len(data) < 64 {
+			return false, fmt.Errorf("corrupt extents record")
+		}
+		for i := 0; i < 8; i++ {
+			e := extent{binary.BigEndian.Uint32(data[8*i:]), binary.BigEndian.Uint32(data[8*i+4:])}
+			if e.BlockCount == 0 {
+				break
+			}
+			extents = append(extents, e)
+		}
+		return false, nil
+	})
+	return extents, err
+}
+
+// forkReader reads the blocks of the extents of a fork. When extents is nil,
+// the extents of the fork data are used.
+func (v *volume) forkReader(f fork, extents []extent) io.ReaderAt {
+	if extents == nil {
+		extents = f.Extents[:]
+	}
+	return &extentReader{r: v.r, blockSize: int64(v.blockSize), size: int64(f.LogicalSize), extents: extents}
+}
+
+type extentReader struct {
+	r         io.ReaderAt
+	blockSize int64
+	size      int64
+	extents   []extent
+}
+
+func (er *extentReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= er.size {
+		return 0, io.EOF
+	}
+	var n int
+	var eof error
+	if int64(len(p)) > er.size-off {
+		p, eof = p[:er.size-off], io.EOF
+	}
+	var start int64 // the logical offset of the extent
+	for _, e := range er.extents {
+		length := int64(e.BlockCount) * er.blockSize
+		if off >= start+length {
+			start += length
+			continue
+		}
+		chunk := p[n:]
+		if rest := start + length - off; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		m, err := er.r.ReadAt(chunk, int64(e.StartBlock)*er.blockSize+off-start)
+		n += m
+		off += int64(m)
+		if err != nil && !(err == io.EOF && m == len(chunk)) {
+			return n, err
+		}
+		if n == len(p) {
+			return n, eof
+		}
+		start += length
+	}
+	return n, io.ErrUnexpectedEOF
+}
+
+// Root returns the root folder.
+func (v *volume) Root() (diskfs.Inode, error) {
+	var root diskfs.Inode
+	var found bool
+	// the root folder is the only child of its parent, which doesn't exist.
+	err := v.children(rootFolderID-1, func(name string, rec *record) (bool, error) {
+		if rec.id == rootFolderID {
+			root, found = v.inode(rec), true
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return root, err
+	}
+	if !found {
+		return root, errors.New("missing root folder")
+	}
+	return root, nil
+}
+
+// ReadDir returns the files and folders of a folder, resolving hard links.
+func (v *volume) ReadDir(dir diskfs.Inode) ([]diskfs.Entry, error) {
+	var entries []diskfs.Entry
+	err := v.children(uint32(dir.ID), func(name string, rec *record) (bool, error) {
+		if dir.ID == rootFolderID && (name == privateDataDir || name == privateDirectoryDir) {
+			return true, nil
+		}
+		rec, err := v.resolveLink(rec)
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", name, err)
+		}
+		// the catalog uses ':' for '/' in names.
+		name = strings.Replace(name, "/", ":", -1)
+		entries = append(entries, diskfs.Entry{Name: name, Inode: v.inode(rec)})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// Open returns a fork of a file.
+func (v *volume) Open(f diskfs.Inode, which diskfs.Fork) (io.ReaderAt, int64, error) {
+	rec := f.Node.(*record)
+	if rec.typ != recordFile {
+		return nil, 0, errors.New("is a directory")
+	}
+	forkType, data := uint8(forkData), rec.data
+	if which == diskfs.ResourceFork {
+		forkType, data = forkResource, rec.rsrc
+	} else if uint32(rec.ownerFlags)&ufCompressed != 0 {
+		return nil, 0, errors.New("compressed files are not supported")
+	}
+	r, err := v.forkFile(rec.id, forkType, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return r, int64(data.LogicalSize), nil
+}
+
+// children calls fn with the name and record of every file and folder in
+// the folder with parentID, in catalog order, until fn returns false.
+func (v *volume) children(parentID uint32, fn func(name string, rec *record) (bool, error)) error {
+	less := func(key []byte) bool {
+		return len(key) < 4 || binary.BigEndian.Uint32(key) < parentID
+	}
+	return v.catalog.search(less, func(key, data []byte) (bool, error) {
+		if len(key) < 6 {
+			return false, errors.New("corrupt catalog key")
+		}
+		if binary.BigEndian.Uint32(key) != parentID {
+			return false, nil
+		}
+		rec, err := parseRecord(data)
+		if err != nil {
+			return false, err
+		}
+		if rec == nil {
+			// a thread record.
+			return true, nil
+		}
+		name, err := parseName(key[4:])
+		if err != nil {
+			return false, err
+		}
+		return fn(name, rec)
+	})
+}
+
+// lookup returns the record of a file or folder in the folder with parentID.
+func (v *volume) lookup(parentID uint32, name string) (*record, error) {
+	var found *record
+	err := v.children(parentID, func(n string, rec *record) (bool, error) {
+		if n == name {
+			found = rec
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == nil && found == nil {
+		err = fs.ErrNotExist
+	}
+	return found, err
+}
+
+// resolveLink returns the record of the inode of a hard link. Other records
+// are returned as is.
+func (v *volume) resolveLink(rec *record) (*record, error) {
+	if rec.typ != recordFile {
+		return rec, nil
+	}
+	var dir, name string
+	switch {
+	case rec.fileType == fourCC("hlnk") && rec.creator == fourCC("hfs+"):
+		dir, name = privateDataDir, "iNode"+strconv.FormatUint(uint64(rec.special), 10)
+	case rec.fileType == fourCC("fdrp") && rec.creator == fourCC("MACS"):
+		dir, name = privateDirectoryDir, "dir_"+strconv.FormatUint(uint64(rec.special), 10)
+	default:
+		return rec, nil
+	}
+	private, err := v.lookup(rootFolderID, dir)
+	if err != nil {
+		return nil, fmt.Errorf("resolve hard link: %s", err)
+	}
+	inode, err := v.lookup(private.id, name)
+	if err != nil {
+		return nil, fmt.Errorf("resolve hard link: %s", err)
+	}
+	return inode, nil
+}
+
+func (v *volume) inode(rec *record) diskfs.Inode {
+	mode := diskfs.UnixMode(rec.mode)
+	if rec.mode&0170000 == 0 {
+		// volumes without permissions.
+		mode = 0644
+		if rec.typ == recordFolder {
+			mode = 0755
+		}
+	}
+	inode := diskfs.Inode{
+		ID:      uint64(rec.id),
+		Mode:    mode,
+		ModTime: hfsTime(rec.modDate),
+		Sys: &Stat{
+			CNID:       rec.id,
+			UID:        rec.uid,
+			GID:        rec.gid,
+			Flags:      uint32(rec.adminFlags)<<16 | uint32(rec.ownerFlags),
+			CreateTime: hfsTime(rec.createDate),
+		},
+		Node: rec,
+	}
+	if rec.typ == recordFolder {
+		inode.Mode |= fs.ModeDir
+	} else {
+		inode.Size = int64(rec.data.LogicalSize)
+		inode.Sys.(*Stat).Type = fourCCString(rec.fileType)
+		inode.Sys.(*Stat).Creator = fourCCString(rec.creator)
+	}
+	return inode
+}
+
+// parseRecord parses a file or folder record. Thread records return nil.
+func parseRecord(data []byte) (*record, error) {
+	if len(data) < 2 {
+		return nil, errors.New("corrupt catalog record")
+	}
+	rec := &record{typ: int16(binary.BigEndian.Uint16(data))}
+	switch rec.typ {
+	case recordFolderThread, recordFileThread:
+		return nil, nil
+	case recordFolder:
+		if len(data) < 88 {
+			return nil, errors.New("corrupt folder record")
+		}
+	case recordFile:
+		if len(data) < 248 {
+			return nil, errors.New("corrupt file record")
+		}
+		rec.fileType = binary.BigEndian.Uint32(data[48:])
+		rec.creator = binary.BigEndian.Uint32(data[52:])
+		rec.data = parseFork(data[88:])
+		rec.rsrc = parseFork(data[168:])
+	default:
+		return nil, fmt.Errorf("unknown catalog record type %d", rec.typ)
+	}
+	rec.id = binary.BigEndian.Uint32(data[8:])
+	rec.createDate = binary.BigEndian.Uint32(data[12:])
+	rec.modDate = binary.BigEndian.Uint32(data[16:])
+	rec.uid = binary.BigEndian.Uint32(data[32:])
+	rec.gid = binary.BigEndian.Uint32(data[36:])
+	rec.adminFlags = data[40]
+	rec.ownerFlags = data[41]
+	rec.mode = binary.BigEndian.Uint16(data[42:])
+	rec.special = binary.BigEndian.Uint32(data[44:])
+	return rec, nil
+}
+
+// parseName decodes a length prefixed UTF-16 name.
+func parseName(b []byte) (string, error) {
+	n := int(binary.BigEndian.Uint16(b))
+	if 2+2*n > len(b) {
+		return "", errors.New("corrupt catalog name")
+	}
+	u := make([]uint16, n)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2+2*i:])
+	}
+	return string(utf16.Decode(u)), nil
+}
+
+func hfsTime(t uint32) time.Time {
+	return hfsEpoch.Add(time.Duration(t) * time.Second)
+}
+
+func fourCC(s string) uint32 {
+	return binary.BigEndian.Uint32([]byte(s))
+}
+
+func fourCCString(v uint32) string {
+	if v == 0 {
+		return ""
+	}
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return string(b)
+}
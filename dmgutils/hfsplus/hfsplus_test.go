@@ -0,0 +1,261 @@
+package hfsplus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"sort"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+)
+
+func TestOpen(t *testing.T) {
+	fsys, err := Open(bytes.NewReader(buildVolume()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "a:b", "hello.txt", "link", "sub/frag.bin", "sub/hard.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	if want := []string{"a:b", "hello.txt", "link", "sub"}; !equal(names, want) {
+		t.Errorf("have entries %q, want %q", names, want)
+	}
+
+	var frag []byte
+	for i := 0; i < 9; i++ {
+		frag = append(frag, bytes.Repeat([]byte{'a' + byte(i)}, testBlockSize)...)
+	}
+	frag = frag[:len(frag)-10]
+	var files = []struct {
+		name string
+		want []byte
+	}{
+		{"hello.txt", []byte("hello, world\n")},
+		{"hello.txt/..namedfork/rsrc", []byte("RSRC")},
+		{"link", []byte("hello, world\n")},
+		{"sub/hard.txt", []byte("linked\n")},
+		{"sub/frag.bin", frag},
+		{"a:b", []byte{}},
+	}
+	for _, tt := range files {
+		have, err := fs.ReadFile(fsys, tt.name)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(have, tt.want) {
+			t.Errorf("%s: have %d bytes, want %d", tt.name, len(have), len(tt.want))
+		}
+	}
+
+	fi, err := fs.Stat(fsys, "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fi.Sys().(*Stat)
+	if st.CNID != 16 || st.UID != 501 || st.Type != "TEXT" || st.Creator != "ttxt" {
+		t.Errorf("have stat %+v", st)
+	}
+	if have, want := fi.ModTime().Unix(), hfsEpoch.Unix()+testDate; have != want {
+		t.Errorf("have mod time %d, want %d", have, want)
+	}
+	if fi, err := fs.Stat(fsys, "sub/hard.txt"); err != nil || fi.Sys().(*Stat).CNID != 21 {
+		t.Errorf("hard link doesn't resolve to its inode: %v", err)
+	}
+	if _, err := fs.Stat(fsys, "sub/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("have %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestOpenNotHFSPlus(t *testing.T) {
+	if _, err := Open(bytes.NewReader(make([]byte, 4096))); err != ErrNotHFSPlus {
+		t.Errorf("have %v, want %v", err, ErrNotHFSPlus)
+	}
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	testBlockSize = 4096
+	testDate      = 3700000000
+)
+
+// be encodes fixed size values in big endian.
+func be(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// buildNode builds a b-tree node holding the records.
+func buildNode(kind int8, height uint8, forward uint32, records [][]byte) []byte {
+	b := make([]byte, testBlockSize)
+	copy(b, be(forward, uint32(0), kind, height, uint16(len(records))))
+	offset := nodeDescriptorSize
+	for i, rec := range records {
+		copy(b[offset:], rec)
+		binary.BigEndian.PutUint16(b[len(b)-2*(i+1):], uint16(offset))
+		offset += len(rec)
+	}
+	binary.BigEndian.PutUint16(b[len(b)-2*(len(records)+1):], uint16(offset))
+	return b
+}
+
+func headerNode(root, totalNodes uint32, maxKeyLen uint16, attributes uint32) []byte {
+	header := be(uint16(1), root, uint32(0), uint32(0), uint32(0), uint16(testBlockSize), maxKeyLen,
+		totalNodes, uint32(0), uint16(0), uint32(0), uint8(0), uint8(0xcf), attributes, [16]uint32{})
+	return buildNode(nodeHeader, 0, 0, [][]byte{header, make([]byte, 128), make([]byte, 256)})
+}
+
+func catalogKey(parent uint32, name string) []byte {
+	u := utf16.Encode([]rune(name))
+	return be(uint16(6+2*len(u)), parent, uint16(len(u)), u)
+}
+
+func forkBytes(size uint64, extents ...extent) []byte {
+	var blocks uint32
+	for _, e := range extents {
+		blocks += e.BlockCount
+	}
+	var ext [8]extent
+	copy(ext[:], extents)
+	return be(size, uint32(0), blocks, ext)
+}
+
+func perms(mode uint16, special uint32) []byte {
+	return be(uint32(501), uint32(20), uint8(0), uint8(0), mode, special)
+}
+
+func folderRecord(id uint32) []byte {
+	rec := be(int16(recordFolder), uint16(0), uint32(0), id,
+		uint32(testDate), uint32(testDate), uint32(0), uint32(0), uint32(0))
+	rec = append(rec, perms(040755, 0)...)
+	return append(rec, make([]byte, 40)...)
+}
+
+func fileRecord(id uint32, mode uint16, special uint32, fileType, creator string, data, rsrc []byte) []byte {
+	rec := be(int16(recordFile), uint16(0), uint32(0), id,
+		uint32(testDate), uint32(testDate), uint32(0), uint32(0), uint32(0))
+	rec = append(rec, perms(mode, special)...)
+	info := make([]byte, 40)
+	copy(info, fileType)
+	copy(info[4:], creator)
+	rec = append(rec, info...)
+	if data == nil {
+		data = forkBytes(0)
+	}
+	if rsrc == nil {
+		rsrc = forkBytes(0)
+	}
+	return append(append(rec, data...), rsrc...)
+}
+
+func threadRecord(typ int16, parent uint32, name string) []byte {
+	return append(be(typ, int16(0), parent), catalogKey(0, name)[6:]...)
+}
+
+// buildVolume builds an HFS+ volume:
+//
+//	a/b           an empty file, with a '/' in its catalog name
+//	hello.txt     a file with a resource fork
+//	link -> hello.txt
+//	sub/frag.bin  a file with 9 extents, one in the extents overflow file
+//	sub/hard.txt  a hard link
+//
+// The catalog file is split in two extents, and its root is an index node.
+func buildVolume() []byte {
+	img := make([]byte, 24*testBlockSize)
+	put := func(n int, b []byte) { copy(img[n*testBlockSize:], b) }
+
+	var fragExtents []extent
+	for i := 0; i < 9; i++ {
+		put(12+i, bytes.Repeat([]byte{'a' + byte(i)}, testBlockSize))
+		fragExtents = append(fragExtents, extent{uint32(12 + i), 1})
+	}
+	fragFork := forkBytes(9*testBlockSize-10, fragExtents[:8]...)
+	// the fork data counts all the blocks of the file.
+	binary.BigEndian.PutUint32(fragFork[12:], 9)
+
+	put(5, []byte("hello, world\n"))
+	put(6, []byte("RSRC"))
+	put(7, []byte("hello.txt"))
+	put(8, []byte("linked\n"))
+
+	type record struct{ key, data []byte }
+	records := []record{
+		{catalogKey(1, "Test"), folderRecord(rootFolderID)},
+		{catalogKey(2, ""), threadRecord(recordFolderThread, 1, "Test")},
+		{catalogKey(2, privateDataDir), folderRecord(22)},
+		{catalogKey(2, "a/b"), fileRecord(23, 0100644, 0, "", "", nil, nil)},
+		{catalogKey(2, "hello.txt"), fileRecord(16, 0100644, 0, "TEXT", "ttxt",
+			forkBytes(13, extent{5, 1}), forkBytes(4, extent{6, 1}))},
+		{catalogKey(2, "link"), fileRecord(17, 0120755, 0, "slnk", "rhap", forkBytes(9, extent{7, 1}), nil)},
+		{catalogKey(2, "sub"), folderRecord(18)},
+		{catalogKey(16, ""), threadRecord(recordFileThread, 2, "hello.txt")},
+		{catalogKey(18, ""), threadRecord(recordFolderThread, 2, "sub")},
+		{catalogKey(18, "frag.bin"), fileRecord(19, 0100600, 0, "", "", fragFork, nil)},
+		{catalogKey(18, "hard.txt"), fileRecord(20, 0100444, 21, "hlnk", "hfs+", nil, nil)},
+		{catalogKey(22, ""), threadRecord(recordFolderThread, 2, privateDataDir)},
+		{catalogKey(22, "iNode21"), fileRecord(21, 0100644, 2, "", "", forkBytes(7, extent{8, 1}), nil)},
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return binary.BigEndian.Uint32(records[i].key[2:]) < binary.BigEndian.Uint32(records[j].key[2:])
+	})
+	var leafA, leafB [][]byte
+	for i, r := range records {
+		if i < 7 {
+			leafA = append(leafA, append(r.key, r.data...))
+		} else {
+			leafB = append(leafB, append(r.key, r.data...))
+		}
+	}
+	// catalog nodes 0 and 1 are in blocks 3 and 4, nodes 2 and 3 in blocks
+	// 10 and 11.
+	put(3, headerNode(1, 4, 516, 0x6))
+	put(4, buildNode(nodeIndex, 2, 0, [][]byte{
+		append(append([]byte(nil), records[0].key...), be(uint32(2))...),
+		append(append([]byte(nil), records[7].key...), be(uint32(3))...),
+	}))
+	put(10, buildNode(nodeLeaf, 1, 3, leafA))
+	put(11, buildNode(nodeLeaf, 1, 0, leafB))
+
+	// the 9th extent of frag.bin is in the extents overflow file.
+	put(1, headerNode(1, 2, 10, 0x2))
+	put(2, buildNode(nodeLeaf, 1, 0, [][]byte{
+		append(be(uint16(10), uint8(forkData), uint8(0), uint32(19), uint32(8)), be(fragExtents[8], [7]extent{})...),
+	}))
+
+	vh := be([2]byte{'H', '+'}, uint16(4), uint32(0), uint32(0), uint32(0),
+		uint32(testDate), uint32(testDate), uint32(0), uint32(0),
+		uint32(5), uint32(3), uint32(testBlockSize), uint32(24))
+	vh = append(vh, make([]byte, 192-len(vh))...)
+	vh = append(vh, forkBytes(2*testBlockSize, extent{1, 2})...)
+	vh = append(vh, forkBytes(4*testBlockSize, extent{3, 2}, extent{10, 2})...)
+	copy(img[volumeHeaderOffset:], vh)
+	return img
+}
@@ -0,0 +1,300 @@
+package dmgutils
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	plist "github.com/groob/plist"
+)
+
+// Format is the format of a disk image, as named by hdiutil.
+type Format string
+
+// Disk image formats.
+const (
+	UDRW Format = "UDRW" // read/write
+	UDRO Format = "UDRO" // read-only
+	UDCO Format = "UDCO" // ADC compressed
+	UDZO Format = "UDZO" // zlib compressed
+	UDBZ Format = "UDBZ" // bzip2 compressed
+	ULFO Format = "ULFO" // lzfse compressed
+	ULMO Format = "ULMO" // lzma compressed
+	UDSP Format = "UDSP" // sparse image
+	UDSB Format = "UDSB" // sparse bundle
+	RAW  Format = "RAW*" // raw disk image, without a UDIF trailer
+)
+
+// ImageInfo describes a disk image file.
+type ImageInfo struct {
+	Format Format
+	// PartitionScheme is the partition map of the disk image, such as GUID,
+	// or none for an image of a single file system.
+	PartitionScheme string
+	Partitions      []Partition
+	// Encrypted images can't be inspected further without the passphrase.
+	Encrypted        bool
+	LicenseAgreement bool
+	// ChecksumType is the type of the checksum of the image, such as CRC32.
+	// It is empty when the image isn't checksummed.
+	ChecksumType string
+	// Checksum is the checksum stored in the image, formatted like hdiutil,
+	// such as $5B6B8C2C.
+	Checksum string
+	// ChecksumValid reports whether the CRC32 checksum of the image matches
+	// the checksums of its block tables. It doesn't check the data, which
+	// would read the whole image: use Verify for that.
+	ChecksumValid bool
+	// Size is the size of the disk image, in bytes.
+	Size int64
+}
+
+// hdiutilPath is the path of hdiutil. It is replaced in tests.
+var hdiutilPath = "/usr/bin/hdiutil"
+
+// Info describes the disk image at dmgpath, using hdiutil imageinfo.
+// Where hdiutil isn't available, such as on Linux, UDIF images are read
+// directly. Sparse images, and the contents of encrypted images can only be
+// described by hdiutil.
+func Info(dmgpath string, opts ...Option) (*ImageInfo, error) {
+	if _, err := os.Stat(hdiutilPath); err != nil {
+		return readImageInfo(dmgpath)
+	}
+	o := new(hdiutil)
+	o.ctx = context.Background()
+	if err := o.apply(opts...); err != nil {
+		return nil, err
+	}
+	if _, ok := o.ctx.Deadline(); !ok {
+		var cancel func()
+		o.ctx, cancel = context.WithTimeout(o.ctx, 10*time.Minute)
+		defer cancel()
+	}
+
+	args := append([]string{"imageinfo", dmgpath, "-plist"}, o.unlockArgs()...)
+	cmd := exec.CommandContext(o.ctx, hdiutilPath, append(args, o.args...)...)
+	cmd.Stdin = o.stdin()
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, hdiutilError("imageinfo", err)
+	}
+	info, err := parseImageInfo(out)
+	if err != nil {
+		return nil, err
+	}
+	if info.ChecksumType == "CRC32" {
+		// hdiutil imageinfo doesn't check the checksum.
+		if u, err := OpenUDIF(dmgpath, SkipChecksum()); err == nil {
+			info.ChecksumValid = u.checksumValid()
+			u.Close()
+		}
+	}
+	return info, nil
+}
+
+// Verify checks the checksums of the disk image at dmgpath, using hdiutil
+// verify. Where hdiutil isn't available, UDIF images are verified directly,
+// and ErrChecksum is returned if a checksum doesn't match.
+func Verify(dmgpath string, opts ...Option) error {
+	if _, err := os.Stat(hdiutilPath); err != nil {
+		return verifyUDIF(dmgpath)
+	}
+	o := new(hdiutil)
+	o.ctx = context.Background()
+	if err := o.apply(opts...); err != nil {
+		return err
+	}
+	if _, ok := o.ctx.Deadline(); !ok {
+		var cancel func()
+		o.ctx, cancel = context.WithTimeout(o.ctx, 1*time.Hour)
+		defer cancel()
+	}
+
+	args := append([]string{"verify", dmgpath}, o.unlockArgs()...)
+	cmd := exec.CommandContext(o.ctx, hdiutilPath, append(args, o.args...)...)
+	cmd.Stdin = o.stdin()
+	if _, err := cmd.Output(); err != nil {
+		return hdiutilError("verify", err)
+	}
+	return nil
+}
+
+type imageInfoPlist struct {
+	Format        string `plist:"Format"`
+	ChecksumType  string `plist:"Checksum Type"`
+	ChecksumValue string `plist:"Checksum Value"`
+	Properties    struct {
+		Encrypted        bool `plist:"Encrypted"`
+		LicenseAgreement bool `plist:"Software License Agreement"`
+	} `plist:"Properties"`
+	SizeInformation struct {
+		TotalBytes  int64 `plist:"Total Bytes"`
+		SectorCount int64 `plist:"Sector Count"`
+	} `plist:"Size Information"`
+	Partitions struct {
+		BlockSize       int64  `plist:"block-size"`
+		PartitionScheme string `plist:"partition-scheme"`
+		Partitions      []struct {
+			Name   string `plist:"partition-name"`
+			Hint   string `plist:"partition-hint"`
+			Start  int64  `plist:"partition-start"`
+			Length int64  `plist:"partition-length"`
+		} `plist:"partitions"`
+	} `plist:"partitions"`
+}
+
+func parseImageInfo(out []byte) (*ImageInfo, error) {
+	var p imageInfoPlist
+	if err := plist.NewDecoder(bytes.NewReader(out)).Decode(&p); err != nil {
+		return nil, err
+	}
+	info := &ImageInfo{
+		Format:           Format(p.Format),
+		PartitionScheme:  p.Partitions.PartitionScheme,
+		Encrypted:        p.Properties.Encrypted,
+		LicenseAgreement: p.Properties.LicenseAgreement,
+		ChecksumType:     p.ChecksumType,
+		Checksum:         p.ChecksumValue,
+		Size:             p.SizeInformation.TotalBytes,
+	}
+	if info.ChecksumType == "none" {
+		info.ChecksumType, info.Checksum = "", ""
+	}
+	if info.Size == 0 {
+		info.Size = p.SizeInformation.SectorCount * sectorSize
+	}
+	blockSize := p.Partitions.BlockSize
+	if blockSize == 0 {
+		blockSize = sectorSize
+	}
+	for _, part := range p.Partitions.Partitions {
+		info.Partitions = append(info.Partitions, Partition{
+			Name:   part.Name,
+			Type:   part.Hint,
+			Offset: part.Start * blockSize,
+			Size:   part.Length * blockSize,
+		})
+	}
+	return info, nil
+}
+
+// readImageInfo describes an image without hdiutil.
+func readImageInfo(dmgpath string) (*ImageInfo, error) {
+	fi, err := os.Stat(dmgpath)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return readSparseBundleInfo(dmgpath)
+	}
+
+	f, err := os.Open(dmgpath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var head, tail [8]byte
+	f.ReadAt(head[:], 0)
+	f.ReadAt(tail[:], fi.Size()-8)
+	switch {
+	case string(head[:]) == "encrcdsa" || string(tail[:]) == "cdsaencr":
+		return &ImageInfo{Encrypted: true}, nil
+	case string(head[:4]) == "sprs":
+		return &ImageInfo{Format: UDSP}, nil
+	}
+
+	// only the trailer, the resources and the partition map are read.
+	u, err := NewUDIFReader(f, fi.Size(), SkipChecksum())
+	if err == errNotUDIF {
+		return &ImageInfo{Format: RAW, Size: fi.Size()}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	info := &ImageInfo{
+		Format:           udifFormat(u.chunks),
+		PartitionScheme:  partitionScheme(u),
+		Partitions:       u.Partitions(),
+		LicenseAgreement: len(u.resources["LPic"]) > 0,
+		Size:             u.Size(),
+	}
+	if u.koly.ChecksumType == checksumCRC32 {
+		info.ChecksumType = "CRC32"
+		info.Checksum = fmt.Sprintf("$%08X", binary.BigEndian.Uint32(u.koly.Checksum[:]))
+		info.ChecksumValid = u.checksumValid()
+	}
+	return info, nil
+}
+
+// udifFormat guesses the format of a UDIF image from the compression of its
+// chunks. Read-only and read/write images can't be told apart, and are both
+// reported as UDRW.
+func udifFormat(chunks []udifChunk) Format {
+	for _, c := range chunks {
+		switch c.typ {
+		case chunkADC:
+			return UDCO
+		case chunkZlib:
+			return UDZO
+		case chunkBzip2:
+			return UDBZ
+		case chunkLZFSE:
+			return ULFO
+		case chunkLZMA:
+			return ULMO
+		}
+	}
+	return UDRW
+}
+
+// partitionScheme reads the partition map at the start of a disk image.
+func partitionScheme(r io.ReaderAt) string {
+	buf := make([]byte, 2*sectorSize)
+	if n, _ := r.ReadAt(buf, 0); n < len(buf) {
+		return "none"
+	}
+	switch {
+	case string(buf[sectorSize:sectorSize+8]) == "EFI PART":
+		return "GUID"
+	case string(buf[:2]) == "ER" && string(buf[sectorSize:sectorSize+2]) == "PM":
+		return "Apple"
+	case buf[510] == 0x55 && buf[511] == 0xaa:
+		return "MBR"
+	}
+	return "none"
+}
+
+// readSparseBundleInfo describes a sparse bundle from its Info.plist.
+func readSparseBundleInfo(bundle string) (*ImageInfo, error) {
+	f, err := os.Open(filepath.Join(bundle, "Info.plist"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p struct {
+		Size int64 `plist:"size"`
+	}
+	if err := plist.NewDecoder(f).Decode(&p); err != nil {
+		return nil, fmt.Errorf("dmgutils: decode sparse bundle Info.plist: %s", err)
+	}
+	_, err = os.Stat(filepath.Join(bundle, "token"))
+	return &ImageInfo{Format: UDSB, Encrypted: err == nil, Size: p.Size}, nil
+}
+
+// verifyUDIF verifies an image without hdiutil.
+func verifyUDIF(dmgpath string) error {
+	u, err := OpenUDIF(dmgpath)
+	if err == errNotUDIF {
+		return fmt.Errorf("dmgutils: %s isn't a UDIF image", dmgpath)
+	} else if err != nil {
+		return err
+	}
+	defer u.Close()
+	return u.Verify()
+}
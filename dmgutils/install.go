@@ -0,0 +1,230 @@
+package dmgutils
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/groob/mackit/install/pkg"
+)
+
+// ErrNothingToInstall is returned by InstallFromDMG when no item of the image
+// matches.
+var ErrNothingToInstall = errors.New("dmgutils: no app or package to install in image")
+
+// ErrAmbiguousItems is returned by InstallFromDMG when no items are selected
+// with WithItems and the image holds more than one app or package.
+var ErrAmbiguousItems = errors.New("dmgutils: more than one app or package in image, select the items to install")
+
+// InstallOption customizes InstallFromDMG.
+type InstallOption func(*installOptions)
+
+type installOptions struct {
+	items       []string
+	destination string
+	attachOpts  []Option
+	pkgOpts     []pkg.Option
+
+	// replaced in tests.
+	installPkg func(string, ...pkg.Option) (bool, error)
+}
+
+// WithItems selects the items to install by name or glob pattern, such as
+// "Foo.app" or "*.pkg", matched against the top level of the mounted volumes.
+// By default the image must hold a single app or package, which is installed,
+// so that images which also hold uninstallers or helpers aren't installed by
+// accident.
+func WithItems(patterns ...string) InstallOption {
+	return func(o *installOptions) {
+		o.items = append(o.items, patterns...)
+	}
+}
+
+// WithDestination sets the directory apps are copied to. The default is
+// /Applications.
+func WithDestination(dir string) InstallOption {
+	return func(o *installOptions) {
+		o.destination = dir
+	}
+}
+
+// WithAttachOptions sets the options used to attach the image, such as
+// WithPassphrase or AcceptLicense.
+func WithAttachOptions(opts ...Option) InstallOption {
+	return func(o *installOptions) {
+		o.attachOpts = append(o.attachOpts, opts...)
+	}
+}
+
+// WithPkgOptions sets the options used to install packages.
+func WithPkgOptions(opts ...pkg.Option) InstallOption {
+	return func(o *installOptions) {
+		o.pkgOpts = append(o.pkgOpts, opts...)
+	}
+}
+
+// InstallResult lists what InstallFromDMG installed.
+type InstallResult struct {
+	// Apps are the paths of the copied apps.
+	Apps []string
+	// Packages are the names of the installed packages.
+	Packages []string
+	// Restart is true if a package requires a restart.
+	Restart bool
+}
+
+// InstallFromDMG attaches the image at dmgpath, copies its apps to the
+// destination, replacing existing copies, and installs its packages with
+// pkg.Install. The image is always detached. If an item fails to install,
+// the result lists the items installed before it, along with the error.
+func InstallFromDMG(dmgpath string, opts ...InstallOption) (*InstallResult, error) {
+	o := newInstallOptions(opts...)
+	attachOpts := append([]Option{ReadOnly(), NoAutoOpen()}, o.attachOpts...)
+	img, err := Attach(dmgpath, attachOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(InstallResult)
+	err = installFrom(img.MountPoints(), o, result)
+	if detachErr := Detach(img); err == nil && detachErr != nil {
+		err = detachErr
+	}
+	return result, err
+}
+
+func newInstallOptions(opts ...InstallOption) *installOptions {
+	o := &installOptions{destination: "/Applications", installPkg: pkg.Install}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// installFrom installs the matching items of the mounted volumes in dirs.
+func installFrom(dirs []string, o *installOptions, result *InstallResult) error {
+	var paths []string
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for _, fi := range infos {
+			matched, err := o.match(fi.Name())
+			if err != nil {
+				return err
+			}
+			if matched {
+				names = append(names, fi.Name())
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	switch {
+	case len(paths) == 0:
+		return ErrNothingToInstall
+	case len(paths) > 1 && len(o.items) == 0:
+		return fmt.Errorf("%w: %s", ErrAmbiguousItems, strings.Join(baseNames(paths), ", "))
+	}
+
+	for _, src := range paths {
+		name := filepath.Base(src)
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".app":
+			dst := filepath.Join(o.destination, name)
+			if err := replaceBundle(dst, src); err != nil {
+				return err
+			}
+			result.Apps = append(result.Apps, dst)
+		case ".pkg", ".mpkg":
+			restart, err := o.installPkg(src, o.pkgOpts...)
+			if err != nil {
+				return fmt.Errorf("dmgutils: install %s: %w", name, err)
+			}
+			result.Packages = append(result.Packages, name)
+			result.Restart = result.Restart || restart
+		default:
+			return fmt.Errorf("dmgutils: don't know how to install %s", name)
+		}
+	}
+	return nil
+}
+
+func baseNames(paths []string) []string {
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = filepath.Base(path)
+	}
+	return names
+}
+
+// match reports whether the item should be installed.
+func (o *installOptions) match(name string) (bool, error) {
+	if len(o.items) == 0 {
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".app", ".pkg", ".mpkg":
+			return true, nil
+		}
+		return false, nil
+	}
+	for _, pattern := range o.items {
+		matched, err := filepath.Match(pattern, name)
+		if err != nil {
+			return false, fmt.Errorf("dmgutils: invalid item pattern %q: %w", pattern, err)
+		}
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rename is replaced in tests.
+var rename = os.Rename
+
+// replaceBundle copies the bundle at src to a temporary path next to dst,
+// before replacing dst with it, so that dst is never left half copied. The
+// existing bundle is moved aside until the copy is in place, and is restored
+// if that fails.
+func replaceBundle(dst, src string) error {
+	tmpDir, err := ioutil.TempDir(filepath.Dir(dst), ".mackit-install")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmp := filepath.Join(tmpDir, filepath.Base(dst))
+	if err := CopyBundle(tmp, src); err != nil {
+		return err
+	}
+
+	old := filepath.Join(tmpDir, "old")
+	_, err = os.Lstat(dst)
+	switch {
+	case os.IsNotExist(err):
+		old = ""
+	case err != nil:
+		return err
+	default:
+		if err := rename(dst, old); err != nil {
+			return err
+		}
+	}
+	if err := rename(tmp, dst); err != nil {
+		if old != "" {
+			if restoreErr := rename(old, dst); restoreErr != nil {
+				return fmt.Errorf("dmgutils: replace %s: %v, and restoring the previous copy failed: %w", dst, err, restoreErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package dmgutils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ErrLicenseAgreement is returned by Attach when an image has a software
+// license agreement and AcceptLicense wasn't used.
+// hdiutil would otherwise wait for the license to be accepted until the
+// command times out.
+var ErrLicenseAgreement = errors.New("dmgutils: image has a software license agreement")
+
+// AcceptLicense accepts the software license agreement of an image, if it
+// has one.
+func AcceptLicense() Option {
+	return func(o *hdiutil) {
+		o.acceptLicense = true
+	}
+}
+
+// HasLicenseAgreement reports whether the image at dmgpath has an embedded
+// software license agreement. The license is looked up in the resources of
+// UDIF images, and in the classic resource fork of legacy images, either
+// stored in the image or in the resource fork of the file.
+func HasLicenseAgreement(dmgpath string) (bool, error) {
+	f, err := os.Open(dmgpath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.IsDir() {
+		// sparse bundles are directories, and don't have licenses.
+		return false, nil
+	}
+
+	// the license texts are stored in the TEXT, RTF and STR# resources, and
+	// the LPic resource maps them to languages.
+	if rsrc, err := ioutil.ReadFile(rsrcForkPath(dmgpath)); err == nil && len(rsrc) > 0 {
+		if types, err := resourceTypes(rsrc); err == nil && types["LPic"] {
+			return true, nil
+		}
+	}
+
+	k, err := readKoly(f, fi.Size())
+	if err == errNotUDIF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	resources, err := readResources(f, fi.Size(), k)
+	if err != nil {
+		return false, err
+	}
+	if len(resources["LPic"]) > 0 {
+		return true, nil
+	}
+	if k.RsrcForkLength == 0 {
+		return false, nil
+	}
+	end := k.RsrcForkOffset + k.RsrcForkLength
+	if end < k.RsrcForkOffset || end > uint64(fi.Size()) || k.RsrcForkLength > maxResourceFork {
+		return false, fmt.Errorf("dmgutils: invalid resource fork location")
+	}
+	rsrc := make([]byte, k.RsrcForkLength)
+	if _, err := f.ReadAt(rsrc, int64(k.RsrcForkOffset)); err != nil {
+		return false, err
+	}
+	types, err := resourceTypes(rsrc)
+	if err != nil {
+		return false, err
+	}
+	return types["LPic"], nil
+}
+
+// rsrcForkPath returns the path of the resource fork of a file on macOS. It is
+// replaced in tests.
+var rsrcForkPath = func(path string) string {
+	return path + "/..namedfork/rsrc"
+}
+
+// maxResourceFork is the largest classic resource fork, whose offsets are 24
+// bit integers.
+const maxResourceFork = 16 << 20
+
+// resourceTypes returns the types of the resources of a classic resource
+// fork. The fork starts with a header locating the resource map, and the type
+// list of the map holds the types.
+func resourceTypes(rsrc []byte) (map[string]bool, error) {
+	invalid := errors.New("dmgutils: invalid resource fork")
+	if len(rsrc) < 16 {
+		return nil, invalid
+	}
+	mapOffset := uint64(binary.BigEndian.Uint32(rsrc[4:]))
+	mapLength := uint64(binary.BigEndian.Uint32(rsrc[12:]))
+	if mapLength < 28 || mapOffset+mapLength > uint64(len(rsrc)) {
+		return nil, invalid
+	}
+	m := rsrc[mapOffset : mapOffset+mapLength]
+	typeList := uint64(binary.BigEndian.Uint16(m[24:]))
+	if typeList+2 > uint64(len(m)) {
+		return nil, invalid
+	}
+	// the number of types is stored minus one, so 0xffff is an empty list.
+	count := (uint64(binary.BigEndian.Uint16(m[typeList:])) + 1) & 0xffff
+	if typeList+2+count*8 > uint64(len(m)) {
+		return nil, invalid
+	}
+	types := make(map[string]bool, count)
+	for i := uint64(0); i < count; i++ {
+		entry := typeList + 2 + i*8
+		types[string(m[entry:entry+4])] = true
+	}
+	return types, nil
+}
@@ -0,0 +1,492 @@
+package dmgutils
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+
+	"github.com/groob/mackit/lzfse"
+)
+
+// The blkx resources of a UDIF image hold one block table (mish) per
+// partition of the disk image. Each table is a list of chunks, mapping a run
+// of 512 byte sectors of the disk image to a compressed or raw run of bytes
+// in the data fork.
+
+const sectorSize = 512
+
+// ErrChecksum is returned when the data of an image doesn't match a checksum
+// stored in the image.
+var ErrChecksum = errors.New("dmgutils: checksum mismatch")
+
+// chunk types.
+const (
+	chunkZero    = 0x00000000
+	chunkRaw     = 0x00000001
+	chunkIgnore  = 0x00000002
+	chunkADC     = 0x80000004
+	chunkZlib    = 0x80000005
+	chunkBzip2   = 0x80000006
+	chunkLZFSE   = 0x80000007
+	chunkLZMA    = 0x80000008
+	chunkComment = 0x7ffffffe
+	chunkEnd     = 0xffffffff
+)
+
+// maxChunkSize is the largest compressed chunk the reader decompresses, in
+// bytes. hdiutil writes chunks of 1 MiB or less, so larger chunks are only
+// found in corrupt or hostile images, whose chunk sizes would otherwise be
+// allocated as they are.
+const maxChunkSize = 64 << 20
+
+// checksum types.
+const (
+	checksumNone  = 0
+	checksumCRC32 = 2
+)
+
+type mishHeader struct {
+	Signature        [4]byte
+	Version          uint32
+	SectorNumber     uint64
+	SectorCount      uint64
+	DataOffset       uint64
+	BuffersNeeded    uint32
+	BlockDescriptors uint32
+	Reserved         [24]byte
+	ChecksumType     uint32
+	ChecksumSize     uint32
+	Checksum         [128]byte
+	ChunkCount       uint32
+}
+
+type mishChunk struct {
+	Type             uint32
+	Comment          uint32
+	SectorNumber     uint64
+	SectorCount      uint64
+	CompressedOffset uint64
+	CompressedLength uint64
+}
+
+// udifChunk is a chunk, with offsets resolved to the disk image and the
+// image file.
+type udifChunk struct {
+	typ    uint32
+	start  int64 // offset in the disk image
+	size   int64
+	offset int64 // offset in the image file
+	length int64
+}
+
+func (c udifChunk) end() int64 { return c.start + c.size }
+
+// Partition is a partition of the disk image, as listed in the block tables.
+type Partition struct {
+	// Name is the name of the block table, such as
+	// "disk image (Apple_HFS : 4)", or the partition name reported by
+	// hdiutil imageinfo.
+	Name string
+	// Type is the partition type parsed from the name, such as Apple_HFS or
+	// Apple_APFS. It is empty when the name doesn't include one.
+	Type string
+	// Offset and Size locate the partition in the disk image, in bytes.
+	Offset int64
+	Size   int64
+}
+
+// UDIFReader reads the raw disk image stored in a UDIF image, without
+// hdiutil. It implements io.ReaderAt, and is safe for concurrent use.
+type UDIFReader struct {
+	r          io.ReaderAt
+	closer     io.Closer
+	koly       *koly
+	size       int64
+	chunks     []udifChunk
+	partitions []Partition
+	tables     []blockTable
+	resources  map[string][]udifResource
+
+	// dataForkVerified is true if the checksum of the data fork was verified
+	// when the image was opened.
+	dataForkVerified bool
+
+	mu     sync.Mutex
+	cached int // index of the decompressed chunk in buf, or -1
+	buf    []byte
+}
+
+// ReaderOption customizes how OpenUDIF and NewUDIFReader read an image.
+type ReaderOption func(*readerOptions)
+
+type readerOptions struct {
+	skipChecksum bool
+}
+
+// SkipChecksum skips verifying the checksum of the data fork when the image
+// is opened, which reads the whole image. Use it to read a few files of a
+// large image. Verify still checks all the checksums.
+func SkipChecksum() ReaderOption {
+	return func(o *readerOptions) {
+		o.skipChecksum = true
+	}
+}
+
+// OpenUDIF opens the UDIF image at dmgpath. The caller must close the reader.
+func OpenUDIF(dmgpath string, opts ...ReaderOption) (*UDIFReader, error) {
+	f, err := os.Open(dmgpath)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	u, err := NewUDIFReader(f, fi.Size(), opts...)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	u.closer = f
+	return u, nil
+}
+
+// NewUDIFReader reads the UDIF image of size bytes from r, verifying the
+// checksum of its data fork unless SkipChecksum is set.
+func NewUDIFReader(r io.ReaderAt, size int64, opts ...ReaderOption) (*UDIFReader, error) {
+	var o readerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	k, err := readKoly(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if k.DataForkOffset+k.DataForkLength < k.DataForkOffset || k.DataForkOffset+k.DataForkLength > uint64(size) {
+		return nil, fmt.Errorf("dmgutils: invalid data fork location")
+	}
+	if !o.skipChecksum {
+		if err := verifyDataFork(r, k); err != nil {
+			return nil, err
+		}
+	}
+	resources, err := readResources(r, size, k)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &UDIFReader{r: r, koly: k, resources: resources, cached: -1, dataForkVerified: !o.skipChecksum}
+	for _, res := range resources["blkx"] {
+		t, err := parseBlockTable(res, k)
+		if err != nil {
+			return nil, err
+		}
+		u.tables = append(u.tables, t)
+		u.partitions = append(u.partitions, t.partition)
+		u.chunks = append(u.chunks, t.chunks...)
+	}
+	sort.Slice(u.chunks, func(i, j int) bool { return u.chunks[i].start < u.chunks[j].start })
+	for i := 1; i < len(u.chunks); i++ {
+		if u.chunks[i].start < u.chunks[i-1].end() {
+			return nil, fmt.Errorf("dmgutils: overlapping block chunks")
+		}
+	}
+
+	u.size = int64(k.SectorCount) * sectorSize
+	if n := len(u.chunks); n > 0 && u.chunks[n-1].end() > u.size {
+		u.size = u.chunks[n-1].end()
+	}
+	return u, nil
+}
+
+// verifyDataFork checks the data fork against the checksum in the trailer.
+// Only CRC32 checksums are verified; images without one are accepted.
+func verifyDataFork(r io.ReaderAt, k *koly) error {
+	if k.DataChecksumType != checksumCRC32 {
+		return nil
+	}
+	h := crc32.NewIEEE()
+	data := io.NewSectionReader(r, int64(k.DataForkOffset), int64(k.DataForkLength))
+	if _, err := io.Copy(h, data); err != nil {
+		return err
+	}
+	if h.Sum32() != binary.BigEndian.Uint32(k.DataChecksum[:]) {
+		return ErrChecksum
+	}
+	return nil
+}
+
+// blockTable is a parsed block table.
+type blockTable struct {
+	partition Partition
+	chunks    []udifChunk
+	// the checksum of the sectors of the partition, skipping the ignored
+	// chunks.
+	checksumType uint32
+	checksum     uint32
+}
+
+var partitionType = regexp.MustCompile(`\(([^():]+?)\s*:\s*\d+\)\s*$`)
+
+func parseBlockTable(res udifResource, k *koly) (blockTable, error) {
+	var h mishHeader
+	rd := bytes.NewReader(res.Data)
+	if err := binary.Read(rd, binary.BigEndian, &h); err != nil || string(h.Signature[:]) != "mish" {
+		return blockTable{}, fmt.Errorf("dmgutils: invalid block table %q", res.Name)
+	}
+	if uint64(rd.Len()) < uint64(h.ChunkCount)*40 {
+		return blockTable{}, fmt.Errorf("dmgutils: truncated block table %q", res.Name)
+	}
+	name := res.Name
+	if name == "" {
+		name = res.CFName
+	}
+	p := Partition{
+		Name:   name,
+		Offset: int64(h.SectorNumber) * sectorSize,
+		Size:   int64(h.SectorCount) * sectorSize,
+	}
+	if m := partitionType.FindStringSubmatch(name); m != nil {
+		p.Type = m[1]
+	}
+
+	t := blockTable{
+		partition:    p,
+		checksumType: h.ChecksumType,
+		checksum:     binary.BigEndian.Uint32(h.Checksum[:]),
+	}
+	for i := uint32(0); i < h.ChunkCount; i++ {
+		var c mishChunk
+		if err := binary.Read(rd, binary.BigEndian, &c); err != nil {
+			return blockTable{}, err
+		}
+		switch c.Type {
+		case chunkComment, chunkEnd:
+			continue
+		}
+		if c.SectorCount == 0 {
+			continue
+		}
+		offset := k.DataForkOffset + h.DataOffset + c.CompressedOffset
+		if c.SectorCount > 1<<40 || offset < c.CompressedOffset || offset+c.CompressedLength > k.DataForkOffset+k.DataForkLength {
+			return blockTable{}, fmt.Errorf("dmgutils: invalid chunk in block table %q", res.Name)
+		}
+		if compressed(c.Type) && (c.SectorCount*sectorSize > maxChunkSize || c.CompressedLength > maxChunkSize) {
+			return blockTable{}, fmt.Errorf("dmgutils: chunk of %d sectors in block table %q is too large", c.SectorCount, res.Name)
+		}
+		t.chunks = append(t.chunks, udifChunk{
+			typ:    c.Type,
+			start:  int64(h.SectorNumber+c.SectorNumber) * sectorSize,
+			size:   int64(c.SectorCount) * sectorSize,
+			offset: int64(offset),
+			length: int64(c.CompressedLength),
+		})
+	}
+	return t, nil
+}
+
+// compressed reports whether chunks of type typ are decompressed in memory.
+func compressed(typ uint32) bool {
+	switch typ {
+	case chunkZero, chunkRaw, chunkIgnore:
+		return false
+	}
+	return true
+}
+
+// Size returns the size of the disk image, in bytes.
+func (u *UDIFReader) Size() int64 { return u.size }
+
+// Partitions returns the partitions of the disk image, in the order of the
+// block tables.
+func (u *UDIFReader) Partitions() []Partition { return u.partitions }
+
+// Close closes the image file, if the reader was created by OpenUDIF.
+func (u *UDIFReader) Close() error {
+	if u.closer == nil {
+		return nil
+	}
+	return u.closer.Close()
+}
+
+// ReadAt reads len(p) bytes of the disk image, starting at off.
+// Sectors which aren't stored in the image read as zeros.
+func (u *UDIFReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("dmgutils: negative offset")
+	}
+	var n int
+	for n < len(p) {
+		if off >= u.size {
+			return n, io.EOF
+		}
+		want := p[n:]
+		if rest := u.size - off; int64(len(want)) > rest {
+			want = want[:rest]
+		}
+
+		i := sort.Search(len(u.chunks), func(i int) bool { return u.chunks[i].end() > off })
+		if i == len(u.chunks) || off < u.chunks[i].start {
+			// a gap between chunks.
+			if i < len(u.chunks) && int64(len(want)) > u.chunks[i].start-off {
+				want = want[:u.chunks[i].start-off]
+			}
+			zero(want)
+		} else {
+			c := u.chunks[i]
+			if int64(len(want)) > c.end()-off {
+				want = want[:c.end()-off]
+			}
+			if err := u.readChunk(want, i, off-c.start); err != nil {
+				return n, err
+			}
+		}
+		n += len(want)
+		off += int64(len(want))
+	}
+	return n, nil
+}
+
+// readChunk fills p with the data of chunk i, starting at off in the chunk.
+func (u *UDIFReader) readChunk(p []byte, i int, off int64) error {
+	c := u.chunks[i]
+	switch c.typ {
+	case chunkZero, chunkIgnore:
+		zero(p)
+		return nil
+	case chunkRaw:
+		if off+int64(len(p)) > c.length {
+			return fmt.Errorf("dmgutils: raw chunk at sector %d is truncated", c.start/sectorSize)
+		}
+		_, err := u.r.ReadAt(p, c.offset+off)
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.cached != i {
+		u.cached = -1
+		data, err := u.decompress(c)
+		if err != nil {
+			return err
+		}
+		u.buf, u.cached = data, i
+	}
+	copy(p, u.buf[off:])
+	return nil
+}
+
+func (u *UDIFReader) decompress(c udifChunk) ([]byte, error) {
+	src := make([]byte, c.length)
+	if _, err := u.r.ReadAt(src, c.offset); err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	var err error
+	switch c.typ {
+	case chunkZlib:
+		r, err = zlib.NewReader(bytes.NewReader(src))
+	case chunkBzip2:
+		r = bzip2.NewReader(bytes.NewReader(src))
+	case chunkLZMA:
+		if len(src) >= xz.HeaderLen && xz.ValidHeader(src[:xz.HeaderLen]) {
+			r, err = xz.NewReader(bytes.NewReader(src))
+		} else {
+			r, err = lzma.NewReader(bytes.NewReader(src))
+		}
+	case chunkLZFSE:
+		var data []byte
+		data, err = lzfse.Decode(src, int(c.size))
+		r = bytes.NewReader(data)
+	case chunkADC:
+		return nil, fmt.Errorf("dmgutils: ADC compressed chunks are not supported")
+	default:
+		return nil, fmt.Errorf("dmgutils: unknown chunk type %#x", c.typ)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dmgutils: decompress chunk at sector %d: %s", c.start/sectorSize, err)
+	}
+
+	buf := u.buf
+	if u.cached == -1 && int64(cap(buf)) >= c.size {
+		buf = buf[:c.size]
+	} else {
+		buf = make([]byte, c.size)
+	}
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("dmgutils: decompress chunk at sector %d: %s", c.start/sectorSize, err)
+	}
+	return buf, nil
+}
+
+// checksumValid reports whether the CRC32 checksum of the image matches the
+// checksums of the block tables it is computed from.
+func (u *UDIFReader) checksumValid() bool {
+	if u.koly.ChecksumType != checksumCRC32 {
+		return false
+	}
+	master := crc32.NewIEEE()
+	for _, t := range u.tables {
+		if t.checksumType == checksumCRC32 {
+			binary.Write(master, binary.BigEndian, t.checksum)
+		}
+	}
+	return master.Sum32() == binary.BigEndian.Uint32(u.koly.Checksum[:])
+}
+
+// Verify reads the whole disk image, checking the checksums of the block
+// tables, and the checksum of the image computed from them. It returns
+// ErrChecksum if a checksum doesn't match. Only CRC32 checksums are verified.
+//
+// The checksum of the data fork is only verified if it wasn't verified when
+// the image was opened.
+func (u *UDIFReader) Verify() error {
+	if !u.dataForkVerified {
+		if err := verifyDataFork(u.r, u.koly); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, chunkSectors*sectorSize)
+	for _, t := range u.tables {
+		if t.checksumType != checksumCRC32 {
+			continue
+		}
+		h := crc32.NewIEEE()
+		for _, c := range t.chunks {
+			if c.typ == chunkIgnore {
+				continue
+			}
+			r := io.NewSectionReader(u, c.start, c.size)
+			if _, err := io.CopyBuffer(h, r, buf); err != nil {
+				return err
+			}
+		}
+		if h.Sum32() != t.checksum {
+			return ErrChecksum
+		}
+	}
+	if u.koly.ChecksumType == checksumCRC32 && !u.checksumValid() {
+		return ErrChecksum
+	}
+	return nil
+}
+
+func zero(p []byte) {
+	for i := range p {
+		p[i] = 0
+	}
+}
@@ -0,0 +1,166 @@
+package dmgutils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	plist "github.com/groob/plist"
+)
+
+// Session records the images attached through it, so that all of them can be
+// detached when the work is done, or when the caller is shutting down:
+//
+//	s := dmgutils.NewSession()
+//	defer s.Close()
+//	img, err := s.Attach("/tmp/installer.dmg", dmgutils.ReadOnly())
+//
+// A Session is safe for concurrent use.
+type Session struct {
+	mu     sync.Mutex
+	images []*Image
+
+	// replaced in tests.
+	attach func(string, ...Option) (*Image, error)
+	detach func(*Image, ...Option) error
+}
+
+// NewSession creates an empty session.
+func NewSession() *Session {
+	return &Session{attach: Attach, detach: Detach}
+}
+
+// Attach attaches a disk image like Attach, and records it in the session.
+func (s *Session) Attach(dmgpath string, opts ...Option) (*Image, error) {
+	img, err := s.attach(dmgpath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.Adopt(img)
+	return img, nil
+}
+
+// MountDMG mounts a disk image like MountDMG, and records it in the session.
+func (s *Session) MountDMG(dmgpath string, opts ...Option) (mountedpaths []string, err error) {
+	img, err := s.Attach(dmgpath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return img.MountPoints(), nil
+}
+
+// Adopt records an image attached elsewhere, such as one found with
+// ListAttached, so that Close detaches it.
+func (s *Session) Adopt(img *Image) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images = append(s.images, img)
+}
+
+// Images returns the images recorded in the session, in the order they were
+// attached.
+func (s *Session) Images() []*Image {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Image(nil), s.images...)
+}
+
+// Detach detaches an image of the session, and removes it from the session.
+func (s *Session) Detach(img *Image, opts ...Option) error {
+	if err := s.detach(img, opts...); err != nil {
+		return err
+	}
+	s.remove(img)
+	return nil
+}
+
+func (s *Session) remove(img *Image) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, recorded := range s.images {
+		if recorded == img {
+			s.images = append(s.images[:i], s.images[i+1:]...)
+			return
+		}
+	}
+}
+
+// Close detaches all the images of the session, most recent first, forcing
+// the detach if needed. Images which can't be detached are kept in the
+// session, and the first error is returned.
+func (s *Session) Close(opts ...Option) error {
+	images := s.Images()
+	var firstErr error
+	for i := len(images) - 1; i >= 0; i-- {
+		if err := s.Detach(images[i], opts...); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("dmgutils: detach %s: %w", images[i].Path, err)
+		}
+	}
+	return firstErr
+}
+
+func infocmd(ctx context.Context, extraArgs ...string) *exec.Cmd {
+	args := []string{"info", "-plist"}
+	args = append(args, extraArgs...)
+	return exec.CommandContext(ctx, hdiutilPath, args...)
+}
+
+type hdiutilInfo struct {
+	Images []struct {
+		ImagePath      string           `plist:"image-path"`
+		SystemEntities []systemEntities `plist:"system-entities"`
+	} `plist:"images"`
+}
+
+func parseInfo(out []byte) ([]*Image, error) {
+	var p hdiutilInfo
+	if err := plist.NewDecoder(bytes.NewReader(out)).Decode(&p); err != nil {
+		return nil, err
+	}
+	images := []*Image{}
+	for _, img := range p.Images {
+		images = append(images, &Image{
+			Path:     img.ImagePath,
+			Entities: parseEntities(img.SystemEntities),
+		})
+	}
+	return images, nil
+}
+
+// ListAttached returns all the images attached on the system, as reported by
+// hdiutil info. A restarted process can use it to find the images it left
+// attached, and detach them with Detach or a Session.
+func ListAttached(opts ...Option) ([]*Image, error) {
+	o := new(hdiutil)
+	o.ctx = context.Background()
+	if err := o.apply(opts...); err != nil {
+		return nil, err
+	}
+
+	if _, ok := o.ctx.Deadline(); !ok {
+		var cancel func()
+		o.ctx, cancel = context.WithTimeout(o.ctx, 1*time.Minute)
+		defer cancel()
+	}
+
+	out, err := infocmd(o.ctx, o.args...).Output()
+	if err != nil {
+		return nil, hdiutilError("info", err)
+	}
+	return parseInfo(out)
+}
+
+// InDir reports whether the image file is in dir, or in one of its
+// subdirectories.
+func (img *Image) InDir(dir string) bool {
+	rel, err := filepath.Rel(filepath.Clean(dir), filepath.Clean(img.Path))
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
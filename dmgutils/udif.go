@@ -0,0 +1,104 @@
+package dmgutils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	plist "github.com/groob/plist"
+)
+
+// UDIF images (.dmg files) end with a 512 byte trailer, the koly block, which
+// points to the data fork and to an XML plist holding the resources of the
+// image, such as the block tables and license agreements.
+// All integers are big endian.
+
+const kolySize = 512
+
+var errNotUDIF = errors.New("dmgutils: not a UDIF image")
+
+type koly struct {
+	Signature             [4]byte
+	Version               uint32
+	HeaderSize            uint32
+	Flags                 uint32
+	RunningDataForkOffset uint64
+	DataForkOffset        uint64
+	DataForkLength        uint64
+	RsrcForkOffset        uint64
+	RsrcForkLength        uint64
+	SegmentNumber         uint32
+	SegmentCount          uint32
+	SegmentID             [16]byte
+	DataChecksumType      uint32
+	DataChecksumSize      uint32
+	DataChecksum          [128]byte
+	XMLOffset             uint64
+	XMLLength             uint64
+	Reserved1             [120]byte
+	ChecksumType          uint32
+	ChecksumSize          uint32
+	Checksum              [128]byte
+	ImageVariant          uint32
+	SectorCount           uint64
+	Reserved2             uint32
+	Reserved3             uint32
+	Reserved4             uint32
+}
+
+// udifResource is a resource of the resource-fork dictionary.
+type udifResource struct {
+	Attributes string `plist:"Attributes"`
+	CFName     string `plist:"CFName"`
+	Data       []byte `plist:"Data"`
+	ID         string `plist:"ID"`
+	Name       string `plist:"Name"`
+}
+
+type udifPlist struct {
+	ResourceFork map[string][]udifResource `plist:"resource-fork"`
+}
+
+// readKoly reads the trailer of a UDIF image of size bytes.
+func readKoly(r io.ReaderAt, size int64) (*koly, error) {
+	if size < kolySize {
+		return nil, errNotUDIF
+	}
+	buf := make([]byte, kolySize)
+	if _, err := r.ReadAt(buf, size-kolySize); err != nil {
+		return nil, err
+	}
+	var k koly
+	if err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &k); err != nil {
+		return nil, err
+	}
+	if string(k.Signature[:]) != "koly" || k.HeaderSize != kolySize {
+		return nil, errNotUDIF
+	}
+	return &k, nil
+}
+
+// readResources reads the XML plist with the resources of a UDIF image.
+func readResources(r io.ReaderAt, size int64, k *koly) (map[string][]udifResource, error) {
+	if k.XMLLength == 0 {
+		return map[string][]udifResource{}, nil
+	}
+	end := k.XMLOffset + k.XMLLength
+	if end < k.XMLOffset || end > uint64(size) || k.XMLLength > 1<<30 {
+		return nil, fmt.Errorf("dmgutils: invalid resource plist location")
+	}
+	buf := make([]byte, k.XMLLength)
+	if _, err := r.ReadAt(buf, int64(k.XMLOffset)); err != nil {
+		return nil, err
+	}
+	var p udifPlist
+	if err := plist.NewDecoder(bytes.NewReader(buf)).Decode(&p); err != nil {
+		return nil, fmt.Errorf("dmgutils: decode resource plist: %s", err)
+	}
+	if p.ResourceFork == nil {
+		p.ResourceFork = map[string][]udifResource{}
+	}
+	return p.ResourceFork, nil
+}
@@ -0,0 +1,265 @@
+package dmgutils
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/dsnet/compress/bzip2"
+	plist "github.com/groob/plist"
+)
+
+// WriterOption customizes the UDIF image written by WriteUDIF.
+type WriterOption func(*udifWriter)
+
+type udifWriter struct {
+	format Format
+	level  int
+	name   string
+}
+
+// WithFormat sets the format of the image. UDZO and UDBZ are supported;
+// the default is UDZO.
+func WithFormat(format Format) WriterOption {
+	return func(w *udifWriter) {
+		w.format = format
+	}
+}
+
+// WithCompressionLevel sets the compression level, from 1 to 9.
+// hdiutil uses level 1 for UDZO images by default.
+func WithCompressionLevel(level int) WriterOption {
+	return func(w *udifWriter) {
+		w.level = level
+	}
+}
+
+// WithPartitionName sets the name of the block table of the image, such as
+// "disk image (Apple_HFS : 0)". By default the name is guessed from the
+// content of the image.
+func WithPartitionName(name string) WriterOption {
+	return func(w *udifWriter) {
+		w.name = name
+	}
+}
+
+// chunkSectors is the size of the chunks of the image, 1 MiB like hdiutil.
+const chunkSectors = 2048
+
+// CreateUDIF writes the raw disk image read from r to a new UDIF image at
+// dmgpath. See WriteUDIF.
+func CreateUDIF(dmgpath string, r io.Reader, opts ...WriterOption) error {
+	f, err := os.Create(dmgpath)
+	if err != nil {
+		return err
+	}
+	if err := WriteUDIF(f, r, opts...); err != nil {
+		f.Close()
+		os.Remove(dmgpath)
+		return err
+	}
+	return f.Close()
+}
+
+// WriteUDIF writes the raw disk image read from r as a compressed UDIF
+// image, which can be attached with hdiutil. The disk image is either a
+// whole disk with a partition map, or a single file system, such as an HFS+
+// volume built by other tools.
+//
+// The image is written as a single block table, split in 1 MiB chunks.
+// Chunks of zeros aren't stored. The data fork, the block table and the
+// image are checksummed with CRC32.
+func WriteUDIF(w io.Writer, r io.Reader, opts ...WriterOption) error {
+	uw := udifWriter{format: UDZO, level: 1}
+	for _, opt := range opts {
+		opt(&uw)
+	}
+	if uw.format != UDZO && uw.format != UDBZ {
+		return fmt.Errorf("dmgutils: unsupported image format %q", uw.format)
+	}
+	if uw.level < 1 || uw.level > 9 {
+		return fmt.Errorf("dmgutils: invalid compression level %d", uw.level)
+	}
+
+	fork := &countWriter{w: w, crc: crc32.NewIEEE()}
+	blockCRC := crc32.NewIEEE()
+	var (
+		chunks     []mishChunk
+		sector     uint64
+		compressed bytes.Buffer
+		buf        = make([]byte, chunkSectors*sectorSize)
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// the last chunk is padded to a whole sector.
+		padded := (n + sectorSize - 1) / sectorSize * sectorSize
+		zero(buf[n:padded])
+		data := buf[:padded]
+		if sector == 0 && uw.name == "" {
+			uw.name = partitionName(data)
+		}
+
+		blockCRC.Write(data)
+		c := mishChunk{
+			Type:             chunkZero,
+			SectorNumber:     sector,
+			SectorCount:      uint64(padded / sectorSize),
+			CompressedOffset: fork.n,
+		}
+		if !isZero(data) {
+			compressed.Reset()
+			if err := uw.compress(&compressed, data); err != nil {
+				return err
+			}
+			c.Type = uw.chunkType()
+			out := compressed.Bytes()
+			if len(out) >= len(data) {
+				c.Type, out = chunkRaw, data
+			}
+			if _, err := fork.Write(out); err != nil {
+				return err
+			}
+			c.CompressedLength = uint64(len(out))
+		}
+		chunks = append(chunks, c)
+		sector += c.SectorCount
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+	if sector == 0 {
+		return fmt.Errorf("dmgutils: empty disk image")
+	}
+	chunks = append(chunks, mishChunk{Type: chunkEnd, SectorNumber: sector})
+
+	h := mishHeader{
+		Version:       1,
+		SectorCount:   sector,
+		BuffersNeeded: chunkSectors + 8,
+		ChecksumType:  checksumCRC32,
+		ChecksumSize:  32,
+		ChunkCount:    uint32(len(chunks)),
+	}
+	copy(h.Signature[:], "mish")
+	binary.BigEndian.PutUint32(h.Checksum[:], blockCRC.Sum32())
+	var table bytes.Buffer
+	binary.Write(&table, binary.BigEndian, h)
+	binary.Write(&table, binary.BigEndian, chunks)
+
+	xml, err := plist.MarshalIndent(udifPlist{ResourceFork: map[string][]udifResource{
+		"blkx": {{
+			Attributes: "0x0050",
+			CFName:     uw.name,
+			Data:       table.Bytes(),
+			ID:         "0",
+			Name:       uw.name,
+		}},
+	}}, "\t")
+	if err != nil {
+		return fmt.Errorf("dmgutils: encode resource plist: %s", err)
+	}
+	if _, err := w.Write(xml); err != nil {
+		return err
+	}
+
+	k := koly{
+		Version:          4,
+		HeaderSize:       kolySize,
+		Flags:            1,
+		DataForkLength:   fork.n,
+		SegmentNumber:    1,
+		SegmentCount:     1,
+		DataChecksumType: checksumCRC32,
+		DataChecksumSize: 32,
+		XMLOffset:        fork.n,
+		XMLLength:        uint64(len(xml)),
+		ChecksumType:     checksumCRC32,
+		ChecksumSize:     32,
+		ImageVariant:     1,
+		SectorCount:      sector,
+	}
+	copy(k.Signature[:], "koly")
+	if _, err := rand.Read(k.SegmentID[:]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(k.DataChecksum[:], fork.crc.Sum32())
+	// the master checksum is the CRC32 of the checksums of the block tables.
+	binary.BigEndian.PutUint32(k.Checksum[:], crc32.ChecksumIEEE(h.Checksum[:4]))
+	return binary.Write(w, binary.BigEndian, k)
+}
+
+func (uw *udifWriter) chunkType() uint32 {
+	if uw.format == UDBZ {
+		return chunkBzip2
+	}
+	return chunkZlib
+}
+
+func (uw *udifWriter) compress(w io.Writer, data []byte) error {
+	var zw io.WriteCloser
+	var err error
+	switch uw.format {
+	case UDBZ:
+		zw, err = bzip2.NewWriter(w, &bzip2.WriterConfig{Level: uw.level})
+	default:
+		zw, err = zlib.NewWriterLevel(w, uw.level)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// partitionName names the block table of a disk image after its first
+// sectors.
+func partitionName(data []byte) string {
+	switch {
+	case len(data) >= 1026 && (string(data[1024:1026]) == "H+" || string(data[1024:1026]) == "HX"):
+		return "disk image (Apple_HFS : 0)"
+	case len(data) >= 36 && string(data[32:36]) == "NXSB":
+		return "disk image (Apple_APFS : 0)"
+	case len(data) >= 520 && string(data[512:520]) == "EFI PART":
+		return "whole disk (GUID_partition_scheme : 0)"
+	case len(data) >= 2 && string(data[:2]) == "ER":
+		return "whole disk (Apple_partition_scheme : 0)"
+	}
+	return "whole disk (unknown partition : 0)"
+}
+
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// countWriter counts and checksums the bytes written to w.
+type countWriter struct {
+	w   io.Writer
+	n   uint64
+	crc hash.Hash32
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += uint64(n)
+	cw.crc.Write(p[:n])
+	return n, err
+}
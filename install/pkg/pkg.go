@@ -5,7 +5,6 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
@@ -14,6 +13,9 @@ import (
 	"time"
 )
 
+// installerPath is the path to the macOS installer command.
+var installerPath = "/usr/sbin/installer"
+
 // Option customizes an installer command.
 type Option func(*installer)
 
@@ -25,6 +27,7 @@ type installer struct {
 	installerChoicesXMLPath  string
 	args                     []string
 	customEnv                []string
+	stagingDir               string
 
 	appliedOpts bool
 }
@@ -41,16 +44,25 @@ func (o *installer) apply(opts ...Option) error {
 		if err := o.choicesXML.write(); err != nil {
 			return err
 		}
+		o.args = append(o.args, "-applyChoiceChangesXML", o.choicesXML.path)
 	}
 	o.appliedOpts = true
 	return nil
 }
 
 func (o *installer) cleanup() error {
+	var err error
 	if o.choicesXML != nil && o.choicesXML.written {
-		return os.Remove(o.choicesXML.path)
+		o.choicesXML.written = false
+		err = os.Remove(o.choicesXML.path)
 	}
-	return nil
+	if o.stagingDir != "" {
+		if rmErr := os.RemoveAll(o.stagingDir); err == nil {
+			err = rmErr
+		}
+		o.stagingDir = ""
+	}
+	return err
 }
 
 type installerChoices struct {
@@ -59,16 +71,30 @@ type installerChoices struct {
 	path    string
 }
 
+// write saves the choices to a new temporary file which is only readable by the
+// current user. Every installer gets its own file, so concurrent installs can't
+// overwrite each other's choices.
 func (i *installerChoices) write() error {
 	if i.written {
 		return nil
 	}
-	if err := ioutil.WriteFile(i.path, i.xml, 0644); err != nil {
+	// CreateTemp opens the file with 0600 permissions.
+	f, err := os.CreateTemp("", "choices-*.xml")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(i.xml); err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return err
 	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	i.path = f.Name()
 	i.written = true
 	return nil
-
 }
 
 // AllowUntrusted allows installing packages with expired certificates.
@@ -80,13 +106,12 @@ func AllowUntrusted() Option {
 
 // ApplyChoiceChangesXML uses a ChoiceChangesXML file during the package installation.
 // See https://github.com/munki/munki/wiki/ChoiceChangesXML
+//
+// The xml is written to a private temporary file which is created for each
+// installation and removed once the installer returns.
 func ApplyChoiceChangesXML(xml []byte) Option {
 	return func(o *installer) {
-		o.choicesXML = &installerChoices{
-			xml:  xml,
-			path: filepath.Join(os.TempDir(), "choices.xml"),
-		}
-		o.args = append(o.args, "-applyChoiceChangesXML", o.choicesXML.path)
+		o.choicesXML = &installerChoices{xml: xml}
 	}
 }
 
@@ -101,6 +126,9 @@ func WithContext(ctx context.Context) Option {
 // SuppressBundleRelocation attempts to remove any info in the package that would
 // cause bundle relocation behavior. This makes bundles install or update in their
 // default location.
+//
+// The package is copied to a temporary directory and the copy is installed
+// instead, leaving the original package untouched.
 func SuppressBundleRelocation() Option {
 	return func(o *installer) {
 		o.suppressBundleRelocation = true
@@ -121,15 +149,21 @@ func WithCustomEnv(env []string) Option {
 func Install(pkgpath string, opts ...Option) (restart bool, err error) {
 	o := new(installer)
 	o.ctx = context.Background()
+	defer o.cleanup()
 	if err := o.apply(opts...); err != nil {
 		return false, err
 	}
-	defer o.cleanup()
 
 	if o.suppressBundleRelocation {
-		if err := suppressBundleRelocation(pkgpath); err != nil {
+		o.stagingDir, err = os.MkdirTemp("", "mackit-pkg")
+		if err != nil {
+			return false, err
+		}
+		staged := filepath.Join(o.stagingDir, filepath.Base(pkgpath))
+		if err := CopyWithoutBundleRelocation(staged, pkgpath); err != nil {
 			return false, err
 		}
+		pkgpath = staged
 	}
 
 	restart, err = needsRestart(pkgpath, o.args...)
@@ -198,28 +232,26 @@ func getEnvironment(custom []string) ([]string, error) {
 }
 
 func installcmd(ctx context.Context, pkgpath string, extraArgs ...string) *exec.Cmd {
-	installer := "/usr/sbin/installer"
 	args := []string{"-verboseR", "-pkg", pkgpath, "-target", "/"}
 	args = append(args, extraArgs...)
-	return exec.CommandContext(ctx, installer, args...)
+	return exec.CommandContext(ctx, installerPath, args...)
 }
 
 // NeedsRestart checks if the pkg at path requires restart.
 func NeedsRestart(pkgpath string, opts ...Option) (bool, error) {
 	o := new(installer)
+	defer o.cleanup()
 	if err := o.apply(opts...); err != nil {
 		return false, err
 	}
-	defer o.cleanup()
 
 	return needsRestart(pkgpath, o.args...)
 }
 
 func needsRestart(pkgpath string, extraArgs ...string) (restart bool, err error) {
-	installer := "/usr/sbin/installer"
 	args := []string{"-query", "RestartAction", "-pkg", pkgpath}
 	args = append(args, extraArgs...)
-	cmd := exec.Command(installer, args...)
+	cmd := exec.Command(installerPath, args...)
 	out, err := cmd.Output()
 	if err != nil {
 		return false, err
@@ -254,7 +286,30 @@ func fromOutput(out []byte) restartAction {
 	}
 }
 
+// CopyWithoutBundleRelocation copies the package at src to dst, removing any
+// info that would cause bundle relocation from the copy. Both bundle and flat
+// packages are supported. The package at src is never modified.
+func CopyWithoutBundleRelocation(dst, src string) error {
+	if err := copyPath(dst, src); err != nil {
+		return err
+	}
+	if err := suppressBundleRelocation(dst); err != nil {
+		os.RemoveAll(dst)
+		return err
+	}
+	return nil
+}
+
+// suppressBundleRelocation modifies the package at pkgpath in place.
 func suppressBundleRelocation(pkgpath string) error {
+	fi, err := os.Stat(pkgpath)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return rmRelocateFromFlatPkg(pkgpath)
+	}
+
 	if err := rmTokenDefinitions(pkgpath); err != nil {
 		return err
 	}
@@ -0,0 +1,59 @@
+package pkg
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/groob/mackit/internal/bplist"
+	"github.com/groob/plist"
+)
+
+// EditBundleInfoPlist decodes the Contents/Info.plist file of a bundle package
+// and calls edit with its contents. The modified dictionary is written back in
+// the same format, XML or binary, as the original file.
+// Packages without an Info.plist are left untouched.
+func EditBundleInfoPlist(pkgpath string, edit func(info map[string]interface{}) error) error {
+	path := filepath.Join(pkgpath, "Contents/Info.plist")
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var info map[string]interface{}
+	if err := plist.Unmarshal(data, &info); err != nil {
+		return err
+	}
+	if err := edit(info); err != nil {
+		return err
+	}
+
+	if isBinaryPlist(data) {
+		data, err = bplist.Marshal(info)
+	} else {
+		data, err = plist.MarshalIndent(info, "\t")
+	}
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, fi.Mode())
+}
+
+func isBinaryPlist(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("bplist00"))
+}
+
+// if the pkg is a bundle, remove the IFPkgPathMappings key from the plist.
+func rmIFPkgPathMappingsFromPlist(pkgpath string) error {
+	return EditBundleInfoPlist(pkgpath, func(info map[string]interface{}) error {
+		delete(info, "IFPkgPathMappings")
+		return nil
+	})
+}
@@ -1,14 +1,26 @@
 package pkg
 
 import (
+	"bytes"
+	"compress/zlib"
 	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/groob/mackit/internal/bplist"
+	"github.com/groob/plist"
 )
 
 func Test_installcmd(t *testing.T) {
@@ -53,8 +65,15 @@ func TestOption(t *testing.T) {
 	}
 
 	choiceFile := i.args[len(i.args)-1]
-	if have, want := filepath.Base(choiceFile), "choices.xml"; have != want {
-		t.Errorf("have %s, want %s", have, want)
+	if base := filepath.Base(choiceFile); !strings.HasPrefix(base, "choices-") || !strings.HasSuffix(base, ".xml") {
+		t.Errorf("have %s, want choices-*.xml", base)
+	}
+	fi, err := os.Stat(choiceFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := fi.Mode().Perm(), os.FileMode(0600); have != want {
+		t.Errorf("have mode %v, want %v", have, want)
 	}
 
 	env, err := getEnvironment(i.customEnv)
@@ -83,6 +102,80 @@ func TestOption(t *testing.T) {
 	if err := i.cleanup(); err != nil {
 		t.Fatal(err)
 	}
+	if _, err := os.Stat(choiceFile); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", choiceFile, err)
+	}
+}
+
+func TestInstallConcurrentChoices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mackit-installer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fake installer which checks that the choices file it was given has the
+	// content the test expects and records the path it was called with.
+	log := filepath.Join(dir, "choices.log")
+	script := `#!/bin/sh
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-query) echo None; exit 0;;
+	-applyChoiceChangesXML) shift; choices="$1";;
+	esac
+	shift
+done
+sleep 0.1
+[ "$(cat "$choices")" = "$WANT_CHOICES" ] || exit 1
+echo "$choices" >> ` + log + `
+`
+	fake := filepath.Join(dir, "installer")
+	if err := ioutil.WriteFile(fake, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(path string) { installerPath = path }(installerPath)
+	installerPath = fake
+
+	var wg sync.WaitGroup
+	const n = 8
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			choices := fmt.Sprintf("choices-%d", i)
+			_, err := Install("/tmp/pkgpath",
+				ApplyChoiceChangesXML([]byte(choices)),
+				WithCustomEnv([]string{"WANT_CHOICES=" + choices}),
+			)
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	out, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, path := range strings.Fields(string(out)) {
+		if seen[path] {
+			t.Errorf("choices file %s used by more than one install", path)
+		}
+		seen[path] = true
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+	if have, want := len(seen), n; have != want {
+		t.Errorf("have %d installs, want %d", have, want)
+	}
 }
 
 func TestInstall(t *testing.T) {
@@ -147,3 +240,380 @@ func isRoot(t *testing.T) bool {
 	}
 	return u.Uid == "0"
 }
+
+func TestCopyWithoutBundleRelocationFlat(t *testing.T) {
+	packageInfo := `<?xml version="1.0" encoding="utf-8"?>
+<pkg-info format-version="2" identifier="test.pkg" version="1.2.3" install-location="/" auth="root">
+    <payload numberOfFiles="2" installKBytes="1"/>
+    <bundle path="./Applications/Foo.app" id="com.example.foo" CFBundleShortVersionString="1.2.3"/>
+    <relocate>
+        <bundle id="com.example.foo"/>
+    </relocate>
+</pkg-info>
+`
+	tests := []struct {
+		name  string
+		files map[string]string
+		infos []string
+	}{
+		{
+			name: "component",
+			files: map[string]string{
+				"PackageInfo": packageInfo,
+				"Payload":     "payload data",
+			},
+			infos: []string{"PackageInfo"},
+		},
+		{
+			name: "product archive",
+			files: map[string]string{
+				"Distribution":        "<installer-gui-script/>",
+				"foo.pkg/PackageInfo": packageInfo,
+				"foo.pkg/Payload":     "payload data",
+				"bar.pkg/PackageInfo": packageInfo,
+				"bar.pkg/Payload":     "other payload data",
+			},
+			infos: []string{"foo.pkg/PackageInfo", "bar.pkg/PackageInfo"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mackit-relocate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			src := filepath.Join(dir, "src.pkg")
+			original := buildXar(t, tt.files)
+			if err := ioutil.WriteFile(src, original, 0644); err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(dir, "dst.pkg")
+			if err := CopyWithoutBundleRelocation(dst, src); err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := ioutil.ReadFile(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, original) {
+				t.Error("source package was modified")
+			}
+
+			data, err = ioutil.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			have := readXarFiles(t, data)
+			for name, want := range tt.files {
+				if strings.HasSuffix(name, "PackageInfo") {
+					continue
+				}
+				if have[name] != want {
+					t.Errorf("%s: have %q, want %q", name, have[name], want)
+				}
+			}
+			for _, name := range tt.infos {
+				info := have[name]
+				if strings.Contains(info, "relocate") {
+					t.Errorf("%s: relocate not removed:\n%s", name, info)
+				}
+				if !strings.Contains(info, `<bundle path="./Applications/Foo.app"`) {
+					t.Errorf("%s: bundle element missing:\n%s", name, info)
+				}
+			}
+		})
+	}
+}
+
+func TestCopyWithoutBundleRelocationBundle(t *testing.T) {
+	info := map[string]interface{}{
+		"CFBundleIdentifier":   "com.example.foo.pkg",
+		"IFPkgFlagRelocatable": true,
+		"IFPkgPathMappings": map[string]interface{}{
+			"./Applications/Foo.app": "{com.example.foo}/Foo.app",
+		},
+	}
+	xmlInfo, err := plist.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binaryInfo, err := bplist.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		info   []byte
+		binary bool
+	}{
+		{name: "xml", info: xmlInfo},
+		{name: "binary", info: binaryInfo, binary: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mackit-relocate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			src := filepath.Join(dir, "src.pkg")
+			td := filepath.Join(src, "Contents/Resources/TokenDefinitions.plist")
+			if err := os.MkdirAll(filepath.Dir(td), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(td, []byte("tokens"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			infoPath := filepath.Join(src, "Contents/Info.plist")
+			if err := ioutil.WriteFile(infoPath, tt.info, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			dst := filepath.Join(dir, "dst.pkg")
+			if err := CopyWithoutBundleRelocation(dst, src); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(td); err != nil {
+				t.Errorf("expected TokenDefinitions.plist in source package: %s", err)
+			}
+			if _, err := os.Stat(filepath.Join(dst, "Contents/Resources/TokenDefinitions.plist")); !os.IsNotExist(err) {
+				t.Errorf("expected TokenDefinitions.plist to be removed from copy, got %v", err)
+			}
+			original, err := ioutil.ReadFile(infoPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(original, tt.info) {
+				t.Error("source Info.plist was modified")
+			}
+
+			data, err := ioutil.ReadFile(filepath.Join(dst, "Contents/Info.plist"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, want := isBinaryPlist(data), tt.binary; have != want {
+				t.Errorf("have binary plist %v, want %v", have, want)
+			}
+			var edited map[string]interface{}
+			if err := plist.Unmarshal(data, &edited); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := edited["IFPkgPathMappings"]; ok {
+				t.Error("IFPkgPathMappings not removed")
+			}
+			if have, want := edited["CFBundleIdentifier"], "com.example.foo.pkg"; have != want {
+				t.Errorf("have CFBundleIdentifier %v, want %s", have, want)
+			}
+			if have, want := edited["IFPkgFlagRelocatable"], true; have != want {
+				t.Errorf("have IFPkgFlagRelocatable %v, want %v", have, want)
+			}
+		})
+	}
+}
+
+func TestCopyWithoutBundleRelocationSymlink(t *testing.T) {
+	packageInfo := `<?xml version="1.0" encoding="utf-8"?>
+<pkg-info format-version="2" identifier="test.pkg" version="1.2.3" install-location="/" auth="root">
+    <relocate>
+        <bundle id="com.example.foo"/>
+    </relocate>
+</pkg-info>
+`
+	tests := []struct {
+		name   string
+		create func(t *testing.T, path string)
+	}{
+		{
+			name: "flat",
+			create: func(t *testing.T, path string) {
+				data := buildXar(t, map[string]string{"PackageInfo": packageInfo})
+				if err := ioutil.WriteFile(path, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "bundle",
+			create: func(t *testing.T, path string) {
+				td := filepath.Join(path, "Contents/Resources/TokenDefinitions.plist")
+				if err := os.MkdirAll(filepath.Dir(td), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(td, []byte("tokens"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mackit-relocate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			original := filepath.Join(dir, "original.pkg")
+			tt.create(t, original)
+			before := readTree(t, original)
+
+			src := filepath.Join(dir, "src.pkg")
+			if err := os.Symlink(original, src); err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(dir, "dst.pkg")
+			if err := CopyWithoutBundleRelocation(dst, src); err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Lstat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode()&os.ModeSymlink != 0 {
+				t.Error("copy is a symlink")
+			}
+			if !reflect.DeepEqual(readTree(t, original), before) {
+				t.Error("original package was modified")
+			}
+			if reflect.DeepEqual(readTree(t, dst), before) {
+				t.Error("copy was not modified")
+			}
+		})
+	}
+}
+
+// readTree returns the contents of the files at or below root by path.
+func readTree(t *testing.T, root string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// buildXar creates a xar archive with zlib compressed files.
+func buildXar(t *testing.T, files map[string]string) []byte {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var heap bytes.Buffer
+	heap.Write(make([]byte, sha1.Size))
+	var toc bytes.Buffer
+	toc.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<xar><toc><checksum style="sha1"><offset>0</offset><size>20</size></checksum>`)
+	id := 0
+	var dir string
+	for _, name := range names {
+		if d := filepath.Dir(name); d != dir {
+			if dir != "" && dir != "." {
+				toc.WriteString("</file>")
+			}
+			dir = d
+			if dir != "." {
+				id++
+				fmt.Fprintf(&toc, `<file id="%d"><name>%s</name><type>directory</type>`, id, dir)
+			}
+		}
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write([]byte(files[name]))
+		zw.Close()
+		id++
+		fmt.Fprintf(&toc, `<file id="%d"><name>%s</name><type>file</type><data>`+
+			`<length>%d</length><offset>%d</offset><size>%d</size>`+
+			`<encoding style="application/x-gzip"/>`+
+			`<archived-checksum style="sha1">%x</archived-checksum>`+
+			`<extracted-checksum style="sha1">%x</extracted-checksum></data></file>`,
+			id, filepath.Base(name), compressed.Len(), heap.Len(), len(files[name]),
+			sha1.Sum(compressed.Bytes()), sha1.Sum([]byte(files[name])))
+		heap.Write(compressed.Bytes())
+	}
+	if dir != "" && dir != "." {
+		toc.WriteString("</file>")
+	}
+	toc.WriteString("</toc></xar>")
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(toc.Bytes())
+	zw.Close()
+	sum := sha1.Sum(compressed.Bytes())
+	h := heap.Bytes()
+	copy(h, sum[:])
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, xarHeader{
+		Magic:            xarMagic,
+		HeaderSize:       28,
+		Version:          1,
+		TOCLenCompressed: uint64(compressed.Len()),
+		TOCLenRaw:        uint64(toc.Len()),
+		ChecksumAlg:      1,
+	})
+	buf.Write(compressed.Bytes())
+	buf.Write(h)
+	return buf.Bytes()
+}
+
+// readXarFiles extracts all the files of a xar archive, verifying checksums.
+func readXarFiles(t *testing.T, data []byte) map[string]string {
+	a, err := readXar(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := int(a.header.HeaderSize)
+	toc := data[start : start+int(a.header.TOCLenCompressed)]
+	heap := data[a.heapOffset:]
+	if sum := sha1.Sum(toc); !bytes.Equal(heap[:sha1.Size], sum[:]) {
+		t.Error("toc checksum mismatch")
+	}
+
+	files := make(map[string]string)
+	for _, f := range a.files() {
+		d := f.node.child("data")
+		if d == nil {
+			continue
+		}
+		offset, _ := d.childUint("offset")
+		length, _ := d.childUint("length")
+		archived := sha1.Sum(heap[offset : offset+length])
+		if have, want := hex.EncodeToString(archived[:]), d.childText("archived-checksum"); have != want {
+			t.Errorf("%s: archived checksum %s, want %s", f.path, have, want)
+		}
+		contents, err := a.readFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		extracted := sha1.Sum(contents)
+		if have, want := hex.EncodeToString(extracted[:]), d.childText("extracted-checksum"); have != want {
+			t.Errorf("%s: extracted checksum %s, want %s", f.path, have, want)
+		}
+		files[f.path] = string(contents)
+	}
+	return files
+}
@@ -0,0 +1,166 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// rmRelocateFromFlatPkg removes the relocate elements from every PackageInfo
+// file in a flat package. Both component packages and product archives, which
+// hold their component packages in *.pkg directories, are supported.
+func rmRelocateFromFlatPkg(pkgpath string) error {
+	f, err := os.Open(pkgpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !isXar(f) {
+		return fmt.Errorf("%s is not a flat package", pkgpath)
+	}
+	archive, err := readXar(f, fi.Size())
+	if err != nil {
+		return fmt.Errorf("read %s: %s", pkgpath, err)
+	}
+
+	var modified bool
+	for _, f := range archive.files() {
+		if !isPackageInfo(f.path) {
+			continue
+		}
+		info, err := archive.readFile(f)
+		if err != nil {
+			return err
+		}
+		stripped, ok, err := rmRelocate(info)
+		if err != nil {
+			return fmt.Errorf("%s: %s", f.path, err)
+		}
+		if !ok {
+			continue
+		}
+		if err := archive.replaceFile(f, stripped); err != nil {
+			return err
+		}
+		modified = true
+	}
+	if !modified {
+		return nil
+	}
+
+	// Write the new archive next to the package, and replace the package
+	// once it's complete.
+	tmp, err := ioutil.TempFile(filepath.Dir(pkgpath), ".relocate-*.pkg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	if err := archive.write(w); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), pkgpath)
+}
+
+// isPackageInfo returns true for the PackageInfo file of a component package,
+// or of a component package inside a product archive.
+func isPackageInfo(name string) bool {
+	dir, file := path.Split(name)
+	if file != "PackageInfo" {
+		return false
+	}
+	dir = strings.TrimSuffix(dir, "/")
+	return dir == "" || (!strings.Contains(dir, "/") && strings.HasSuffix(dir, ".pkg"))
+}
+
+// rmRelocate removes the relocate elements from a PackageInfo document,
+// reporting whether any were found.
+func rmRelocate(info []byte) ([]byte, bool, error) {
+	root, err := parseXML(bytes.NewReader(info))
+	if err != nil {
+		return nil, false, err
+	}
+	if root.removeChildren("relocate") == 0 {
+		return info, false, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	root.write(&buf)
+	return buf.Bytes(), true, nil
+}
+
+// copyPath copies a file or a directory tree from src to dst, keeping file
+// modes and symlinks. If src itself is a symlink, the file or directory it
+// points to is copied, so that dst never refers to the original.
+func copyPath(dst, src string) error {
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch mode := fi.Mode(); {
+		case mode.IsDir():
+			return os.MkdirAll(target, mode.Perm())
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(target, path, mode.Perm())
+		default:
+			return fmt.Errorf("copy %s: unsupported file type %s", path, mode.Type())
+		}
+	})
+}
+
+func copyFile(dst, src string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,506 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Flat packages are xar archives. The xar code below only implements what is
+// needed to rewrite single files of an existing archive, keeping the rest of
+// the table of contents as it was.
+
+const xarMagic = 0x78617221 // "xar!"
+
+type xarHeader struct {
+	Magic            uint32
+	HeaderSize       uint16
+	Version          uint16
+	TOCLenCompressed uint64
+	TOCLenRaw        uint64
+	ChecksumAlg      uint32
+}
+
+// xarArchive is a decoded xar archive. Only the header and the table of
+// contents are held in memory, the heap is read from r when needed.
+type xarArchive struct {
+	header xarHeader
+	// extra holds the header bytes following the fixed size header, such as
+	// the checksum name when ChecksumAlg is 3.
+	extra []byte
+	toc   *xmlNode
+
+	r          io.ReaderAt
+	heapOffset int64
+	heapSize   int64
+	// replaced holds the compressed contents of replaced files by their data
+	// element. They are written in place of the original data.
+	replaced map[*xmlNode][]byte
+}
+
+// xarFile is a file entry of the table of contents.
+type xarFile struct {
+	path string
+	node *xmlNode
+}
+
+// isXar reports whether r starts with the xar magic number.
+func isXar(r io.ReaderAt) bool {
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return false
+	}
+	return binary.BigEndian.Uint32(magic[:]) == xarMagic
+}
+
+// readXar reads the header and the table of contents of the xar archive of
+// size bytes in r.
+func readXar(r io.ReaderAt, size int64) (*xarArchive, error) {
+	a := xarArchive{r: r, replaced: make(map[*xmlNode][]byte)}
+	if err := binary.Read(io.NewSectionReader(r, 0, size), binary.BigEndian, &a.header); err != nil {
+		return nil, fmt.Errorf("read xar header: %s", err)
+	}
+	if a.header.Magic != xarMagic {
+		return nil, errors.New("not a xar archive")
+	}
+	hsize := uint64(a.header.HeaderSize)
+	if hsize < 28 || hsize+a.header.TOCLenCompressed > uint64(size) {
+		return nil, errors.New("xar archive is truncated")
+	}
+	a.extra = make([]byte, hsize-28)
+	if _, err := r.ReadAt(a.extra, 28); err != nil {
+		return nil, fmt.Errorf("read xar header: %s", err)
+	}
+
+	zr, err := zlib.NewReader(io.NewSectionReader(r, int64(hsize), int64(a.header.TOCLenCompressed)))
+	if err != nil {
+		return nil, fmt.Errorf("read xar toc: %s", err)
+	}
+	toc, err := parseXML(zr)
+	if err != nil {
+		return nil, fmt.Errorf("parse xar toc: %s", err)
+	}
+	if toc.Name != "xar" || toc.child("toc") == nil {
+		return nil, errors.New("xar toc is missing the toc element")
+	}
+	a.toc = toc
+	a.heapOffset = int64(hsize + a.header.TOCLenCompressed)
+	a.heapSize = size - a.heapOffset
+	return &a, nil
+}
+
+// files returns all the file entries of the archive, with their full path.
+func (a *xarArchive) files() []xarFile {
+	var files []xarFile
+	var walk func(n *xmlNode, dir string)
+	walk = func(n *xmlNode, dir string) {
+		for _, f := range n.children("file") {
+			path := f.childText("name")
+			if dir != "" {
+				path = dir + "/" + path
+			}
+			files = append(files, xarFile{path: path, node: f})
+			walk(f, path)
+		}
+	}
+	walk(a.toc.child("toc"), "")
+	return files
+}
+
+// section returns a reader of the heap data referenced by a data or ea
+// element.
+func (a *xarArchive) section(data *xmlNode) (*io.SectionReader, error) {
+	offset, err := data.childUint("offset")
+	if err != nil {
+		return nil, err
+	}
+	length, err := data.childUint("length")
+	if err != nil {
+		return nil, err
+	}
+	if offset > uint64(a.heapSize) || length > uint64(a.heapSize)-offset {
+		return nil, errors.New("xar: data is out of bounds")
+	}
+	return io.NewSectionReader(a.r, a.heapOffset+int64(offset), int64(length)), nil
+}
+
+// readFile returns the extracted contents of a file entry.
+func (a *xarArchive) readFile(f xarFile) ([]byte, error) {
+	data := f.node.child("data")
+	if data == nil {
+		return nil, fmt.Errorf("xar: %s has no data", f.path)
+	}
+	var raw io.Reader
+	if b, ok := a.replaced[data]; ok {
+		raw = bytes.NewReader(b)
+	} else {
+		section, err := a.section(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s of %s", err, f.path)
+		}
+		raw = section
+	}
+
+	var r io.Reader
+	switch style := data.child("encoding").attr("style"); style {
+	case "application/x-gzip":
+		zr, err := zlib.NewReader(raw)
+		if err != nil {
+			return nil, fmt.Errorf("xar: decompress %s: %s", f.path, err)
+		}
+		r = zr
+	case "application/x-bzip2":
+		r = bzip2.NewReader(raw)
+	case "application/octet-stream", "":
+		r = raw
+	default:
+		return nil, fmt.Errorf("xar: unsupported encoding %q for %s", style, f.path)
+	}
+	return ioutil.ReadAll(r)
+}
+
+// replaceFile replaces the contents of a file entry, compressing them with
+// zlib. The new contents are kept in memory, and are written in place of the
+// original data when the archive is written.
+func (a *xarArchive) replaceFile(f xarFile, contents []byte) error {
+	data := f.node.child("data")
+	if data == nil {
+		return fmt.Errorf("xar: %s has no data", f.path)
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(contents); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	a.replaced[data] = buf.Bytes()
+
+	data.setChildText("length", strconv.Itoa(buf.Len()))
+	data.setChildText("size", strconv.Itoa(len(contents)))
+	data.setChildAttr("encoding", "style", "application/x-gzip")
+	for _, name := range []string{"archived-checksum", "extracted-checksum", "unarchived-checksum"} {
+		sum := data.child(name)
+		if sum == nil {
+			continue
+		}
+		b := buf.Bytes()
+		if name != "archived-checksum" {
+			b = contents
+		}
+		h, err := newXarHash(sum.attr("style"))
+		if err != nil {
+			return err
+		}
+		h.Write(b)
+		sum.Text = hex.EncodeToString(h.Sum(nil))
+	}
+	return nil
+}
+
+// write writes the archive to w. The heap is compacted so that it only holds
+// the data referenced by the table of contents, and is copied from the
+// original archive piece by piece, so that large archives are never held in
+// memory. Signatures are dropped, as they no longer match the contents of the
+// archive.
+func (a *xarArchive) write(w io.Writer) error {
+	toc := a.toc.child("toc")
+	toc.removeChildren("signature")
+	toc.removeChildren("x-signature")
+
+	var heapLen int64
+	cksum := toc.child("checksum")
+	var h hash.Hash
+	if cksum != nil {
+		var err error
+		if h, err = newXarHash(cksum.attr("style")); err != nil {
+			return err
+		}
+		cksum.setChildText("offset", "0")
+		cksum.setChildText("size", strconv.Itoa(h.Size()))
+		heapLen = int64(h.Size())
+	}
+
+	// Lay out the new heap first, as the table of contents which holds the
+	// new offsets precedes it.
+	type span struct{ offset, length uint64 }
+	var pieces []io.Reader
+	moved := make(map[span]int64)
+	var relocate func(n *xmlNode) error
+	relocate = func(n *xmlNode) error {
+		for _, c := range n.Children {
+			if c.Name == "data" || c.Name == "ea" {
+				newOffset := heapLen
+				if b, ok := a.replaced[c]; ok {
+					pieces = append(pieces, bytes.NewReader(b))
+					heapLen += int64(len(b))
+				} else {
+					section, err := a.section(c)
+					if err != nil {
+						return err
+					}
+					offset, _ := c.childUint("offset")
+					s := span{offset, uint64(section.Size())}
+					if prev, ok := moved[s]; ok {
+						newOffset = prev
+					} else {
+						pieces = append(pieces, section)
+						heapLen += section.Size()
+						moved[s] = newOffset
+					}
+				}
+				c.setChildText("offset", strconv.FormatInt(newOffset, 10))
+			}
+			if err := relocate(c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := relocate(toc); err != nil {
+		return err
+	}
+
+	var raw bytes.Buffer
+	raw.WriteString(xml.Header)
+	a.toc.write(&raw)
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(raw.Bytes()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	header := a.header
+	header.TOCLenCompressed = uint64(compressed.Len())
+	header.TOCLenRaw = uint64(raw.Len())
+	if err := binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+	chunks := [][]byte{a.extra, compressed.Bytes()}
+	if h != nil {
+		h.Write(compressed.Bytes())
+		chunks = append(chunks, h.Sum(nil))
+	}
+	for _, b := range chunks {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	for _, r := range pieces {
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newXarHash(style string) (hash.Hash, error) {
+	switch strings.ToLower(style) {
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("xar: unsupported checksum style %q", style)
+	}
+}
+
+// xmlNode is a minimal XML element tree which keeps unknown elements and
+// attributes intact when an XML document is rewritten.
+type xmlNode struct {
+	Name     string
+	Attr     []xml.Attr
+	Text     string
+	Children []*xmlNode
+}
+
+func parseXML(r io.Reader) (*xmlNode, error) {
+	dec := xml.NewDecoder(r)
+	var stack []*xmlNode
+	var root *xmlNode
+	for {
+		// RawToken keeps namespace prefixes as they were written.
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &xmlNode{Name: xmlName(t.Name), Attr: t.Copy().Attr}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("unexpected end element %s", xmlName(t.Name))
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].Text += string(t)
+			}
+		}
+	}
+	if root == nil {
+		return nil, errors.New("empty xml document")
+	}
+	return root, nil
+}
+
+func (n *xmlNode) write(buf *bytes.Buffer) {
+	n.writeIndent(buf, 0)
+}
+
+func (n *xmlNode) writeIndent(buf *bytes.Buffer, depth int) {
+	indent := strings.Repeat(" ", depth)
+	buf.WriteString(indent + "<" + n.Name)
+	for _, a := range n.Attr {
+		buf.WriteString(" " + xmlName(a.Name) + `="`)
+		xml.EscapeText(buf, []byte(a.Value))
+		buf.WriteString(`"`)
+	}
+	text := strings.TrimSpace(n.Text)
+	switch {
+	case len(n.Children) == 0 && text == "":
+		buf.WriteString("/>\n")
+	case len(n.Children) == 0:
+		buf.WriteString(">")
+		xml.EscapeText(buf, []byte(text))
+		buf.WriteString("</" + n.Name + ">\n")
+	default:
+		buf.WriteString(">\n")
+		if text != "" {
+			buf.WriteString(indent + " ")
+			xml.EscapeText(buf, []byte(text))
+			buf.WriteString("\n")
+		}
+		for _, c := range n.Children {
+			c.writeIndent(buf, depth+1)
+		}
+		buf.WriteString(indent + "</" + n.Name + ">\n")
+	}
+}
+
+func xmlName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+func (n *xmlNode) attr(name string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) child(name string) *xmlNode {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func (n *xmlNode) children(name string) []*xmlNode {
+	var nodes []*xmlNode
+	for _, c := range n.Children {
+		if c.Name == name {
+			nodes = append(nodes, c)
+		}
+	}
+	return nodes
+}
+
+// removeChildren removes all the children with name, returning the number of
+// removed elements.
+func (n *xmlNode) removeChildren(name string) int {
+	kept := n.Children[:0]
+	for _, c := range n.Children {
+		if c.Name != name {
+			kept = append(kept, c)
+		}
+	}
+	removed := len(n.Children) - len(kept)
+	n.Children = kept
+	return removed
+}
+
+func (n *xmlNode) childText(name string) string {
+	c := n.child(name)
+	if c == nil {
+		return ""
+	}
+	return strings.TrimSpace(c.Text)
+}
+
+func (n *xmlNode) childUint(name string) (uint64, error) {
+	v, err := strconv.ParseUint(n.childText(name), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("xar: invalid %s in %s: %s", name, n.Name, err)
+	}
+	return v, nil
+}
+
+func (n *xmlNode) setChildText(name, text string) {
+	c := n.child(name)
+	if c == nil {
+		c = &xmlNode{Name: name}
+		n.Children = append(n.Children, c)
+	}
+	c.Text = text
+}
+
+func (n *xmlNode) setChildAttr(name, attr, value string) {
+	c := n.child(name)
+	if c == nil {
+		c = &xmlNode{Name: name}
+		n.Children = append(n.Children, c)
+	}
+	for i, a := range c.Attr {
+		if a.Name.Local == attr {
+			c.Attr[i].Value = value
+			return
+		}
+	}
+	c.Attr = append(c.Attr, xml.Attr{Name: xml.Name{Local: attr}, Value: value})
+}
@@ -0,0 +1,234 @@
+// Package bplist encodes values as binary property lists.
+//
+// github.com/groob/plist decodes both XML and binary property lists, but can
+// only encode XML. Some macOS files must be written in the binary format.
+package bplist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+	"unicode/utf16"
+
+	"github.com/groob/plist"
+)
+
+// Marshal returns the binary property list encoding of v.
+//
+// v is first encoded with github.com/groob/plist, so the same struct tags and
+// types are supported.
+func Marshal(v interface{}) ([]byte, error) {
+	data, err := plist.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if err := plist.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	e := new(encoder)
+	if _, err := e.add(value); err != nil {
+		return nil, err
+	}
+	return e.bytes(), nil
+}
+
+// appleEpoch is the reference date of binary plist dates.
+var appleEpoch = time.Date(2001, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type encoder struct {
+	// objects holds the encoded objects. Collections reference other objects
+	// by their index, which is fixed up once the number of objects is known.
+	objects []object
+}
+
+type object struct {
+	data []byte
+	// refs are the object references of an array or dictionary.
+	refs []int
+}
+
+func (e *encoder) add(v interface{}) (int, error) {
+	idx := len(e.objects)
+	e.objects = append(e.objects, object{})
+
+	var o object
+	switch v := v.(type) {
+	case nil:
+		return 0, fmt.Errorf("bplist: nil values are not supported")
+	case bool:
+		if v {
+			o.data = []byte{0x09}
+		} else {
+			o.data = []byte{0x08}
+		}
+	case int64:
+		o.data = encodeInt(v)
+	case uint64:
+		if v > math.MaxInt64 {
+			// unsigned values which don't fit 8 bytes are stored as 16 bytes.
+			o.data = make([]byte, 17)
+			o.data[0] = 0x14
+			binary.BigEndian.PutUint64(o.data[9:], v)
+		} else {
+			o.data = encodeInt(int64(v))
+		}
+	case float32:
+		o.data = make([]byte, 5)
+		o.data[0] = 0x22
+		binary.BigEndian.PutUint32(o.data[1:], math.Float32bits(v))
+	case float64:
+		o.data = make([]byte, 9)
+		o.data[0] = 0x23
+		binary.BigEndian.PutUint64(o.data[1:], math.Float64bits(v))
+	case time.Time:
+		o.data = make([]byte, 9)
+		o.data[0] = 0x33
+		secs := float64(v.Sub(appleEpoch)) / float64(time.Second)
+		binary.BigEndian.PutUint64(o.data[1:], math.Float64bits(secs))
+	case []byte:
+		o.data = append(encodeMarker(0x40, len(v)), v...)
+	case string:
+		o.data = encodeString(v)
+	case []interface{}:
+		o.data = encodeMarker(0xa0, len(v))
+		for _, item := range v {
+			ref, err := e.add(item)
+			if err != nil {
+				return 0, err
+			}
+			o.refs = append(o.refs, ref)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		o.data = encodeMarker(0xd0, len(v))
+		for _, k := range keys {
+			ref, err := e.add(k)
+			if err != nil {
+				return 0, err
+			}
+			o.refs = append(o.refs, ref)
+		}
+		for _, k := range keys {
+			ref, err := e.add(v[k])
+			if err != nil {
+				return 0, err
+			}
+			o.refs = append(o.refs, ref)
+		}
+	default:
+		return 0, fmt.Errorf("bplist: unsupported type %T", v)
+	}
+	e.objects[idx] = o
+	return idx, nil
+}
+
+func (e *encoder) bytes() []byte {
+	refSize := intSize(uint64(len(e.objects)))
+
+	var buf bytes.Buffer
+	buf.WriteString("bplist00")
+	offsets := make([]uint64, len(e.objects))
+	for i, o := range e.objects {
+		offsets[i] = uint64(buf.Len())
+		buf.Write(o.data)
+		for _, ref := range o.refs {
+			writeSized(&buf, uint64(ref), refSize)
+		}
+	}
+
+	tableOffset := uint64(buf.Len())
+	offsetSize := intSize(tableOffset)
+	for _, off := range offsets {
+		writeSized(&buf, off, offsetSize)
+	}
+
+	var trailer [32]byte
+	trailer[6] = byte(offsetSize)
+	trailer[7] = byte(refSize)
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(e.objects)))
+	binary.BigEndian.PutUint64(trailer[16:], 0) // the top object is always first.
+	binary.BigEndian.PutUint64(trailer[24:], tableOffset)
+	buf.Write(trailer[:])
+	return buf.Bytes()
+}
+
+func encodeInt(v int64) []byte {
+	if v < 0 {
+		// negative values are always stored as 8 bytes.
+		b := make([]byte, 9)
+		b[0] = 0x13
+		binary.BigEndian.PutUint64(b[1:], uint64(v))
+		return b
+	}
+	var buf bytes.Buffer
+	size := intSize(uint64(v))
+	buf.WriteByte(0x10 | byte(log2(size)))
+	writeSized(&buf, uint64(v), size)
+	return buf.Bytes()
+}
+
+// encodeMarker encodes the marker of a variable length object. Counts of 15 or
+// more follow the marker as an integer object.
+func encodeMarker(marker byte, count int) []byte {
+	if count < 15 {
+		return []byte{marker | byte(count)}
+	}
+	return append([]byte{marker | 0x0f}, encodeInt(int64(count))...)
+}
+
+func encodeString(s string) []byte {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return append(encodeMarker(0x50, len(s)), s...)
+	}
+	units := utf16.Encode([]rune(s))
+	b := encodeMarker(0x60, len(units))
+	for _, u := range units {
+		b = append(b, byte(u>>8), byte(u))
+	}
+	return b
+}
+
+// intSize returns the number of bytes needed to store v, as a power of 2.
+func intSize(v uint64) int {
+	switch {
+	case v <= math.MaxUint8:
+		return 1
+	case v <= math.MaxUint16:
+		return 2
+	case v <= math.MaxUint32:
+		return 4
+	default:
+		return 8
+	}
+}
+
+func log2(size int) int {
+	n := 0
+	for size > 1 {
+		size >>= 1
+		n++
+	}
+	return n
+}
+
+func writeSized(buf *bytes.Buffer, v uint64, size int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	buf.Write(b[8-size:])
+}
@@ -0,0 +1,67 @@
+package bplist
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/groob/plist"
+)
+
+func TestMarshal(t *testing.T) {
+	type nested struct {
+		Name string `plist:"name"`
+	}
+	type document struct {
+		String   string            `plist:"string"`
+		Unicode  string            `plist:"unicode"`
+		Long     string            `plist:"long"`
+		Int      int               `plist:"int"`
+		Negative int               `plist:"negative"`
+		Big      uint64            `plist:"big"`
+		Float    float64           `plist:"float"`
+		Bool     bool              `plist:"bool"`
+		Data     []byte            `plist:"data"`
+		Date     time.Time         `plist:"date"`
+		Array    []string          `plist:"array"`
+		Dict     map[string]string `plist:"dict"`
+		Nested   []nested          `plist:"nested"`
+	}
+	want := document{
+		String:   "hello",
+		Unicode:  "héllo wörld ☃",
+		Long:     strings.Repeat("a", 300),
+		Int:      70000,
+		Negative: -42,
+		Big:      1<<64 - 1,
+		Float:    3.25,
+		Bool:     true,
+		Data:     bytes.Repeat([]byte{0, 1, 2}, 10),
+		Date:     time.Date(2017, time.June, 1, 12, 30, 0, 0, time.UTC),
+		Array:    []string{"a", "b", "c"},
+		Dict:     map[string]string{"foo": "bar", "baz": "qux"},
+		Nested:   []nested{{Name: "one"}, {Name: "two"}},
+	}
+
+	data, err := Marshal(&want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("bplist00")) {
+		t.Fatalf("missing bplist header: %q", data[:8])
+	}
+
+	var have document
+	if err := plist.Unmarshal(data, &have); err != nil {
+		t.Fatal(err)
+	}
+	if !have.Date.Equal(want.Date) {
+		t.Errorf("have date %s, want %s", have.Date, want.Date)
+	}
+	have.Date, want.Date = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %+v,\nwant %+v", have, want)
+	}
+}
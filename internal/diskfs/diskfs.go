@@ -0,0 +1,334 @@
+// Package diskfs implements io/fs on top of the read-only file system readers
+// of dmgutils.
+//
+// A reader only needs to list directories and read files; diskfs resolves
+// paths, follows symlinks and implements the fs.File interfaces.
+// The resource fork of a file is available at file/..namedfork/rsrc, like on
+// macOS.
+package diskfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"time"
+)
+
+// Inode is a file, directory or symlink of a volume.
+type Inode struct {
+	ID      uint64
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+	// Sys is returned by the Sys method of the fs.FileInfo.
+	Sys interface{}
+	// Node is private to the volume, such as the record of the file.
+	Node interface{}
+}
+
+// Entry is a directory entry.
+type Entry struct {
+	Name string
+	Inode
+}
+
+// Fork selects the data or the resource fork of a file.
+type Fork int
+
+// Forks.
+const (
+	DataFork Fork = iota
+	ResourceFork
+)
+
+// Volume is implemented by the file system readers.
+type Volume interface {
+	// Root returns the root directory of the volume.
+	Root() (Inode, error)
+	// ReadDir returns the entries of a directory, sorted by name.
+	ReadDir(dir Inode) ([]Entry, error)
+	// Open returns the contents of a fork of a file, and its size. The data
+	// fork of a symlink holds its target.
+	Open(f Inode, fork Fork) (io.ReaderAt, int64, error)
+}
+
+// maxSymlinks is the maximum number of symlinks followed when resolving
+// a path.
+const maxSymlinks = 40
+
+const namedFork = "..namedfork/rsrc"
+
+var errSymlinkOutside = errors.New("symlink points outside of the file system")
+
+// FS implements fs.FS, fs.StatFS and fs.ReadDirFS for a volume. The ReadLink
+// and Lstat methods don't follow the symlink at the end of the path.
+type FS struct {
+	v Volume
+}
+
+// New returns the file system of a volume.
+func New(v Volume) *FS {
+	return &FS{v: v}
+}
+
+// Open opens the named file or directory, following symlinks.
+func (fsys *FS) Open(name string) (fs.File, error) {
+	inode, fork, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi := fileInfo{name: path.Base(name), Inode: inode}
+	if fork == DataFork && inode.Mode.IsDir() {
+		entries, err := fsys.v.ReadDir(inode)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &dir{fileInfo: fi, entries: entries}, nil
+	}
+	if fork == ResourceFork {
+		fi.name = "rsrc"
+	}
+	r, size, err := fsys.v.Open(inode, fork)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	fi.Inode.Size = size
+	return &file{fileInfo: fi, SectionReader: io.NewSectionReader(r, 0, size)}, nil
+}
+
+// Stat returns the file info of the named file, following symlinks.
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	return fsys.stat("stat", name, true)
+}
+
+// Lstat returns the file info of the named file, without following the
+// symlink at the end of the path.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	return fsys.stat("lstat", name, false)
+}
+
+func (fsys *FS) stat(op, name string, follow bool) (fs.FileInfo, error) {
+	inode, fork, err := fsys.lookup(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	fi := fileInfo{name: path.Base(name), Inode: inode}
+	if fork == ResourceFork {
+		_, size, err := fsys.v.Open(inode, fork)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		fi.Inode.Mode, fi.Inode.Size = inode.Mode.Perm(), size
+	}
+	return fi, nil
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	inode, fork, err := fsys.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if fork != DataFork || !inode.Mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	entries, err := fsys.v.ReadDir(inode)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return dirEntries(entries), nil
+}
+
+// ReadLink returns the target of the named symlink.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	inode, fork, err := fsys.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if fork != DataFork || inode.Mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errors.New("not a symlink")}
+	}
+	target, err := fsys.readLink(inode)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+func (fsys *FS) readLink(inode Inode) (string, error) {
+	r, size, err := fsys.v.Open(inode, DataFork)
+	if err != nil {
+		return "", err
+	}
+	if size > 4096 {
+		return "", errors.New("symlink target too long")
+	}
+	buf := make([]byte, size)
+	if _, err := r.ReadAt(buf, 0); err != nil && err != io.EOF {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// lookup resolves a path to an inode. Symlinks in the directories of the
+// path are always followed; a symlink at the end of the path is followed
+// when follow is true.
+func (fsys *FS) lookup(op, name string, follow bool) (Inode, Fork, error) {
+	if !fs.ValidPath(name) {
+		return Inode{}, DataFork, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	fork := DataFork
+	p := name
+	if p == namedFork || strings.HasSuffix(p, "/"+namedFork) {
+		fork = ResourceFork
+		p = strings.TrimSuffix(strings.TrimSuffix(p, namedFork), "/")
+		if p == "" {
+			p = "."
+		}
+		// the resource fork is the one of the file, not of a symlink.
+		follow = true
+	}
+
+	for links := 0; links <= maxSymlinks; links++ {
+		inode, next, err := fsys.walk(p, follow)
+		if err != nil {
+			return Inode{}, fork, &fs.PathError{Op: op, Path: name, Err: err}
+		}
+		if next == "" {
+			return inode, fork, nil
+		}
+		p = next
+	}
+	return Inode{}, fork, &fs.PathError{Op: op, Path: name, Err: errors.New("too many levels of symlinks")}
+}
+
+// walk resolves a path from the root of the volume. When it finds a symlink
+// to follow, it returns the path with the symlink replaced by its target.
+func (fsys *FS) walk(p string, follow bool) (Inode, string, error) {
+	inode, err := fsys.v.Root()
+	if err != nil || p == "." {
+		return inode, "", err
+	}
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if !inode.Mode.IsDir() {
+			return Inode{}, "", fs.ErrNotExist
+		}
+		entries, err := fsys.v.ReadDir(inode)
+		if err != nil {
+			return Inode{}, "", err
+		}
+		var found bool
+		for _, e := range entries {
+			if e.Name == part {
+				inode, found = e.Inode, true
+				break
+			}
+		}
+		if !found {
+			return Inode{}, "", fs.ErrNotExist
+		}
+
+		last := i == len(parts)-1
+		if inode.Mode&fs.ModeSymlink == 0 || (last && !follow) {
+			continue
+		}
+		target, err := fsys.readLink(inode)
+		if err != nil {
+			return Inode{}, "", err
+		}
+		if path.IsAbs(target) {
+			return Inode{}, "", errSymlinkOutside
+		}
+		next := path.Join(append([]string{path.Join(parts[:i]...), target}, parts[i+1:]...)...)
+		if next == ".." || strings.HasPrefix(next, "../") {
+			return Inode{}, "", errSymlinkOutside
+		}
+		return Inode{}, next, nil
+	}
+	return inode, "", nil
+}
+
+type fileInfo struct {
+	name string
+	Inode
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.Inode.Size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.Inode.Mode }
+func (fi fileInfo) ModTime() time.Time { return fi.Inode.ModTime }
+func (fi fileInfo) IsDir() bool        { return fi.Inode.Mode.IsDir() }
+func (fi fileInfo) Sys() interface{}   { return fi.Inode.Sys }
+
+func dirEntries(entries []Entry) []fs.DirEntry {
+	list := make([]fs.DirEntry, len(entries))
+	for i, e := range entries {
+		list[i] = fs.FileInfoToDirEntry(fileInfo{name: e.Name, Inode: e.Inode})
+	}
+	return list
+}
+
+type file struct {
+	fileInfo
+	*io.SectionReader
+}
+
+func (f *file) Stat() (fs.FileInfo, error) { return f.fileInfo, nil }
+func (f *file) Close() error               { return nil }
+
+type dir struct {
+	fileInfo
+	entries []Entry
+	offset  int
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) { return d.fileInfo, nil }
+func (d *dir) Close() error               { return nil }
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	d.offset += len(rest)
+	return dirEntries(rest), nil
+}
+
+// UnixMode converts the mode of a BSD inode to a fs.FileMode.
+func UnixMode(mode uint16) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & 0170000 {
+	case 0040000:
+		m |= fs.ModeDir
+	case 0120000:
+		m |= fs.ModeSymlink
+	case 0020000:
+		m |= fs.ModeDevice | fs.ModeCharDevice
+	case 0060000:
+		m |= fs.ModeDevice
+	case 0010000:
+		m |= fs.ModeNamedPipe
+	case 0140000:
+		m |= fs.ModeSocket
+	}
+	if mode&04000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,280 @@
+package latest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// Build is a macOS build number, such as 23A344.
+type Build struct {
+	// Major is the Darwin major version, 23 for macOS 14.
+	Major int
+	// Train is the letter of the release train, A for the first release of a
+	// major version, B for the next update, and so on.
+	Train byte
+	// Number is the build number within the train.
+	Number int
+	// Suffix is the letter which ends the build number of betas, Rapid
+	// Security Responses and rebuilds, such as the a of 17A405a. It is empty
+	// for most builds.
+	Suffix string
+}
+
+var buildRegexp = regexp.MustCompile(`^([1-9][0-9]{0,2})([A-Z])([1-9][0-9]{0,8})([a-z]?)$`)
+
+// Parse parses a build number, such as 23A344. It returns an error, and never
+// panics, if s isn't a valid build number.
+func Parse(s string) (Build, error) {
+	m := buildRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return Build{}, fmt.Errorf("latest: invalid build %q", s)
+	}
+	major, _ := strconv.Atoi(m[1])
+	number, _ := strconv.Atoi(m[3])
+	return Build{Major: major, Train: m[2][0], Number: number, Suffix: m[4]}, nil
+}
+
+// String returns the build number, such as 23A344.
+func (b Build) String() string {
+	if b == (Build{}) {
+		return ""
+	}
+	return fmt.Sprintf("%d%c%d%s", b.Major, b.Train, b.Number, b.Suffix)
+}
+
+// Compare returns -1 if b is older than other, 0 if they are the same build,
+// and +1 if b is newer.
+//
+// Builds are ordered by Darwin major version, then by train. Within a train:
+//
+//   - Since macOS 11, beta builds, such as 23A5276g, are older than all the
+//     other builds. Earlier betas aren't told apart from other builds.
+//   - Rapid Security Responses, such as 22E772610a, are newer than all the
+//     other builds, and ordered by number and letter.
+//   - Since macOS 11, hardware-specific forks, such as 23B2073 for the first
+//     M3 Macs, are ordered by their number without the fork, then by fork, so
+//     that 23B74 < 23B2077 < 23B81 < 23B2082. Only numbers of 2000 to 4999
+//     and 6000 to 9999 are forks: 1000 to 1999 are later security updates,
+//     such as 20G1427. Earlier releases used all the higher numbers for
+//     security updates, so their builds are ordered by number.
+//   - Builds with the same number are ordered by letter, so that a rebuild,
+//     such as 17A405a, is newer than the original build.
+func (b Build) Compare(other Build) int {
+	switch {
+	case b.Major != other.Major:
+		return compareInt(b.Major, other.Major)
+	case b.Train != other.Train:
+		return compareInt(int(b.Train), int(other.Train))
+	case b.rank() != other.rank():
+		return compareInt(b.rank(), other.rank())
+	case b.base() != other.base():
+		return compareInt(b.base(), other.base())
+	case b.Number != other.Number:
+		return compareInt(b.Number, other.Number)
+	case b.Suffix != other.Suffix:
+		if b.Suffix < other.Suffix {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// the order of the kinds of builds within a train.
+const (
+	rankBeta = iota
+	rankRelease
+	rankRSR
+)
+
+// forkMajor is the Darwin major version of macOS 11, the first release with
+// hardware-specific forks.
+const forkMajor = 20
+
+func (b Build) rank() int {
+	switch {
+	case b.Beta():
+		return rankBeta
+	case b.RapidSecurityResponse():
+		return rankRSR
+	}
+	return rankRelease
+}
+
+// Beta reports whether b is a beta build of macOS 11 or later, whose number
+// has four digits starting with 4 or 5 and ends with a letter, such as
+// 23A5276g or 20A4299v. Earlier releases also used these numbers for
+// security updates, such as 18G5033, so their betas aren't reported.
+func (b Build) Beta() bool {
+	if b.Major < forkMajor || b.Suffix == "" {
+		return false
+	}
+	return b.Number >= 4000 && b.Number < 6000
+}
+
+// RapidSecurityResponse reports whether b is a Rapid Security Response, whose
+// number has six digits or more and ends with the letter of the response,
+// such as 22E772610a for macOS 13.3.1 (a).
+func (b Build) RapidSecurityResponse() bool {
+	return b.Number >= 100000 && b.Suffix != ""
+}
+
+// Fork returns the hardware-specific fork of b, which is the thousands of its
+// number, such as 2 for 23B2073, or 0 for builds of the main branch. Only
+// builds since macOS 11 with a number of 2000 to 4999 or 6000 to 9999 are
+// forks: the builds from 1000 to 1999, such as 20G1427, are security updates.
+// Builds ending with a letter are never forks.
+func (b Build) Fork() int {
+	if b.Major < forkMajor || b.Suffix != "" || b.rank() != rankRelease {
+		return 0
+	}
+	if fork := b.Number / 1000; fork >= 2 && fork <= 9 && fork != 5 {
+		return fork
+	}
+	return 0
+}
+
+// base returns the number of b without its fork.
+func (b Build) base() int {
+	if b.Fork() != 0 {
+		return b.Number % 1000
+	}
+	return b.Number
+}
+
+// Less reports whether b is older than other.
+func (b Build) Less(other Build) bool { return b.Compare(other) < 0 }
+
+func compareInt(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// MarshalText encodes the build as its build number.
+func (b Build) MarshalText() ([]byte, error) {
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText decodes a build number. An empty string decodes to the zero
+// Build.
+func (b *Build) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*b = Build{}
+		return nil
+	}
+	parsed, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*b = parsed
+	return nil
+}
+
+// release is a major macOS release.
+type release struct {
+	name string
+	// the marketing major version, and for 10.x releases, the minor version.
+	major, minor int
+	// trains maps the trains of releases since macOS 11 to the version which
+	// first shipped with them. Trains which shipped several minor versions,
+	// such as the G train of macOS 13, which shipped 13.5 and 13.6, are left
+	// out.
+	trains map[byte]string
+}
+
+// releases maps the Darwin major versions to macOS releases.
+var releases = map[int]release{
+	5:  {"Puma", 10, 1, nil},
+	6:  {"Jaguar", 10, 2, nil},
+	7:  {"Panther", 10, 3, nil},
+	8:  {"Tiger", 10, 4, nil},
+	9:  {"Leopard", 10, 5, nil},
+	10: {"Snow Leopard", 10, 6, nil},
+	11: {"Lion", 10, 7, nil},
+	12: {"Mountain Lion", 10, 8, nil},
+	13: {"Mavericks", 10, 9, nil},
+	14: {"Yosemite", 10, 10, nil},
+	15: {"El Capitan", 10, 11, nil},
+	16: {"Sierra", 10, 12, nil},
+	17: {"High Sierra", 10, 13, nil},
+	18: {"Mojave", 10, 14, nil},
+	19: {"Catalina", 10, 15, nil},
+	20: {"Big Sur", 11, 0, map[byte]string{
+		'A': "11.0", 'B': "11.0.1", 'C': "11.1", 'D': "11.2", 'E': "11.3", 'F': "11.4",
+	}},
+	21: {"Monterey", 12, 0, map[byte]string{
+		'A': "12.0", 'C': "12.1", 'D': "12.2", 'E': "12.3", 'F': "12.4", 'H': "12.7.3",
+	}},
+	22: {"Ventura", 13, 0, map[byte]string{
+		'A': "13.0", 'C': "13.1", 'D': "13.2", 'E': "13.3", 'F': "13.4", 'H': "13.7",
+	}},
+	23: {"Sonoma", 14, 0, map[byte]string{
+		'A': "14.0", 'B': "14.1", 'C': "14.2", 'D': "14.3", 'E': "14.4", 'F': "14.5", 'G': "14.6", 'H': "14.7",
+	}},
+	24: {"Sequoia", 15, 0, map[byte]string{
+		'A': "15.0", 'B': "15.1", 'C': "15.2", 'D': "15.3", 'E': "15.4", 'F': "15.5",
+	}},
+	25: {"Tahoe", 26, 0, map[byte]string{
+		'A': "26.0", 'B': "26.1",
+	}},
+}
+
+// ProductName returns the name of the macOS release of the build, such as
+// Sonoma, or an empty string for unknown releases.
+func (b Build) ProductName() string {
+	return releases[b.Major].name
+}
+
+// MarketingVersion returns the macOS version which first shipped with the
+// train of the build, such as 14.0 for 23A344, or 10.12.6 for 16G29. Later
+// updates of a train, such as 14.6.1 (23G93), are reported as the first
+// version of the train, 14.6. It returns an empty string for unknown
+// releases, and for trains which shipped several minor versions, such as
+// 22G120, which may be 13.5 or 13.6.
+func (b Build) MarketingVersion() string {
+	rel, ok := releases[b.Major]
+	if !ok {
+		return ""
+	}
+	if rel.major != 10 {
+		return rel.trains[b.Train]
+	}
+	// Since 10.8, every train of a 10.x release shipped the next patch
+	// version. Earlier releases skipped trains, so only their first train
+	// is known.
+	switch train := int(b.Train - 'A'); {
+	case train == 0:
+		return fmt.Sprintf("10.%d", rel.minor)
+	case rel.minor >= 8:
+		return fmt.Sprintf("10.%d.%d", rel.minor, train)
+	default:
+		return ""
+	}
+}
+
+// Display returns the release, the marketing version and the build number,
+// such as "Sonoma 14.0 (23A344)" or "Sonoma 14.0 beta (23A5276g)". The
+// version is left out if it's unknown, such as "Ventura (22G120)", and
+// unknown releases only show the build number.
+func (b Build) Display() string {
+	name, version := b.ProductName(), b.MarketingVersion()
+	switch {
+	case name == "":
+		return b.String()
+	case version == "":
+		if b.Beta() {
+			return fmt.Sprintf("%s beta (%s)", name, b)
+		}
+		return fmt.Sprintf("%s (%s)", name, b)
+	}
+	if b.Beta() {
+		version += " beta"
+	}
+	return fmt.Sprintf("%s %s (%s)", name, version, b)
+}
@@ -0,0 +1,247 @@
+// Package installerapp reads the build and version of macOS installer apps,
+// such as Install macOS Sonoma.app, from their disk images, without attaching
+// them.
+package installerapp
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/groob/mackit/dmgutils"
+	"github.com/groob/mackit/latest"
+	"github.com/groob/plist"
+)
+
+// ErrNoInstallerMetadata is returned by ReadInstallerApp when the app has no
+// SharedSupport metadata, such as the stub installers which download the
+// rest of the installer when launched.
+var ErrNoInstallerMetadata = errors.New("installerapp: no installer metadata in app")
+
+// InstallerApp is a macOS installer app, such as Install macOS Sonoma.app.
+type InstallerApp struct {
+	Path string
+	// Name is the name of the bundle, such as Install macOS Sonoma.
+	Name string
+	// Build and Version are the build and the product version the app
+	// installs. Build is empty when the app doesn't list it.
+	Build   string
+	Version string
+}
+
+// AppError is an error reading an installer app.
+type AppError struct {
+	Path string
+	Err  error
+}
+
+func (e *AppError) Error() string {
+	return fmt.Sprintf("installerapp: read %s: %s", e.Path, e.Err)
+}
+
+func (e *AppError) Unwrap() error { return e.Err }
+
+// AppErrors is returned by InstallerApps when some apps can't be read. It
+// lists the skipped apps, in the order of their names.
+type AppErrors []*AppError
+
+func (e AppErrors) Error() string {
+	switch len(e) {
+	case 0:
+		return "installerapp: no errors"
+	case 1:
+		return e[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", e[0], len(e)-1)
+}
+
+// Unwrap returns the errors of the apps, for errors.Is and errors.As.
+func (e AppErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// mobileAssetPath is the path of the software update asset in
+// SharedSupport.dmg.
+const mobileAssetPath = "com_apple_MobileAsset_MacSoftwareUpdate/com_apple_MobileAsset_MacSoftwareUpdate.xml"
+
+// ReadInstallerApp reads the build and version of the macOS installer app at
+// path, without attaching its disk images. Errors reading the app are
+// returned as an *AppError.
+//
+// Since macOS 11, they are read from the software update asset in
+// Contents/SharedSupport/SharedSupport.dmg. Before, the version is read from
+// Contents/SharedSupport/InstallInfo.plist, and the build from the
+// SystemVersion.plist of Contents/SharedSupport/BaseSystem.dmg.
+func ReadInstallerApp(path string) (*InstallerApp, error) {
+	app, err := readInstallerApp(path)
+	if err != nil && err != ErrNoInstallerMetadata {
+		return nil, &AppError{Path: path, Err: err}
+	}
+	return app, err
+}
+
+func readInstallerApp(path string) (*InstallerApp, error) {
+	app := &InstallerApp{Path: path, Name: bundleName(path)}
+	sharedSupport := filepath.Join(path, "Contents/SharedSupport")
+
+	if dmgpath := filepath.Join(sharedSupport, "SharedSupport.dmg"); exists(dmgpath) {
+		err := readImage(dmgpath, func(fsys fs.FS) error {
+			var err error
+			app.Build, app.Version, err = readMobileAsset(fsys)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return app, nil
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(sharedSupport, "InstallInfo.plist"))
+	if os.IsNotExist(err) {
+		return nil, ErrNoInstallerMetadata
+	} else if err != nil {
+		return nil, err
+	}
+	var info struct {
+		SystemImageInfo struct {
+			Version string `plist:"version"`
+		} `plist:"System Image Info"`
+	}
+	if err := plist.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("decode InstallInfo.plist: %w", err)
+	}
+	app.Version = info.SystemImageInfo.Version
+
+	err = readImage(filepath.Join(sharedSupport, "BaseSystem.dmg"), func(fsys fs.FS) error {
+		v, err := latest.ReadSystemVersionFS(fsys)
+		if err != nil {
+			return err
+		}
+		app.Build = v.ProductBuildVersion
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return app, nil
+}
+
+// InstallerApps reads the macOS installer apps of dir, such as /Applications
+// or a cache of installers, and sorts them from the newest build to the
+// oldest. Apps without a valid build are listed last, and stub installers are
+// left out.
+//
+// Apps which can't be read, such as an app whose SharedSupport.dmg is still
+// downloading, are skipped. The other apps are returned along with an
+// AppErrors listing the skipped apps.
+func InstallerApps(dir string) ([]*InstallerApp, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var apps []*InstallerApp
+	var failed AppErrors
+	for _, fi := range infos {
+		name := fi.Name()
+		if !fi.IsDir() || !strings.HasPrefix(name, "Install ") || filepath.Ext(name) != ".app" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		app, err := readInstallerApp(path)
+		if err == ErrNoInstallerMetadata {
+			continue
+		} else if err != nil {
+			failed = append(failed, &AppError{Path: path, Err: err})
+			continue
+		}
+		apps = append(apps, app)
+	}
+	sortInstallerApps(apps)
+	if len(failed) > 0 {
+		return apps, failed
+	}
+	return apps, nil
+}
+
+func sortInstallerApps(apps []*InstallerApp) {
+	sort.SliceStable(apps, func(i, j int) bool {
+		bi, erri := latest.Parse(apps[i].Build)
+		bj, errj := latest.Parse(apps[j].Build)
+		if (erri == nil) != (errj == nil) {
+			return erri == nil
+		}
+		return bj.Less(bi)
+	})
+}
+
+// readImage calls fn with the file system of the disk image at dmgpath. The
+// checksum of the image isn't verified, as that would read the whole image,
+// which is many gigabytes for SharedSupport.dmg.
+func readImage(dmgpath string, fn func(fs.FS) error) error {
+	u, err := dmgutils.OpenUDIF(dmgpath, dmgutils.SkipChecksum())
+	if err != nil {
+		return err
+	}
+	defer u.Close()
+	fsys, err := u.FS()
+	if err != nil {
+		return err
+	}
+	return fn(fsys)
+}
+
+// readMobileAsset reads the build and version of the software update asset
+// of a SharedSupport.dmg.
+func readMobileAsset(fsys fs.FS) (build, version string, err error) {
+	data, err := fs.ReadFile(fsys, mobileAssetPath)
+	if err != nil {
+		return "", "", err
+	}
+	var asset struct {
+		Assets []struct {
+			Build     string `plist:"Build"`
+			OSVersion string `plist:"OSVersion"`
+		} `plist:"Assets"`
+	}
+	if err := plist.Unmarshal(data, &asset); err != nil {
+		return "", "", fmt.Errorf("decode %s: %w", filepath.Base(mobileAssetPath), err)
+	}
+	if len(asset.Assets) == 0 {
+		return "", "", fmt.Errorf("no asset in %s", filepath.Base(mobileAssetPath))
+	}
+	return asset.Assets[0].Build, asset.Assets[0].OSVersion, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// bundleName returns the display name of the bundle at path, or the name of
+// the bundle without its extension.
+func bundleName(path string) string {
+	var info struct {
+		DisplayName string `plist:"CFBundleDisplayName"`
+		Name        string `plist:"CFBundleName"`
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(path, "Contents/Info.plist")); err == nil {
+		if plist.Unmarshal(data, &info) == nil {
+			if info.DisplayName != "" {
+				return info.DisplayName
+			}
+			if info.Name != "" {
+				return info.Name
+			}
+		}
+	}
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
@@ -0,0 +1,347 @@
+package installerapp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"unicode/utf16"
+
+	"github.com/groob/mackit/dmgutils"
+)
+
+func Test_readMobileAsset(t *testing.T) {
+	fsys := fstest.MapFS{
+		mobileAssetPath: &fstest.MapFile{Data: []byte(testMobileAsset)},
+	}
+	build, version, err := readMobileAsset(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if build != "23A344" || version != "14.0" {
+		t.Errorf("have %s %s, want 23A344 14.0", build, version)
+	}
+
+	fsys[mobileAssetPath] = &fstest.MapFile{Data: []byte(`<plist><dict><key>Assets</key><array/></dict></plist>`)}
+	if _, _, err := readMobileAsset(fsys); err == nil {
+		t.Error("expected an error for an empty asset")
+	}
+	if _, _, err := readMobileAsset(fstest.MapFS{}); !os.IsNotExist(err) {
+		t.Errorf("have %v, want a not exist error", err)
+	}
+}
+
+const testMobileAsset = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>Assets</key>
+	<array>
+		<dict>
+			<key>Build</key>
+			<string>23A344</string>
+			<key>OSVersion</key>
+			<string>14.0</string>
+			<key>SupportedDeviceModels</key>
+			<array>
+				<string>J314cAP</string>
+			</array>
+		</dict>
+	</array>
+</dict>
+</plist>
+`
+
+const testSystemVersion = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>ProductBuildVersion</key>
+	<string>19H15</string>
+	<key>ProductName</key>
+	<string>Mac OS X</string>
+	<key>ProductVersion</key>
+	<string>10.15.7</string>
+</dict>
+</plist>
+`
+
+func TestReadInstallerApp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "installerapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	catalina := filepath.Join(dir, "Install macOS Catalina.app")
+	writeFile(t, filepath.Join(catalina, "Contents/Info.plist"), `<plist version="1.0"><dict>
+		<key>CFBundleDisplayName</key><string>Install macOS Catalina</string>
+	</dict></plist>`)
+	writeFile(t, filepath.Join(catalina, "Contents/SharedSupport/InstallInfo.plist"), `<plist version="1.0"><dict>
+		<key>System Image Info</key>
+		<dict>
+			<key>URL</key><string>InstallESD.dmg</string>
+			<key>id</key><string>com.apple.dmg.InstallESD</string>
+			<key>version</key><string>10.15.7</string>
+		</dict>
+	</dict></plist>`)
+	writeImage(t, filepath.Join(catalina, "Contents/SharedSupport/BaseSystem.dmg"), map[string]string{
+		"System/Library/CoreServices/SystemVersion.plist": testSystemVersion,
+	})
+
+	sonoma := filepath.Join(dir, "Install macOS Sonoma.app")
+	writeImage(t, filepath.Join(sonoma, "Contents/SharedSupport/SharedSupport.dmg"), map[string]string{
+		mobileAssetPath: testMobileAsset,
+	})
+
+	var tests = []struct {
+		path string
+		want *InstallerApp
+	}{
+		{catalina, &InstallerApp{Path: catalina, Name: "Install macOS Catalina", Build: "19H15", Version: "10.15.7"}},
+		{sonoma, &InstallerApp{Path: sonoma, Name: "Install macOS Sonoma", Build: "23A344", Version: "14.0"}},
+	}
+	for _, tt := range tests {
+		app, err := ReadInstallerApp(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(app, tt.want) {
+			t.Errorf("have %+v, want %+v", app, tt.want)
+		}
+	}
+
+	stub := filepath.Join(dir, "Install macOS Big Sur.app")
+	writeFile(t, filepath.Join(stub, "Contents/Info.plist"), `<plist version="1.0"><dict/></plist>`)
+	if _, err := ReadInstallerApp(stub); err != ErrNoInstallerMetadata {
+		t.Errorf("have %v, want %v", err, ErrNoInstallerMetadata)
+	}
+
+	broken := filepath.Join(dir, "Install macOS Ventura.app")
+	writeFile(t, filepath.Join(broken, "Contents/SharedSupport/SharedSupport.dmg"), "not a disk image")
+	var appErr *AppError
+	if _, err := ReadInstallerApp(broken); !errors.As(err, &appErr) || appErr.Path != broken {
+		t.Errorf("have %v, want an *AppError for %s", err, broken)
+	}
+
+	writeFile(t, filepath.Join(dir, "Install macOS Monterey.app/Contents/SharedSupport/InstallInfo.plist"), `<plist version="1.0"><dict/></plist>`)
+	writeFile(t, filepath.Join(dir, "Other.app/Contents/SharedSupport/InstallInfo.plist"), `<plist version="1.0"><dict/></plist>`)
+
+	// the broken app is skipped, and the other apps are still listed.
+	apps, err := InstallerApps(dir)
+	var failed AppErrors
+	if !errors.As(err, &failed) || len(failed) != 1 || failed[0].Path != broken {
+		t.Fatalf("have %v, want an AppErrors for %s", err, broken)
+	}
+	var names []string
+	for _, app := range apps {
+		names = append(names, app.Name)
+	}
+	if want := []string{"Install macOS Sonoma", "Install macOS Catalina", "Install macOS Monterey"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("have %q, want %q", names, want)
+	}
+
+	os.RemoveAll(broken)
+	if _, err := InstallerApps(dir); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_sortInstallerApps(t *testing.T) {
+	apps := []*InstallerApp{
+		{Name: "Install macOS Catalina"},
+		{Name: "Install macOS Ventura", Build: "22G120"},
+		{Name: "Install macOS Sonoma", Build: "23A344"},
+		{Name: "Install macOS Sonoma beta", Build: "23C5030f"},
+		{Name: "Install macOS Big Sur", Build: "20G165"},
+	}
+	sortInstallerApps(apps)
+	var have []string
+	for _, app := range apps {
+		have = append(have, app.Name)
+	}
+	want := []string{
+		"Install macOS Sonoma beta",
+		"Install macOS Sonoma",
+		"Install macOS Ventura",
+		"Install macOS Big Sur",
+		"Install macOS Catalina",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestAppErrors(t *testing.T) {
+	errs := AppErrors{
+		{Path: "Install macOS Sonoma.app", Err: os.ErrNotExist},
+		{Path: "Install macOS Ventura.app", Err: errors.New("invalid image")},
+	}
+	if have, want := errs.Error(), "installerapp: read Install macOS Sonoma.app: file does not exist (and 1 more errors)"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if !errors.Is(errs, os.ErrNotExist) {
+		t.Error("expected AppErrors to wrap os.ErrNotExist")
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeImage writes a UDIF image at path holding an HFS+ volume with files.
+func writeImage(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := dmgutils.CreateUDIF(path, bytes.NewReader(buildVolume(files))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const testBlockSize = 4096
+
+// be encodes fixed size values in big endian.
+func be(values ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// buildVolume builds an HFS+ volume holding files, keyed by their slash
+// separated paths. Block 1 is an empty extents overflow file, blocks 2 and 3
+// are the catalog file, a header node and a single leaf node, and the data of
+// the files starts at block 4. The catalog has no thread records.
+func buildVolume(files map[string]string) []byte {
+	type record struct {
+		parent uint32
+		name   string
+		data   []byte
+	}
+	records := []record{{1, "Test", folderRecord(2)}}
+	folders := map[string]uint32{"": 2}
+	nextID := uint32(16)
+	var folder func(dir string) uint32
+	folder = func(dir string) uint32 {
+		if id, ok := folders[dir]; ok {
+			return id
+		}
+		parent := folder(parentDir(dir))
+		id := nextID
+		nextID++
+		folders[dir] = id
+		records = append(records, record{parent, filepath.Base(dir), folderRecord(id)})
+		return id
+	}
+
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var blocks [][]byte
+	for _, path := range paths {
+		data := []byte(files[path])
+		parent := folder(parentDir(path))
+		start := uint32(4 + len(blocks))
+		count := uint32((len(data) + testBlockSize - 1) / testBlockSize)
+		for i := 0; i < int(count); i++ {
+			block := make([]byte, testBlockSize)
+			copy(block, data[i*testBlockSize:])
+			blocks = append(blocks, block)
+		}
+		fork := be(uint64(len(data)), uint32(0), count, uint32(start), count, [7][2]uint32{})
+		records = append(records, record{parent, filepath.Base(path), fileRecord(nextID, fork)})
+		nextID++
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].parent != records[j].parent {
+			return records[i].parent < records[j].parent
+		}
+		return records[i].name < records[j].name
+	})
+	var leaf [][]byte
+	for _, r := range records {
+		u := utf16.Encode([]rune(r.name))
+		key := be(uint16(6+2*len(u)), r.parent, uint16(len(u)), u)
+		leaf = append(leaf, append(key, r.data...))
+	}
+
+	totalBlocks := 4 + len(blocks)
+	img := make([]byte, 0, totalBlocks*testBlockSize)
+	vh := be([2]byte{'H', '+'}, uint16(4), [7]uint32{}, uint32(len(paths)), uint32(len(folders)-1),
+		uint32(testBlockSize), uint32(totalBlocks))
+	vh = append(vh, make([]byte, 192-len(vh))...)
+	vh = append(vh, be(uint64(testBlockSize), uint32(0), uint32(1), uint32(1), uint32(1), [7][2]uint32{})...)
+	vh = append(vh, be(uint64(2*testBlockSize), uint32(0), uint32(2), uint32(2), uint32(2), [7][2]uint32{})...)
+	block0 := make([]byte, testBlockSize)
+	copy(block0[1024:], vh)
+	img = append(img, block0...)
+	img = append(img, headerNode(0, 1)...)
+	img = append(img, headerNode(1, 2)...)
+	img = append(img, buildNode(-1, 1, leaf)...)
+	for _, block := range blocks {
+		img = append(img, block...)
+	}
+	return img
+}
+
+func parentDir(path string) string {
+	if i := strings.LastIndex(path, "/"); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// buildNode builds a b-tree node holding the records.
+func buildNode(kind int8, height uint8, records [][]byte) []byte {
+	b := make([]byte, testBlockSize)
+	copy(b, be(uint32(0), uint32(0), kind, height, uint16(len(records))))
+	offset := 14
+	for i, rec := range records {
+		if offset+len(rec)+2*(len(records)+1) > len(b) {
+			panic(fmt.Sprintf("b-tree node overflow at record %d", i))
+		}
+		copy(b[offset:], rec)
+		binary.BigEndian.PutUint16(b[len(b)-2*(i+1):], uint16(offset))
+		offset += len(rec)
+	}
+	binary.BigEndian.PutUint16(b[len(b)-2*(len(records)+1):], uint16(offset))
+	return b
+}
+
+func headerNode(root, totalNodes uint32) []byte {
+	header := be(uint16(1), root, uint32(0), root, root, uint16(testBlockSize), uint16(516),
+		totalNodes, uint32(0), uint16(0), uint32(0), uint8(0), uint8(0xcf), uint32(0x6), [16]uint32{})
+	return buildNode(1, 0, [][]byte{header, make([]byte, 128), make([]byte, 256)})
+}
+
+func folderRecord(id uint32) []byte {
+	rec := be(int16(1), uint16(0), uint32(0), id, [5]uint32{})
+	rec = append(rec, be(uint32(0), uint32(0), uint8(0), uint8(0), uint16(040755), uint32(0))...)
+	return append(rec, make([]byte, 40)...)
+}
+
+func fileRecord(id uint32, data []byte) []byte {
+	rec := be(int16(2), uint16(0), uint32(0), id, [5]uint32{})
+	rec = append(rec, be(uint32(0), uint32(0), uint8(0), uint8(0), uint16(0100644), uint32(0))...)
+	rec = append(rec, make([]byte, 40)...)
+	return append(append(rec, data...), make([]byte, 80)...)
+}
@@ -1,107 +1,89 @@
 package latest
 
 import (
-	"regexp"
 	"sort"
-	"strconv"
 )
 
-// Version returns the latest macOS build number given a list of them.
+// Version returns the latest macOS build number given a list of them. Invalid
+// build numbers are ignored.
 func Version(versions ...string) string {
-	if len(versions) == 0 {
+	v := Sorted(versions...)
+	if len(v) == 0 {
 		return ""
 	}
-
-	v := Sorted(versions...)
 	return v[0]
 }
 
-// Sorted sorts a list of macOS build numbers with the latest build number first.
-func Sorted(versions ...string) []string {
-	v := byVersion(versions)
-	sort.Sort(v)
-	return v
-}
-
-// ReverseSorted sorts a list of macOS build numbers from oldest to newest.
-func ReverseSorted(versions ...string) []string {
-	v := byVersion(versions)
-	sort.Sort(sort.Reverse(v))
-	return v
+// VersionStrict is like Version, but returns an error if a build number is
+// invalid.
+func VersionStrict(versions ...string) (string, error) {
+	v, err := SortedStrict(versions...)
+	if err != nil || len(v) == 0 {
+		return "", err
+	}
+	return v[0], nil
 }
 
-var r = regexp.MustCompile(`(?P<major>[\d]+)(?P<min>[A-Z])(?P<patch>[\d]+)(?P<fix>[a-z]?)`)
-
-type byVersion []string
-
-func (a byVersion) Len() int      { return len(a) }
-func (a byVersion) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a byVersion) Less(i, j int) bool {
-	return a[i] == version(a[i], a[j])
+// Sorted sorts a list of macOS build numbers with the latest build number first,
+// in the order of Build.Compare. Invalid build numbers are left out.
+func Sorted(versions ...string) []string {
+	v, _ := parseAll(versions, false)
+	sort.Stable(v)
+	return v.strings()
 }
 
-// return the newer of the two
-func version(a, b string) string {
-	if a == b {
-		return a
-	}
-
-	aa := r.FindStringSubmatch(a)
-	bb := r.FindStringSubmatch(b)
-
-	maa, err := strconv.Atoi(aa[1])
-	if err != nil {
-		panic(err)
-	}
-
-	mbb, err := strconv.Atoi(bb[1])
+// SortedStrict is like Sorted, but returns an error if a build number is
+// invalid.
+func SortedStrict(versions ...string) ([]string, error) {
+	v, err := parseAll(versions, true)
 	if err != nil {
-		panic(err)
-	}
-
-	major := maa > mbb
-	if major {
-		return a
-	} else if maa < mbb {
-		return b
+		return nil, err
 	}
+	sort.Stable(v)
+	return v.strings(), nil
+}
 
-	minor := aa[2] > bb[2]
-	if minor {
-		return a
-	} else if aa[2] < bb[2] {
-		return b
-	}
+// ReverseSorted sorts a list of macOS build numbers from oldest to newest.
+// Invalid build numbers are left out.
+func ReverseSorted(versions ...string) []string {
+	v, _ := parseAll(versions, false)
+	sort.Stable(sort.Reverse(v))
+	return v.strings()
+}
 
-	paa, err := strconv.Atoi(aa[3])
-	if err != nil {
-		panic(err)
-	}
+type version struct {
+	s     string
+	build Build
+}
 
-	pbb, err := strconv.Atoi(bb[3])
-	if err != nil {
-		panic(err)
+// parseAll parses the build numbers, skipping the invalid ones, or failing on
+// the first one if strict is set.
+func parseAll(versions []string, strict bool) (byVersion, error) {
+	v := make(byVersion, 0, len(versions))
+	for _, s := range versions {
+		b, err := Parse(s)
+		if err != nil {
+			if strict {
+				return nil, err
+			}
+			continue
+		}
+		v = append(v, version{s: s, build: b})
 	}
+	return v, nil
+}
 
-	patch := paa > pbb
-	if patch {
-		return a
-	} else if paa < pbb {
-		return b
-	}
+// byVersion sorts the newest build first.
+type byVersion []version
 
-	if len(aa) > len(bb) {
-		// is a re-build with `a-z` at the end.
-		return a
-	}
+func (a byVersion) Len() int           { return len(a) }
+func (a byVersion) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byVersion) Less(i, j int) bool { return a[j].build.Less(a[i].build) }
 
-	if len(aa) == len(bb) && len(aa) == 5 {
-		// both have a re-build letter, compare.
-		fixup := aa[4] > bb[4]
-		if fixup {
-			return a
-		}
+func (a byVersion) strings() []string {
+	s := make([]string, len(a))
+	for i, v := range a {
+		s[i] = v.s
 	}
-
-	return b
+	return s
 }
@@ -0,0 +1,533 @@
+package latest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Build
+		display string
+	}{
+		{"23A344", Build{23, 'A', 344, ""}, "Sonoma 14.0 (23A344)"},
+		{"23B74", Build{23, 'B', 74, ""}, "Sonoma 14.1 (23B74)"},
+		{"17A405a", Build{17, 'A', 405, "a"}, "High Sierra 10.13 (17A405a)"},
+		{"16G29", Build{16, 'G', 29, ""}, "Sierra 10.12.6 (16G29)"},
+		{"19H2", Build{19, 'H', 2, ""}, "Catalina 10.15.7 (19H2)"},
+		{"11G56", Build{11, 'G', 56, ""}, "Lion (11G56)"},
+		{"20B29", Build{20, 'B', 29, ""}, "Big Sur 11.0.1 (20B29)"},
+		{"20C69", Build{20, 'C', 69, ""}, "Big Sur 11.1 (20C69)"},
+		{"20G165", Build{20, 'G', 165, ""}, "Big Sur (20G165)"},
+		{"21C52", Build{21, 'C', 52, ""}, "Monterey 12.1 (21C52)"},
+		{"21G115", Build{21, 'G', 115, ""}, "Monterey (21G115)"},
+		{"22G120", Build{22, 'G', 120, ""}, "Ventura (22G120)"},
+		{"22H123", Build{22, 'H', 123, ""}, "Ventura 13.7 (22H123)"},
+		{"23G93", Build{23, 'G', 93, ""}, "Sonoma 14.6 (23G93)"},
+		{"24G84", Build{24, 'G', 84, ""}, "Sequoia (24G84)"},
+		{"25A354", Build{25, 'A', 354, ""}, "Tahoe 26.0 (25A354)"},
+		{"23A5276g", Build{23, 'A', 5276, "g"}, "Sonoma 14.0 beta (23A5276g)"},
+		{"99A1", Build{99, 'A', 1, ""}, "99A1"},
+	}
+	for _, tt := range tests {
+		have, err := Parse(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != tt.want {
+			t.Errorf("%s: have %+v, want %+v", tt.in, have, tt.want)
+		}
+		if have.String() != tt.in {
+			t.Errorf("have %s, want %s", have, tt.in)
+		}
+		if have.Display() != tt.display {
+			t.Errorf("have %q, want %q", have.Display(), tt.display)
+		}
+	}
+
+	for _, in := range []string{"", "23", "23a344", "A344", "23A", "23A344 ", "023A344", "23A0344"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestBuildCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"23A344", "23A344", 0},
+		{"16A323", "17A405", -1},
+		{"9A581", "16A323", -1},
+		{"17B48", "17A405", 1},
+		{"17A405", "17A42", 1},
+		{"17A405a", "17A405", 1},
+		{"17A405a", "17A405b", -1},
+		{"23A5276g", "23A344", -1},
+		{"23A5276g", "23A5257q", 1},
+		{"22E772610a", "22E261", 1},
+		{"22F770820b", "22F770820d", -1},
+		{"22F770820d", "22G74", -1},
+		{"23B2077", "23B81", -1},
+		{"23B2077", "23B74", 1},
+		{"23B2074", "23B74", 1},
+		{"20G1427", "20G817", 1},
+		{"20G1120", "20G918", 1},
+		{"20G1120", "20G165", 1},
+		{"21G1974", "21G920", 1},
+		{"17G2208", "17G65", 1},
+		{"17G3025", "17G2307", 1},
+		{"18G5033", "18G4032", 1},
+		{"18G6020", "18G5033", 1},
+		{"20A4299v", "20A5343i", -1},
+		{"20A5343i", "20A2411", -1},
+		{"20A4299v", "20A2411", -1},
+	}
+	for _, tt := range tests {
+		a, _ := Parse(tt.a)
+		b, _ := Parse(tt.b)
+		if have := a.Compare(b); have != tt.want {
+			t.Errorf("%s.Compare(%s): have %d, want %d", tt.a, tt.b, have, tt.want)
+		}
+		if have, want := b.Less(a), tt.want > 0; have != want {
+			t.Errorf("%s.Less(%s): have %v, want %v", tt.b, tt.a, have, want)
+		}
+	}
+
+	var builds []Build
+	for _, s := range []string{"17A405a", "16G29", "23A344", "17A405"} {
+		b, _ := Parse(s)
+		builds = append(builds, b)
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Less(builds[j]) })
+	var have []string
+	for _, b := range builds {
+		have = append(have, b.String())
+	}
+	if want := []string{"16G29", "17A405", "17A405a", "23A344"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+// realWorldBuilds are released builds, from oldest to newest.
+var realWorldBuilds = []string{
+	"17A405",     // 10.13
+	"17G65",      // 10.13.6
+	"17G2208",    // 10.13.6, 2018 MacBook Pro
+	"17G2307",    // 10.13.6 supplemental update
+	"17G3025",    // security update 2018-002
+	"17G14019",   // security update 2020-001
+	"18G4032",    // Mojave security update 2020-002
+	"18G5033",    // Mojave security update 2020-003
+	"18G6020",    // Mojave security update 2020-004
+	"20A4299v",   // 11.0 beta
+	"20A5343i",   // 11.0 beta
+	"20A2411",    // 11.0, M1 Macs
+	"20G165",     // 11.6
+	"20G817",     // Big Sur security update
+	"20G918",     // Big Sur security update
+	"20G1120",    // Big Sur security update
+	"20G1427",    // Big Sur security update
+	"21F79",      // 12.4
+	"21F2081",    // 12.4, M2 MacBook Pro
+	"21F2092",    // 12.4, M2 MacBook Air
+	"21G72",      // 12.5
+	"22E252",     // 13.3
+	"22E261",     // 13.3.1
+	"22E772610a", // 13.3.1 (a)
+	"22F66",      // 13.4
+	"22F82",      // 13.4.1
+	"22F770820b", // 13.4.1 (a)
+	"22F770820d", // 13.4.1 (c)
+	"22G74",      // 13.5
+	"23A5257q",   // 14.0 beta
+	"23A5276g",   // 14.0 beta
+	"23A339",     // 14.0 RC
+	"23A344",     // 14.0
+	"23B2073",    // 14.1, M3 Macs
+	"23B74",      // 14.1
+	"23B2077",    // 14.1, M3 Macs
+	"23B81",      // 14.1.1
+	"23B2082",    // 14.1.1, M3 Macs
+	"23B2091",    // 14.1.2, M3 Macs
+	"23B92",      // 14.1.2
+	"23C64",      // 14.2
+}
+
+func TestSortedRealWorld(t *testing.T) {
+	want := make([]string, len(realWorldBuilds))
+	for i, s := range realWorldBuilds {
+		want[len(want)-1-i] = s
+	}
+	// shuffle deterministically.
+	in := append([]string(nil), realWorldBuilds...)
+	for i := range in {
+		j := (i * 7) % len(in)
+		in[i], in[j] = in[j], in[i]
+	}
+	if have := Sorted(in...); !reflect.DeepEqual(have, want) {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have := ReverseSorted(in...); !reflect.DeepEqual(have, realWorldBuilds) {
+		t.Errorf("have %q, want %q", have, realWorldBuilds)
+	}
+}
+
+func TestBuildKind(t *testing.T) {
+	tests := []struct {
+		in   string
+		beta bool
+		rsr  bool
+		fork int
+	}{
+		{"23A344", false, false, 0},
+		{"17A405a", false, false, 0},
+		{"23A5276g", true, false, 0},
+		{"22G5027e", true, false, 0},
+		{"20A4299v", true, false, 0},
+		{"18G5033", false, false, 0},
+		{"22E772610a", false, true, 0},
+		{"22F770820d", false, true, 0},
+		{"23B2073", false, false, 2},
+		{"22A8380", false, false, 8},
+		{"17G2208", false, false, 0},
+		{"17G14019", false, false, 0},
+		{"20G1427", false, false, 0},
+		{"21F2081", false, false, 2},
+	}
+	for _, tt := range tests {
+		b, err := Parse(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := b.Beta(); have != tt.beta {
+			t.Errorf("%s.Beta(): have %v, want %v", tt.in, have, tt.beta)
+		}
+		if have := b.RapidSecurityResponse(); have != tt.rsr {
+			t.Errorf("%s.RapidSecurityResponse(): have %v, want %v", tt.in, have, tt.rsr)
+		}
+		if have := b.Fork(); have != tt.fork {
+			t.Errorf("%s.Fork(): have %d, want %d", tt.in, have, tt.fork)
+		}
+	}
+}
+
+func TestBuildJSON(t *testing.T) {
+	type report struct {
+		Build Build `json:"build"`
+	}
+	in := report{Build: Build{23, 'A', 344, ""}}
+	b, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(b), `{"build":"23A344"}`; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	var out report
+	if err := json.Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Errorf("have %+v, want %+v", out, in)
+	}
+	if err := json.Unmarshal([]byte(`{"build":"not a build"}`), &out); err == nil {
+		t.Error("expected an error for an invalid build")
+	}
+}
+
+func TestSorted(t *testing.T) {
+	tests := []struct {
+		in       []string
+		sorted   []string
+		reversed []string
+		latest   string
+	}{
+		{nil, []string{}, []string{}, ""},
+		{
+			in:       []string{"16A323", "17A405a", "15G31", "17A405"},
+			sorted:   []string{"17A405a", "17A405", "16A323", "15G31"},
+			reversed: []string{"15G31", "16A323", "17A405", "17A405a"},
+			latest:   "17A405a",
+		},
+		{
+			in:       []string{"17A42", "not a build", "", "17A405", "17"},
+			sorted:   []string{"17A405", "17A42"},
+			reversed: []string{"17A42", "17A405"},
+			latest:   "17A405",
+		},
+		{[]string{"Z", "9"}, []string{}, []string{}, ""},
+	}
+	for _, tt := range tests {
+		if have := Sorted(tt.in...); !reflect.DeepEqual(have, tt.sorted) {
+			t.Errorf("Sorted(%q): have %q, want %q", tt.in, have, tt.sorted)
+		}
+		if have := ReverseSorted(tt.in...); !reflect.DeepEqual(have, tt.reversed) {
+			t.Errorf("ReverseSorted(%q): have %q, want %q", tt.in, have, tt.reversed)
+		}
+		if have := Version(tt.in...); have != tt.latest {
+			t.Errorf("Version(%q): have %q, want %q", tt.in, have, tt.latest)
+		}
+	}
+}
+
+func TestSortedStrict(t *testing.T) {
+	have, err := SortedStrict("16A323", "17A405")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"17A405", "16A323"}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if _, err := SortedStrict("16A323", "16"); err == nil {
+		t.Error("expected an error for an invalid build")
+	}
+
+	latest, err := VersionStrict("16A323", "17A405")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != "17A405" {
+		t.Errorf("have %q, want %q", latest, "17A405")
+	}
+	if _, err := VersionStrict("17A405", "A17"); err == nil {
+		t.Error("expected an error for an invalid build")
+	}
+	if latest, err := VersionStrict(); latest != "" || err != nil {
+		t.Errorf("have %q, %v, want an empty version", latest, err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{"23A344", "17A405a", "16G29", "", "17", "99999999999A1", "1A99999999999"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		b, err := Parse(s)
+		if err != nil {
+			return
+		}
+		if b.String() != s {
+			t.Errorf("have %q, want %q", b.String(), s)
+		}
+		b.Display()
+	})
+}
+
+func FuzzSorted(f *testing.F) {
+	f.Add("16A323,17A405a,15G31,17A405")
+	f.Add("17A42,,not a build,17A405")
+	f.Fuzz(func(t *testing.T, s string) {
+		in := strings.Split(s, ",")
+		sorted := Sorted(in...)
+		for i := 1; i < len(sorted); i++ {
+			a, _ := Parse(sorted[i-1])
+			b, _ := Parse(sorted[i])
+			if a.Less(b) {
+				t.Errorf("%q sorted before %q", sorted[i-1], sorted[i])
+			}
+		}
+		if len(sorted) > 0 && Version(in...) != sorted[0] {
+			t.Errorf("have %q, want %q", Version(in...), sorted[0])
+		}
+		ReverseSorted(in...)
+		SortedStrict(in...)
+	})
+}
+
+func TestProductVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ProductVersion
+		str     string
+		release string
+		name    string
+	}{
+		{"10.15.7", ProductVersion{10, 15, 7, ""}, "10.15.7", "10.15", "Catalina"},
+		{"10.9", ProductVersion{10, 9, 0, ""}, "10.9", "10.9", "Mavericks"},
+		{"11.0.1", ProductVersion{11, 0, 1, ""}, "11.0.1", "11", "Big Sur"},
+		{"14", ProductVersion{14, 0, 0, ""}, "14.0", "14", "Sonoma"},
+		{"14.2.1", ProductVersion{14, 2, 1, ""}, "14.2.1", "14", "Sonoma"},
+		{"13.3.1 (a)", ProductVersion{13, 3, 1, "a"}, "13.3.1 (a)", "13", "Ventura"},
+		{"13.4.1(c)", ProductVersion{13, 4, 1, "c"}, "13.4.1 (c)", "13", "Ventura"},
+		{" 26.0 ", ProductVersion{26, 0, 0, ""}, "26.0", "26", "Tahoe"},
+		{"30.1", ProductVersion{30, 1, 0, ""}, "30.1", "30", ""},
+	}
+	for _, tt := range tests {
+		have, err := ParseProductVersion(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != tt.want {
+			t.Errorf("%s: have %+v, want %+v", tt.in, have, tt.want)
+		}
+		if have.String() != tt.str {
+			t.Errorf("have %q, want %q", have, tt.str)
+		}
+		if have.Release() != tt.release {
+			t.Errorf("%s: have release %q, want %q", tt.in, have.Release(), tt.release)
+		}
+		if have.ProductName() != tt.name {
+			t.Errorf("%s: have name %q, want %q", tt.in, have.ProductName(), tt.name)
+		}
+	}
+
+	for _, in := range []string{"", "0", "14.", ".14", "14.2.1.1", "14.2 beta", "14.2 (A)", "v14"} {
+		if _, err := ParseProductVersion(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestLatest(t *testing.T) {
+	in := []string{"10.15.7", "14.2", "13.3.1 (a)", "invalid", "14.2.1", "13.3.1", "10.9"}
+	if have, want := Latest(in...), "14.2.1"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	want := []string{"14.2.1", "14.2", "13.3.1 (a)", "13.3.1", "10.15.7", "10.9"}
+	if have := SortedProductVersions(in...); !reflect.DeepEqual(have, want) {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have := Latest("invalid"); have != "" {
+		t.Errorf("have %q, want an empty version", have)
+	}
+}
+
+func TestSatisfies(t *testing.T) {
+	tests := []struct {
+		version    string
+		constraint string
+		want       bool
+	}{
+		{"14.2.1", ">=13.6, <15", true},
+		{"13.6", ">=13.6, <15", true},
+		{"13.5.2", ">=13.6, <15", false},
+		{"15.0", ">=13.6, <15", false},
+		{"14.1.2", "< 14.2", true},
+		{"14.2", "< 14.2", false},
+		{"13.6.1", "≥ 13.6.1", true},
+		{"13.6", "≥ 13.6.1", false},
+		{"13.3.1 (a)", ">13.3.1", true},
+		{"13.3.1 (a)", "13.3.1 (a)", true},
+		{"14.2", "==14.2.0", true},
+		{"14.2", "!=14.2", false},
+		{"10.15.7", "<11", true},
+		{"10.15.7", "<=10.15", false},
+	}
+	for _, tt := range tests {
+		have, err := Satisfies(tt.version, tt.constraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != tt.want {
+			t.Errorf("Satisfies(%q, %q): have %v, want %v", tt.version, tt.constraint, have, tt.want)
+		}
+	}
+
+	for _, c := range []string{"", ">=", ">=13.6,", "~>13", ">=13.6, <<15"} {
+		if _, err := ParseConstraint(c); err == nil {
+			t.Errorf("%q: expected an error", c)
+		}
+	}
+	if _, err := Satisfies("invalid", ">=13"); err == nil {
+		t.Error("expected an error for an invalid version")
+	}
+
+	c, err := ParseConstraint("≥13.6,< 15 , 14.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := c.String(), ">=13.6, <15.0, =14.2"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+const testSystemVersion = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>BuildID</key>
+	<string>2D6B2A2C-4E1B-11EE-9E8B-3E8A7C2C0F2A</string>
+	<key>ProductBuildVersion</key>
+	<string>%s</string>
+	<key>ProductCopyright</key>
+	<string>1983-2023 Apple Inc.</string>
+	<key>ProductName</key>
+	<string>macOS</string>
+	<key>ProductUserVisibleVersion</key>
+	<string>%s</string>
+	<key>ProductVersion</key>
+	<string>%[2]s</string>
+	<key>ProductVersionExtra</key>
+	<string>%s</string>
+</dict>
+</plist>
+`
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadSystemVersion(t *testing.T) {
+	root, err := ioutil.TempDir("", "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	if _, err := ReadSystemVersion(root); !os.IsNotExist(err) {
+		t.Errorf("have %v, want a not exist error", err)
+	}
+
+	writeFile(t, filepath.Join(root, systemVersionPath), fmt.Sprintf(testSystemVersion, "22E261", "13.3.1", ""))
+	v, err := ReadSystemVersion(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.ProductName != "macOS" || v.ProductBuildVersion != "22E261" || v.ProductVersion != "13.3.1" {
+		t.Errorf("have %+v", v)
+	}
+	build, err := v.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := build.Display(), "Ventura 13.3 (22E261)"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+
+	// the cryptex has the version of the Rapid Security Response.
+	writeFile(t, filepath.Join(root, cryptexSystemVersionPath), fmt.Sprintf(testSystemVersion, "22E772610a", "13.3.1", "(a)"))
+	v, err = ReadSystemVersion(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build, err = v.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !build.RapidSecurityResponse() {
+		t.Errorf("%s: expected a Rapid Security Response", build)
+	}
+	version, err := v.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := version, (ProductVersion{13, 3, 1, "a"}); have != want {
+		t.Errorf("have %+v, want %+v", have, want)
+	}
+}
@@ -0,0 +1,256 @@
+package latest
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ProductVersion is a macOS product version, such as 10.15.7, 14.2.1 or
+// 13.3.1 (a).
+type ProductVersion struct {
+	// Major is 10 for Mac OS X and macOS 10.x, and the release number since
+	// macOS 11.
+	Major int
+	// Minor is the release number of 10.x versions, such as 15 for 10.15.7,
+	// and the update number since macOS 11, such as 2 for 14.2.1.
+	Minor int
+	// Patch is the number of the patch update, such as 1 for 14.2.1.
+	Patch int
+	// RSR is the letter of a Rapid Security Response, such as the a of
+	// 13.3.1 (a). It is empty for most versions.
+	RSR string
+}
+
+var productVersionRegexp = regexp.MustCompile(`^([1-9][0-9]{0,3})(?:\.([0-9]{1,4}))?(?:\.([0-9]{1,4}))?(?: ?\(([a-z])\))?$`)
+
+// ParseProductVersion parses a product version, such as 10.15.7, 14.2.1 or
+// 13.3.1 (a). A missing minor or patch number is 0.
+func ParseProductVersion(s string) (ProductVersion, error) {
+	m := productVersionRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return ProductVersion{}, fmt.Errorf("latest: invalid product version %q", s)
+	}
+	var v ProductVersion
+	v.Major, _ = strconv.Atoi(m[1])
+	if m[2] != "" {
+		v.Minor, _ = strconv.Atoi(m[2])
+	}
+	if m[3] != "" {
+		v.Patch, _ = strconv.Atoi(m[3])
+	}
+	v.RSR = m[4]
+	return v, nil
+}
+
+// String returns the product version, such as 14.2, 14.2.1 or 13.3.1 (a).
+// The patch number is left out when it's 0.
+func (v ProductVersion) String() string {
+	if v == (ProductVersion{}) {
+		return ""
+	}
+	s := fmt.Sprintf("%d.%d", v.Major, v.Minor)
+	if v.Patch != 0 {
+		s += fmt.Sprintf(".%d", v.Patch)
+	}
+	if v.RSR != "" {
+		s += fmt.Sprintf(" (%s)", v.RSR)
+	}
+	return s
+}
+
+// Release returns the major release of the version, which is 10.15 for
+// 10.15.7, and 14 for 14.2.1.
+func (v ProductVersion) Release() string {
+	if v.Major == 10 {
+		return fmt.Sprintf("10.%d", v.Minor)
+	}
+	return strconv.Itoa(v.Major)
+}
+
+// ProductName returns the name of the macOS release of the version, such as
+// Sonoma, or an empty string for unknown releases.
+func (v ProductVersion) ProductName() string {
+	for _, rel := range releases {
+		if rel.major == v.Major && (v.Major != 10 || rel.minor == v.Minor) {
+			return rel.name
+		}
+	}
+	return ""
+}
+
+// Compare returns -1 if v is older than other, 0 if they are the same
+// version, and +1 if v is newer. A Rapid Security Response is newer than the
+// version it applies to.
+func (v ProductVersion) Compare(other ProductVersion) int {
+	switch {
+	case v.Major != other.Major:
+		return compareInt(v.Major, other.Major)
+	case v.Minor != other.Minor:
+		return compareInt(v.Minor, other.Minor)
+	case v.Patch != other.Patch:
+		return compareInt(v.Patch, other.Patch)
+	case v.RSR != other.RSR:
+		if v.RSR < other.RSR {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// Less reports whether v is older than other.
+func (v ProductVersion) Less(other ProductVersion) bool { return v.Compare(other) < 0 }
+
+// MarshalText encodes the product version as a string.
+func (v ProductVersion) MarshalText() ([]byte, error) {
+	return []byte(v.String()), nil
+}
+
+// UnmarshalText decodes a product version. An empty string decodes to the
+// zero ProductVersion.
+func (v *ProductVersion) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*v = ProductVersion{}
+		return nil
+	}
+	parsed, err := ParseProductVersion(string(text))
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
+
+// Latest returns the latest product version given a list of them. Invalid
+// product versions are ignored.
+func Latest(versions ...string) string {
+	v := SortedProductVersions(versions...)
+	if len(v) == 0 {
+		return ""
+	}
+	return v[0]
+}
+
+// SortedProductVersions sorts a list of product versions with the latest
+// version first. Invalid product versions are left out.
+func SortedProductVersions(versions ...string) []string {
+	type product struct {
+		s string
+		v ProductVersion
+	}
+	var products []product
+	for _, s := range versions {
+		if v, err := ParseProductVersion(s); err == nil {
+			products = append(products, product{s, v})
+		}
+	}
+	sort.SliceStable(products, func(i, j int) bool { return products[j].v.Less(products[i].v) })
+	sorted := make([]string, len(products))
+	for i, p := range products {
+		sorted[i] = p.s
+	}
+	return sorted
+}
+
+// Constraint is a list of comparisons a product version must all satisfy,
+// such as ">=13.6, <15".
+type Constraint []Comparison
+
+// Comparison compares a product version with Version.
+type Comparison struct {
+	// Op is one of =, !=, <, <=, > and >=.
+	Op      string
+	Version ProductVersion
+}
+
+// ParseConstraint parses a comma separated list of comparisons, such as
+// ">=13.6, <15". The operators are =, !=, <, <=, > and >=, as well as == for
+// =, and ≤ and ≥. A version without an operator must be equal.
+func ParseConstraint(s string) (Constraint, error) {
+	var c Constraint
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		op := ""
+		for _, prefix := range []string{"==", "!=", "<=", ">=", "≤", "≥", "=", "<", ">"} {
+			if strings.HasPrefix(term, prefix) {
+				op = prefix
+				break
+			}
+		}
+		v, err := ParseProductVersion(strings.TrimPrefix(term, op))
+		if err != nil {
+			return nil, fmt.Errorf("latest: invalid constraint %q: %w", s, err)
+		}
+		switch op {
+		case "", "==":
+			op = "="
+		case "≤":
+			op = "<="
+		case "≥":
+			op = ">="
+		}
+		c = append(c, Comparison{Op: op, Version: v})
+	}
+	return c, nil
+}
+
+// Check reports whether v satisfies all the comparisons of c.
+func (c Constraint) Check(v ProductVersion) bool {
+	for _, cmp := range c {
+		if !cmp.Check(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the constraint, such as ">=13.6, <15.0".
+func (c Constraint) String() string {
+	terms := make([]string, len(c))
+	for i, cmp := range c {
+		terms[i] = cmp.String()
+	}
+	return strings.Join(terms, ", ")
+}
+
+// Check reports whether v satisfies the comparison.
+func (cmp Comparison) Check(v ProductVersion) bool {
+	n := v.Compare(cmp.Version)
+	switch cmp.Op {
+	case "=":
+		return n == 0
+	case "!=":
+		return n != 0
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	}
+	return false
+}
+
+// String returns the comparison, such as ">=13.6".
+func (cmp Comparison) String() string {
+	return cmp.Op + cmp.Version.String()
+}
+
+// Satisfies reports whether the product version satisfies the constraint,
+// such as Satisfies("14.2.1", ">=13.6, <15").
+func Satisfies(version, constraint string) (bool, error) {
+	v, err := ParseProductVersion(version)
+	if err != nil {
+		return false, err
+	}
+	c, err := ParseConstraint(constraint)
+	if err != nil {
+		return false, err
+	}
+	return c.Check(v), nil
+}
@@ -0,0 +1,66 @@
+package latest
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/groob/plist"
+)
+
+// SystemVersion is the version of a macOS system, read from its
+// SystemVersion.plist.
+type SystemVersion struct {
+	ProductName         string `plist:"ProductName"`
+	ProductVersion      string `plist:"ProductVersion"`
+	ProductBuildVersion string `plist:"ProductBuildVersion"`
+	// ProductVersionExtra is the letter of the Rapid Security Response
+	// applied to the system, such as (a).
+	ProductVersionExtra       string `plist:"ProductVersionExtra"`
+	ProductUserVisibleVersion string `plist:"ProductUserVisibleVersion"`
+	ProductCopyright          string `plist:"ProductCopyright"`
+}
+
+const (
+	systemVersionPath = "System/Library/CoreServices/SystemVersion.plist"
+	// the SystemVersion.plist of the cryptex which holds the Rapid Security
+	// Responses since macOS 13.
+	cryptexSystemVersionPath = "System/Cryptexes/OS/" + systemVersionPath
+)
+
+// ReadSystemVersion reads the SystemVersion.plist of the system at root, such
+// as / for the boot volume or the mount point of another volume. The version
+// of the OS cryptex, which includes the Rapid Security Response, is read
+// when the cryptex is mounted.
+func ReadSystemVersion(root string) (*SystemVersion, error) {
+	return ReadSystemVersionFS(os.DirFS(root))
+}
+
+// ReadSystemVersionFS is like ReadSystemVersion, but reads the system from
+// fsys, such as the file system of a disk image.
+func ReadSystemVersionFS(fsys fs.FS) (*SystemVersion, error) {
+	data, err := fs.ReadFile(fsys, cryptexSystemVersionPath)
+	if os.IsNotExist(err) {
+		data, err = fs.ReadFile(fsys, systemVersionPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v SystemVersion
+	if err := plist.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("latest: decode SystemVersion.plist: %w", err)
+	}
+	return &v, nil
+}
+
+// Build parses the build of the system.
+func (v *SystemVersion) Build() (Build, error) {
+	return Parse(v.ProductBuildVersion)
+}
+
+// Version parses the product version of the system, including the letter of
+// its Rapid Security Response.
+func (v *SystemVersion) Version() (ProductVersion, error) {
+	return ParseProductVersion(strings.TrimSpace(v.ProductVersion + " " + v.ProductVersionExtra))
+}
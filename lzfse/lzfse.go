@@ -0,0 +1,526 @@
+// Package lzfse implements a decoder for Apple's LZFSE compression format.
+//
+// LZFSE is used by ULFO disk images, and in many other places on macOS.
+// A stream is a sequence of blocks, each starting with a 4 byte magic:
+// uncompressed blocks, LZVN compressed blocks, LZFSE compressed blocks,
+// and a final end of stream block.
+// Based on the reference implementation at https://github.com/lzfse/lzfse
+package lzfse
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// ErrCorrupt is returned when the input is not a valid LZFSE stream.
+var ErrCorrupt = errors.New("lzfse: corrupt input")
+
+const (
+	endOfStreamMagic  = 0x24787662 // bvx$
+	uncompressedMagic = 0x2d787662 // bvx-
+	compressedV1Magic = 0x31787662 // bvx1
+	compressedV2Magic = 0x32787662 // bvx2
+	compressedLZVN    = 0x6e787662 // bvxn
+)
+
+const (
+	lSymbols       = 20
+	mSymbols       = 20
+	dSymbols       = 64
+	literalSymbols = 256
+
+	lStates       = 64
+	mStates       = 64
+	dStates       = 256
+	literalStates = 1024
+
+	matchesPerBlock  = 10000
+	literalsPerBlock = 4 * matchesPerBlock
+)
+
+var (
+	lExtraBits = [lSymbols]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 3, 5, 8,
+	}
+	lBaseValue = [lSymbols]int32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 20, 28, 60,
+	}
+	mExtraBits = [mSymbols]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 5, 8, 11,
+	}
+	mBaseValue = [mSymbols]int32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 24, 56, 312,
+	}
+	dExtraBits = [dSymbols]uint8{
+		0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3,
+		4, 4, 4, 4, 5, 5, 5, 5, 6, 6, 6, 6, 7, 7, 7, 7,
+		8, 8, 8, 8, 9, 9, 9, 9, 10, 10, 10, 10, 11, 11, 11, 11,
+		12, 12, 12, 12, 13, 13, 13, 13, 14, 14, 14, 14, 15, 15, 15, 15,
+	}
+	dBaseValue = [dSymbols]int32{
+		0, 1, 2, 3, 4, 6, 8, 10, 12, 16,
+		20, 24, 28, 36, 44, 52, 60, 76, 92, 108,
+		124, 156, 188, 220, 252, 316, 380, 444, 508, 636,
+		764, 892, 1020, 1276, 1532, 1788, 2044, 2556, 3068, 3580,
+		4092, 5116, 6140, 7164, 8188, 10236, 12284, 14332, 16380, 20476,
+		24572, 28668, 32764, 40956, 49148, 57340, 65532, 81916, 98300, 114684,
+		131068, 163836, 196604, 229372,
+	}
+)
+
+// Decode decompresses a complete LZFSE stream. sizeHint is used to size the
+// output buffer, and may be 0 when the decompressed size isn't known.
+func Decode(src []byte, sizeHint int) ([]byte, error) {
+	dst := make([]byte, 0, sizeHint)
+	for {
+		if len(src) < 4 {
+			return nil, ErrCorrupt
+		}
+		magic := binary.LittleEndian.Uint32(src)
+		var err error
+		switch magic {
+		case endOfStreamMagic:
+			return dst, nil
+		case uncompressedMagic:
+			if len(src) < 8 {
+				return nil, ErrCorrupt
+			}
+			n := binary.LittleEndian.Uint32(src[4:])
+			if uint64(len(src)-8) < uint64(n) {
+				return nil, ErrCorrupt
+			}
+			dst = append(dst, src[8:8+n]...)
+			src = src[8+n:]
+		case compressedLZVN:
+			if len(src) < 12 {
+				return nil, ErrCorrupt
+			}
+			rawBytes := binary.LittleEndian.Uint32(src[4:])
+			payloadBytes := binary.LittleEndian.Uint32(src[8:])
+			if uint64(len(src)-12) < uint64(payloadBytes) {
+				return nil, ErrCorrupt
+			}
+			dst, err = decodeLZVN(dst, src[12:12+payloadBytes], int(rawBytes))
+			if err != nil {
+				return nil, err
+			}
+			src = src[12+payloadBytes:]
+		case compressedV2Magic:
+			var n int
+			dst, n, err = decodeV2Block(dst, src)
+			if err != nil {
+				return nil, err
+			}
+			src = src[n:]
+		case compressedV1Magic:
+			return nil, fmt.Errorf("lzfse: unsupported v1 block")
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+}
+
+// blockHeader is the decoded header of an LZFSE compressed block.
+type blockHeader struct {
+	nRawBytes            uint32
+	nLiterals            uint32
+	nMatches             uint32
+	nLiteralPayloadBytes uint32
+	nLMDPayloadBytes     uint32
+	literalBits          int
+	literalState         [4]uint16
+	lmdBits              int
+	lState               uint16
+	mState               uint16
+	dState               uint16
+	lFreq                [lSymbols]uint16
+	mFreq                [mSymbols]uint16
+	dFreq                [dSymbols]uint16
+	literalFreq          [literalSymbols]uint16
+}
+
+func field(v uint64, offset, nbits uint) uint64 {
+	return (v >> offset) & (1<<nbits - 1)
+}
+
+// decodeV2Block decodes a bvx2 block, returning the number of bytes of src
+// which were consumed.
+func decodeV2Block(dst, src []byte) ([]byte, int, error) {
+	if len(src) < 32 {
+		return nil, 0, ErrCorrupt
+	}
+	var h blockHeader
+	h.nRawBytes = binary.LittleEndian.Uint32(src[4:])
+	v0 := binary.LittleEndian.Uint64(src[8:])
+	v1 := binary.LittleEndian.Uint64(src[16:])
+	v2 := binary.LittleEndian.Uint64(src[24:])
+
+	h.nLiterals = uint32(field(v0, 0, 20))
+	h.nLiteralPayloadBytes = uint32(field(v0, 20, 20))
+	h.nMatches = uint32(field(v0, 40, 20))
+	h.literalBits = int(field(v0, 60, 3)) - 7
+	h.literalState[0] = uint16(field(v1, 0, 10))
+	h.literalState[1] = uint16(field(v1, 10, 10))
+	h.literalState[2] = uint16(field(v1, 20, 10))
+	h.literalState[3] = uint16(field(v1, 30, 10))
+	h.nLMDPayloadBytes = uint32(field(v1, 40, 20))
+	h.lmdBits = int(field(v1, 60, 3)) - 7
+	headerSize := field(v2, 0, 32)
+	h.lState = uint16(field(v2, 32, 10))
+	h.mState = uint16(field(v2, 42, 10))
+	h.dState = uint16(field(v2, 52, 10))
+
+	if headerSize < 32 || headerSize > uint64(len(src)) {
+		return nil, 0, ErrCorrupt
+	}
+	if err := decodeFreqs(&h, src[32:headerSize]); err != nil {
+		return nil, 0, err
+	}
+
+	payloadEnd := headerSize + uint64(h.nLiteralPayloadBytes) + uint64(h.nLMDPayloadBytes)
+	if payloadEnd > uint64(len(src)) {
+		return nil, 0, ErrCorrupt
+	}
+	literalPayload := src[headerSize : headerSize+uint64(h.nLiteralPayloadBytes)]
+	lmdPayload := src[headerSize+uint64(h.nLiteralPayloadBytes) : payloadEnd]
+
+	dst, err := decodeCompressedBlock(dst, &h, literalPayload, lmdPayload)
+	if err != nil {
+		return nil, 0, err
+	}
+	return dst, int(payloadEnd), nil
+}
+
+// decodeFreqs decodes the variable length frequency tables of a v2 header.
+func decodeFreqs(h *blockHeader, src []byte) error {
+	freqs := make([]*uint16, 0, lSymbols+mSymbols+dSymbols+literalSymbols)
+	for i := range h.lFreq {
+		freqs = append(freqs, &h.lFreq[i])
+	}
+	for i := range h.mFreq {
+		freqs = append(freqs, &h.mFreq[i])
+	}
+	for i := range h.dFreq {
+		freqs = append(freqs, &h.dFreq[i])
+	}
+	for i := range h.literalFreq {
+		freqs = append(freqs, &h.literalFreq[i])
+	}
+	if len(src) == 0 {
+		// all the frequencies are zero.
+		return nil
+	}
+
+	var accum uint32
+	var accumBits uint
+	for _, freq := range freqs {
+		for len(src) > 0 && accumBits+8 <= 32 {
+			accum |= uint32(src[0]) << accumBits
+			accumBits += 8
+			src = src[1:]
+		}
+		value, nbits := decodeFreqValue(accum)
+		if nbits > accumBits {
+			return ErrCorrupt
+		}
+		*freq = value
+		accum >>= nbits
+		accumBits -= nbits
+	}
+	if accumBits >= 8 || len(src) != 0 {
+		return ErrCorrupt
+	}
+	return nil
+}
+
+var (
+	freqNBitsTable = [32]uint8{
+		2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+		2, 3, 2, 5, 2, 3, 2, 8, 2, 3, 2, 5, 2, 3, 2, 14,
+	}
+	freqValueTable = [32]int8{
+		0, 2, 1, 4, 0, 3, 1, -1, 0, 2, 1, 5, 0, 3, 1, -1,
+		0, 2, 1, 6, 0, 3, 1, -1, 0, 2, 1, 7, 0, 3, 1, -1,
+	}
+)
+
+func decodeFreqValue(bits uint32) (value uint16, nbits uint) {
+	b := bits & 31
+	n := freqNBitsTable[b]
+	switch n {
+	case 8:
+		return uint16(8 + (bits>>4)&0xf), 8
+	case 14:
+		return uint16(24 + (bits>>4)&0x3ff), 14
+	default:
+		return uint16(freqValueTable[b]), uint(n)
+	}
+}
+
+func decodeCompressedBlock(dst []byte, h *blockHeader, literalPayload, lmdPayload []byte) ([]byte, error) {
+	if h.nLiterals > literalsPerBlock || h.nMatches > matchesPerBlock {
+		return nil, ErrCorrupt
+	}
+
+	literalDecoder, err := newDecoderTable(literalStates, h.literalFreq[:])
+	if err != nil {
+		return nil, err
+	}
+	lDecoder, err := newValueDecoderTable(lStates, h.lFreq[:], lExtraBits[:], lBaseValue[:])
+	if err != nil {
+		return nil, err
+	}
+	mDecoder, err := newValueDecoderTable(mStates, h.mFreq[:], mExtraBits[:], mBaseValue[:])
+	if err != nil {
+		return nil, err
+	}
+	dDecoder, err := newValueDecoderTable(dStates, h.dFreq[:], dExtraBits[:], dBaseValue[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// the literals are interleaved between 4 states, and padded to a
+	// multiple of 4.
+	literals := make([]byte, (h.nLiterals+3)&^3)
+	in, err := newInStream(h.literalBits, literalPayload)
+	if err != nil {
+		return nil, err
+	}
+	states := h.literalState
+	for i := range states {
+		if int(states[i]) >= literalStates {
+			return nil, ErrCorrupt
+		}
+	}
+	for i := 0; i < len(literals); i += 4 {
+		if err := in.flush(); err != nil {
+			return nil, err
+		}
+		for j := 0; j < 4; j++ {
+			literals[i+j] = literalDecoder.decode(&states[j], in)
+		}
+	}
+
+	in, err = newInStream(h.lmdBits, lmdPayload)
+	if err != nil {
+		return nil, err
+	}
+	lState, mState, dState := h.lState, h.mState, h.dState
+	if lState >= lStates || mState >= mStates || dState >= dStates {
+		return nil, ErrCorrupt
+	}
+	start := len(dst)
+	var d int32 = -1
+	for i := uint32(0); i < h.nMatches; i++ {
+		if err := in.flush(); err != nil {
+			return nil, err
+		}
+		l := lDecoder.decode(&lState, in)
+		m := mDecoder.decode(&mState, in)
+		if newD := dDecoder.decode(&dState, in); newD != 0 {
+			d = newD
+		}
+		if int(l) > len(literals) {
+			return nil, ErrCorrupt
+		}
+		dst = append(dst, literals[:l]...)
+		literals = literals[l:]
+		if m > 0 {
+			if d <= 0 || int(d) > len(dst) {
+				return nil, ErrCorrupt
+			}
+			dst = copyMatch(dst, int(d), int(m))
+		}
+	}
+	if uint32(len(dst)-start) != h.nRawBytes {
+		return nil, ErrCorrupt
+	}
+	return dst, nil
+}
+
+// copyMatch appends m bytes starting d bytes back from the end of dst. The
+// source and destination may overlap, and matches can reach into the output
+// of previous blocks.
+func copyMatch(dst []byte, d, m int) []byte {
+	from := len(dst) - d
+	for i := 0; i < m; i++ {
+		dst = append(dst, dst[from+i])
+	}
+	return dst
+}
+
+// inStream reads bits backwards from the end of a buffer.
+type inStream struct {
+	buf   []byte
+	accum uint64
+	nbits uint
+	err   error
+}
+
+func newInStream(n int, buf []byte) (*inStream, error) {
+	s := &inStream{buf: buf}
+	if n < -7 || n > 0 {
+		return nil, ErrCorrupt
+	}
+	if n != 0 {
+		if len(s.buf) < 8 {
+			return nil, ErrCorrupt
+		}
+		s.accum = binary.LittleEndian.Uint64(s.buf[len(s.buf)-8:])
+		s.buf = s.buf[:len(s.buf)-8]
+		s.nbits = uint(n + 64)
+	} else {
+		if len(s.buf) < 7 {
+			return nil, ErrCorrupt
+		}
+		var b [8]byte
+		copy(b[:], s.buf[len(s.buf)-7:])
+		s.accum = binary.LittleEndian.Uint64(b[:])
+		s.buf = s.buf[:len(s.buf)-7]
+		s.nbits = 56
+	}
+	if s.nbits < 56 || s.nbits >= 64 || s.accum>>s.nbits != 0 {
+		return nil, ErrCorrupt
+	}
+	return s, nil
+}
+
+// flush refills the accumulator so that it holds at least 56 bits.
+func (s *inStream) flush() error {
+	if s.err != nil {
+		return s.err
+	}
+	nbytes := int((63 - s.nbits) / 8)
+	if nbytes > len(s.buf) {
+		return ErrCorrupt
+	}
+	var incoming uint64
+	for i := 0; i < nbytes; i++ {
+		incoming |= uint64(s.buf[len(s.buf)-nbytes+i]) << (8 * uint(i))
+	}
+	s.buf = s.buf[:len(s.buf)-nbytes]
+	nbits := uint(nbytes * 8)
+	if nbits > 0 {
+		s.accum = s.accum<<nbits | incoming
+	}
+	s.nbits += nbits
+	return nil
+}
+
+func (s *inStream) pull(n uint) uint64 {
+	if n > s.nbits {
+		// reading past the bits which were flushed; the data is corrupt.
+		s.err = ErrCorrupt
+		return 0
+	}
+	s.nbits -= n
+	result := s.accum >> s.nbits
+	s.accum &= 1<<s.nbits - 1
+	return result
+}
+
+type decoderEntry struct {
+	k      uint8
+	symbol uint8
+	delta  int16
+}
+
+type decoderTable []decoderEntry
+
+// newDecoderTable builds the FSE decoding table for the symbol frequencies.
+func newDecoderTable(nstates int, freq []uint16) (decoderTable, error) {
+	t := make(decoderTable, 0, nstates)
+	nClz := bits.LeadingZeros32(uint32(nstates))
+	sum := 0
+	for i, f := range freq {
+		if f == 0 {
+			continue
+		}
+		sum += int(f)
+		if sum > nstates {
+			return nil, ErrCorrupt
+		}
+		k := bits.LeadingZeros32(uint32(f)) - nClz
+		j0 := ((2 * nstates) >> uint(k)) - int(f)
+		for j := 0; j < int(f); j++ {
+			e := decoderEntry{symbol: uint8(i)}
+			if j < j0 {
+				e.k = uint8(k)
+				e.delta = int16(((int(f) + j) << uint(k)) - nstates)
+			} else {
+				e.k = uint8(k - 1)
+				e.delta = int16((j - j0) << uint(k-1))
+			}
+			t = append(t, e)
+		}
+	}
+	// pad the table so corrupt states never index past its end.
+	for len(t) < nstates {
+		t = append(t, decoderEntry{})
+	}
+	return t, nil
+}
+
+func (t decoderTable) decode(state *uint16, in *inStream) uint8 {
+	e := t[*state]
+	*state = uint16(int(e.delta) + int(in.pull(uint(e.k))))
+	if int(*state) >= len(t) {
+		in.err = ErrCorrupt
+		*state = 0
+	}
+	return e.symbol
+}
+
+type valueDecoderEntry struct {
+	totalBits uint8
+	valueBits uint8
+	delta     int16
+	vbase     int32
+}
+
+type valueDecoderTable []valueDecoderEntry
+
+func newValueDecoderTable(nstates int, freq []uint16, vbits []uint8, vbase []int32) (valueDecoderTable, error) {
+	t := make(valueDecoderTable, 0, nstates)
+	nClz := bits.LeadingZeros32(uint32(nstates))
+	sum := 0
+	for i, f := range freq {
+		if f == 0 {
+			continue
+		}
+		sum += int(f)
+		if sum > nstates {
+			return nil, ErrCorrupt
+		}
+		k := bits.LeadingZeros32(uint32(f)) - nClz
+		j0 := ((2 * nstates) >> uint(k)) - int(f)
+		for j := 0; j < int(f); j++ {
+			e := valueDecoderEntry{valueBits: vbits[i], vbase: vbase[i]}
+			if j < j0 {
+				e.totalBits = uint8(k) + e.valueBits
+				e.delta = int16(((int(f) + j) << uint(k)) - nstates)
+			} else {
+				e.totalBits = uint8(k-1) + e.valueBits
+				e.delta = int16((j - j0) << uint(k-1))
+			}
+			t = append(t, e)
+		}
+	}
+	for len(t) < nstates {
+		t = append(t, valueDecoderEntry{})
+	}
+	return t, nil
+}
+
+func (t valueDecoderTable) decode(state *uint16, in *inStream) int32 {
+	e := t[*state]
+	v := in.pull(uint(e.totalBits))
+	*state = uint16(int(e.delta) + int(v>>e.valueBits))
+	if int(*state) >= len(t) {
+		in.err = ErrCorrupt
+		*state = 0
+	}
+	return e.vbase + int32(v&(1<<e.valueBits-1))
+}
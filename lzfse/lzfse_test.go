@@ -0,0 +1,188 @@
+package lzfse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	var tests = []struct {
+		name string
+		src  []byte
+		want []byte
+	}{
+		{
+			name: "empty",
+			src:  []byte("bvx$"),
+			want: []byte{},
+		},
+		{
+			name: "uncompressed",
+			src:  cat(rawBlock([]byte("hello, ")), rawBlock([]byte("world")), []byte("bvx$")),
+			want: []byte("hello, world"),
+		},
+		{
+			name: "lzvn",
+			src:  cat(lzvnBlock(23, lzvnPayload), []byte("bvx$")),
+			want: []byte("ababababxyzyzqzqzqzqaba"),
+		},
+		{
+			name: "lzvn match into previous block",
+			src: cat(
+				rawBlock([]byte("abc")),
+				lzvnBlock(6, []byte{0x1f, 0x03, 0x00, 0x06, 0, 0, 0, 0, 0, 0, 0}),
+				[]byte("bvx$"),
+			),
+			want: []byte("abcabcabc"),
+		},
+		{
+			name: "lzfse",
+			src:  cat(v2Block(), []byte("bvx$")),
+			want: bytes.Repeat([]byte("a"), 14),
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.src, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCorrupt(t *testing.T) {
+	var tests = []struct {
+		name string
+		src  []byte
+	}{
+		{"no end of stream", rawBlock([]byte("abc"))},
+		{"bad magic", []byte("bvx?")},
+		{"truncated raw block", []byte("bvx-\x10\x00\x00\x00abc")},
+		{"lzvn wrong size", cat(lzvnBlock(22, lzvnPayload), []byte("bvx$"))},
+		{"lzvn distance before start", cat(lzvnBlock(6, []byte{0x1f, 0x04, 0x00, 0x06, 0, 0, 0, 0, 0, 0, 0}), []byte("bvx$"))},
+		{"lzvn undefined opcode", cat(lzvnBlock(0, []byte{0x70, 0x06}), []byte("bvx$"))},
+		{"lzfse truncated", v2Block()[:40]},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.src, 0); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+// lzvnPayload exercises every kind of LZVN instruction, ending with an eos
+// and its padding.
+var lzvnPayload = []byte{
+	0x98, 0x02, 'a', 'b', // sml_d L=2 M=6 D=2
+	0x0e,                // nop
+	0xe3, 'x', 'y', 'z', // sml_l L=3
+	0xf2,      // sml_m M=2
+	0x46, 'q', // pre_d L=1 M=3
+	0xa0, 0x10, 0x00, // med_d L=0 M=3 D=4
+	0x07, 0x14, 0x00, // lrg_d L=0 M=3 D=20
+	0x06, 0, 0, 0, 0, 0, 0, 0, // eos
+}
+
+func cat(b ...[]byte) []byte {
+	return bytes.Join(b, nil)
+}
+
+func rawBlock(data []byte) []byte {
+	b := []byte("bvx-")
+	b = append(b, le32(uint32(len(data)))...)
+	return append(b, data...)
+}
+
+func lzvnBlock(rawBytes int, payload []byte) []byte {
+	b := []byte("bvxn")
+	b = append(b, le32(uint32(rawBytes))...)
+	b = append(b, le32(uint32(len(payload)))...)
+	return append(b, payload...)
+}
+
+// v2Block builds a compressed block where every table has a single symbol,
+// so decoding consumes no bits from the payloads: 8 'a' literals and 2
+// matches of L=4, M=3, D=1.
+func v2Block() []byte {
+	var freqs []uint16
+	l := make([]uint16, lSymbols)
+	l[4] = lStates
+	m := make([]uint16, mSymbols)
+	m[3] = mStates
+	d := make([]uint16, dSymbols)
+	d[1] = dStates
+	lit := make([]uint16, literalSymbols)
+	lit['a'] = literalStates
+	freqs = append(append(append(append(freqs, l...), m...), d...), lit...)
+
+	// frequencies are packed LSB first; zero is the 2 bit code 00, and
+	// larger values use the 14 bit code xxxxxxxxxx1111.
+	var w bitWriter
+	for _, f := range freqs {
+		if f == 0 {
+			w.write(0, 2)
+			continue
+		}
+		w.write(uint64(f-24)<<4|0xf, 14)
+	}
+	table := w.bytes()
+
+	const nLiterals, nMatches, payload = 8, 2, 7
+	v0 := uint64(nLiterals) | uint64(payload)<<20 | uint64(nMatches)<<40 | uint64(7)<<60
+	v1 := uint64(payload)<<40 | uint64(7)<<60
+	v2 := uint64(32 + len(table))
+
+	b := []byte("bvx2")
+	b = append(b, le32(14)...)
+	b = append(b, le64(v0)...)
+	b = append(b, le64(v1)...)
+	b = append(b, le64(v2)...)
+	b = append(b, table...)
+	return append(b, make([]byte, 2*payload)...)
+}
+
+func le32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return b
+}
+
+func le64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return b
+}
+
+type bitWriter struct {
+	buf   []byte
+	accum uint64
+	nbits uint
+}
+
+func (w *bitWriter) write(v uint64, n uint) {
+	w.accum |= v << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.buf = append(w.buf, byte(w.accum))
+		w.accum >>= 8
+		w.nbits -= 8
+	}
+}
+
+func (w *bitWriter) bytes() []byte {
+	if w.nbits > 0 {
+		return append(w.buf, byte(w.accum))
+	}
+	return w.buf
+}
@@ -0,0 +1,101 @@
+package lzfse
+
+// LZVN is the fast LZ codec LZFSE uses for small blocks. Every instruction
+// starts with an opcode byte, which encodes a number of literal bytes L which
+// follow the instruction, and a match of M bytes at distance D, which is
+// copied after the literals:
+//
+//	sml_d  LLMMMDDD DDDDDDDD                  literals, match, new distance
+//	med_d  101LLMMM DDDDDDMM DDDDDDDD         literals, match, new distance
+//	lrg_d  LLMMM111 DDDDDDDD DDDDDDDD         literals, match, new distance
+//	pre_d  LLMMM110                           literals, match, previous distance
+//	sml_m  1111MMMM                           match, previous distance
+//	lrg_m  11110000 MMMMMMMM                  match, previous distance
+//	sml_l  1110LLLL                           literals
+//	lrg_l  11100000 LLLLLLLL                  literals
+//	nop    00001110, 00010110
+//	eos    00000110
+//
+// The remaining opcodes are undefined.
+
+// decodeLZVN appends the rawBytes bytes decoded from src to dst.
+func decodeLZVN(dst, src []byte, rawBytes int) ([]byte, error) {
+	start := len(dst)
+	var d int
+	for {
+		if len(src) == 0 {
+			return nil, ErrCorrupt
+		}
+		op := src[0]
+		var l, m, n int // literals, match length and instruction length
+		switch {
+		case op == 0x06: // eos
+			if len(dst)-start != rawBytes {
+				return nil, ErrCorrupt
+			}
+			return dst, nil
+		case op == 0x0e || op == 0x16: // nop
+			src = src[1:]
+			continue
+		case op&0xf0 == 0x70 || op&0xf0 == 0xd0:
+			return nil, ErrCorrupt
+		case op == 0xe0: // lrg_l
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			l, n = int(src[1])+16, 2
+		case op&0xf0 == 0xe0: // sml_l
+			l, n = int(op&0x0f), 1
+		case op == 0xf0: // lrg_m
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			m, n = int(src[1])+16, 2
+		case op&0xf0 == 0xf0: // sml_m
+			m, n = int(op&0x0f), 1
+		case op&0xe0 == 0xa0: // med_d
+			if len(src) < 3 {
+				return nil, ErrCorrupt
+			}
+			l = int(op>>3) & 3
+			m = (int(op&7)<<2 | int(src[1]&3)) + 3
+			d = int(src[2])<<6 | int(src[1]>>2)
+			n = 3
+		case op&7 == 6: // pre_d
+			if op>>6 == 0 {
+				// a pre_d with no literals is an sml_m.
+				return nil, ErrCorrupt
+			}
+			l, m, n = int(op>>6), int(op>>3&7)+3, 1
+		case op&7 == 7: // lrg_d
+			if len(src) < 3 {
+				return nil, ErrCorrupt
+			}
+			l, m = int(op>>6), int(op>>3&7)+3
+			d = int(src[1]) | int(src[2])<<8
+			n = 3
+		default: // sml_d
+			if len(src) < 2 {
+				return nil, ErrCorrupt
+			}
+			l, m = int(op>>6), int(op>>3&7)+3
+			d = int(op&7)<<8 | int(src[1])
+			n = 2
+		}
+
+		if len(src) < n+l {
+			return nil, ErrCorrupt
+		}
+		dst = append(dst, src[n:n+l]...)
+		src = src[n+l:]
+		if m > 0 {
+			if d <= 0 || d > len(dst) {
+				return nil, ErrCorrupt
+			}
+			dst = copyMatch(dst, d, m)
+		}
+		if len(dst)-start > rawBytes {
+			return nil, ErrCorrupt
+		}
+	}
+}
@@ -3,22 +3,98 @@
 package password
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/sha512"
+	"crypto/subtle"
 	"errors"
+	"fmt"
 	"math/big"
 
 	"golang.org/x/crypto/pbkdf2"
 )
 
-// macKeyLen is the length of a PBKDF2 salt.
+// macKeyLen is the length of the PBKDF2 key macOS derives from a password.
 const macKeyLen = 128
 
 // ErrNoMatch is returned by Verify if the password does not match.
 var ErrNoMatch = errors.New("password does not match")
 
-// SaltedSha512PBKDF2Dictionary is a SHA512 PBKDF2 dictionary.
+// Option customizes the hashes created by SaltedSHA512PBKDF2, SRPRFC5054 and
+// ShadowHashData.
+type Option func(*params)
+
+type params struct {
+	saltLen       int
+	minIterations int
+	maxIterations int
+	keyLen        int
+}
+
+func newParams(opts ...Option) (*params, error) {
+	p := &params{
+		saltLen:       32,
+		minIterations: 20000,
+		maxIterations: 40000,
+		keyLen:        macKeyLen,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	switch {
+	case p.saltLen < 16:
+		return nil, fmt.Errorf("password: salt length %d is shorter than 16 bytes", p.saltLen)
+	case p.minIterations < 1 || p.maxIterations < p.minIterations:
+		return nil, fmt.Errorf("password: invalid iteration range %d-%d", p.minIterations, p.maxIterations)
+	case p.keyLen < 32:
+		return nil, fmt.Errorf("password: key length %d is shorter than 32 bytes", p.keyLen)
+	}
+	return p, nil
+}
+
+// WithSaltLength sets the length of the random salt in bytes. The default is
+// 32 bytes, and the minimum is 16.
+func WithSaltLength(n int) Option {
+	return func(p *params) {
+		p.saltLen = n
+	}
+}
+
+// WithIterations sets a fixed number of PBKDF2 iterations.
+func WithIterations(n int) Option {
+	return WithIterationRange(n, n)
+}
+
+// WithIterationRange picks the number of PBKDF2 iterations at random between
+// min and max, inclusive, like macOS does. The default is 20,000 to 40,000.
+func WithIterationRange(min, max int) Option {
+	return func(p *params) {
+		p.minIterations, p.maxIterations = min, max
+	}
+}
+
+// WithKeyLength sets the length of the SALTED-SHA512-PBKDF2 entropy in bytes.
+// The default is 128 bytes, like macOS. The SRP verifier always uses a 128
+// byte key.
+func WithKeyLength(n int) Option {
+	return func(p *params) {
+		p.keyLen = n
+	}
+}
+
+// salt returns a random salt and number of iterations.
+func (p *params) salt() ([]byte, int, error) {
+	salt := make([]byte, p.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, 0, err
+	}
+	iterations, err := secureRandInt(p.minIterations, p.maxIterations)
+	if err != nil {
+		return nil, 0, err
+	}
+	return salt, iterations, nil
+}
+
+// SaltedSHA512PBKDF2Dictionary is a SHA512 PBKDF2 dictionary.
 type SaltedSHA512PBKDF2Dictionary struct {
 	Iterations int    `plist:"iterations"`
 	Salt       []byte `plist:"salt"`
@@ -26,15 +102,14 @@ type SaltedSHA512PBKDF2Dictionary struct {
 }
 
 // SaltedSHA512PBKDF2 creates a SALTED-SHA512-PBKDF2 dictionary
-// from a plaintext password. The hash function will use a 128 bit
-// salt.
-func SaltedSHA512PBKDF2(plaintext string) (SaltedSHA512PBKDF2Dictionary, error) {
-	salt := make([]byte, 32)
-	_, err := rand.Read(salt)
+// from a plaintext password. By default the hash function uses a 32 byte
+// salt, 20,000 to 40,000 iterations, and a 128 byte key.
+func SaltedSHA512PBKDF2(plaintext string, opts ...Option) (SaltedSHA512PBKDF2Dictionary, error) {
+	p, err := newParams(opts...)
 	if err != nil {
 		return SaltedSHA512PBKDF2Dictionary{}, err
 	}
-	iterations, err := secureRandInt(20000, 40000)
+	salt, iterations, err := p.salt()
 	if err != nil {
 		return SaltedSHA512PBKDF2Dictionary{}, err
 	}
@@ -42,33 +117,48 @@ func SaltedSHA512PBKDF2(plaintext string) (SaltedSHA512PBKDF2Dictionary, error)
 		Iterations: iterations,
 		Salt:       salt,
 		Entropy: pbkdf2.Key([]byte(plaintext),
-			salt, iterations, macKeyLen, sha512.New),
+			salt, iterations, p.keyLen, sha512.New),
 	}, nil
 }
 
 // Verify verifies a plaintext password against a existing SALTED-SHA512-PBKDF2
-// password dictionary.
+// password dictionary. The comparison takes constant time.
 func Verify(plaintext string, h SaltedSHA512PBKDF2Dictionary) error {
-	hashed := pbkdf2.Key([]byte(plaintext), h.Salt, h.Iterations, macKeyLen, sha512.New)
-	if !bytes.Equal(h.Entropy, hashed) {
+	if h.Iterations < 1 || len(h.Entropy) == 0 {
+		return errors.New("password: invalid SALTED-SHA512-PBKDF2 dictionary")
+	}
+	hashed := pbkdf2.Key([]byte(plaintext), h.Salt, h.Iterations, len(h.Entropy), sha512.New)
+	if subtle.ConstantTimeCompare(h.Entropy, hashed) != 1 {
 		return ErrNoMatch
 	}
 	return nil
 }
 
+// Policy is the minimum strength of a SALTED-SHA512-PBKDF2 dictionary.
+type Policy struct {
+	MinIterations int
+	MinSaltLength int
+	MinKeyLength  int
+}
+
+// NeedsRehash reports whether the dictionary is weaker than the policy, so
+// that the password should be hashed again the next time it's known, such
+// as after raising the minimum number of iterations.
+func NeedsRehash(h SaltedSHA512PBKDF2Dictionary, policy Policy) bool {
+	return h.Iterations < policy.MinIterations ||
+		len(h.Salt) < policy.MinSaltLength ||
+		len(h.Entropy) < policy.MinKeyLength
+}
+
 // CCCalibratePBKDF uses a pseudorandom value returned within 100 milliseconds.
-// Use a random int from crypto/rand between 20,000 and 40,000 instead.
-func secureRandInt(min, max int64) (int, error) {
-	var random int
-	for {
-		iter, err := rand.Int(rand.Reader, big.NewInt(max))
-		if err != nil {
-			return 0, err
-		}
-		if iter.Int64() >= min {
-			random = int(iter.Int64())
-			break
-		}
+// Use a random int from crypto/rand between min and max, inclusive, instead.
+func secureRandInt(min, max int) (int, error) {
+	if min > max {
+		return 0, fmt.Errorf("password: invalid range %d-%d", min, max)
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max-min)+1))
+	if err != nil {
+		return 0, err
 	}
-	return random, nil
+	return min + int(n.Int64()), nil
 }
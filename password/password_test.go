@@ -0,0 +1,333 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/hex"
+	"math/big"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestShadowHashData(t *testing.T) {
+	data, err := ShadowHashData("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("bplist00")) {
+		t.Fatalf("have %q, want a binary plist", data[:8])
+	}
+
+	d, err := ParseShadowHashData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := d.SaltedSHA512PBKDF2
+	if h == nil {
+		t.Fatal("missing SALTED-SHA512-PBKDF2 dictionary")
+	}
+	if len(h.Salt) != 32 || len(h.Entropy) != macKeyLen {
+		t.Errorf("have salt of %d bytes and entropy of %d bytes, want 32 and %d", len(h.Salt), len(h.Entropy), macKeyLen)
+	}
+	if h.Iterations < 20000 || h.Iterations > 40000 {
+		t.Errorf("have %d iterations, want between 20000 and 40000", h.Iterations)
+	}
+	if err := Verify("password", *h); err != nil {
+		t.Error(err)
+	}
+	if err := Verify("wrong", *h); err != ErrNoMatch {
+		t.Errorf("have %v, want %v", err, ErrNoMatch)
+	}
+	srp := d.SRP
+	if srp == nil {
+		t.Fatal("missing SRP-RFC5054-4096-SHA512-PBKDF2 dictionary")
+	}
+	if !bytes.Equal(srp.Verifier, srpVerifier("password", srp.Salt, srp.Iterations)) {
+		t.Error("SRP verifier doesn't match the password")
+	}
+
+	// as printed by dscl . -read /Users/name ShadowHashData.
+	var dscl strings.Builder
+	dscl.WriteString("dsAttrTypeNative:ShadowHashData:\n")
+	encoded := hex.EncodeToString(data)
+	for i := 0; i < len(encoded); i += 8 {
+		end := i + 8
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		if i%64 == 0 {
+			dscl.WriteString("\n")
+		}
+		dscl.WriteString(" " + encoded[i:end])
+	}
+	fromHex, err := ParseShadowHashData([]byte(dscl.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromHex, d) {
+		t.Errorf("have %+v, want %+v", fromHex, d)
+	}
+}
+
+func TestParseShadowHashData(t *testing.T) {
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0">
+<dict>
+	<key>SALTED-SHA512-PBKDF2</key>
+	<dict>
+		<key>entropy</key>
+		<data>AQID</data>
+		<key>iterations</key>
+		<integer>31337</integer>
+		<key>salt</key>
+		<data>BAUG</data>
+	</dict>
+	<key>SRP-RFC5054-4096-SHA512-PBKDF2</key>
+	<dict>
+		<key>iterations</key>
+		<integer>31338</integer>
+		<key>salt</key>
+		<data>BwgJ</data>
+		<key>verifier</key>
+		<data>CgsM</data>
+	</dict>
+	<key>KERBEROS</key>
+	<dict/>
+</dict>
+</plist>
+`
+	d, err := ParseShadowHashData([]byte(xml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ShadowHashDictionary{
+		SaltedSHA512PBKDF2: &SaltedSHA512PBKDF2Dictionary{Iterations: 31337, Salt: []byte{4, 5, 6}, Entropy: []byte{1, 2, 3}},
+		SRP:                &SRPDictionary{Iterations: 31338, Salt: []byte{7, 8, 9}, Verifier: []byte{10, 11, 12}},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("have %+v, want %+v", d, want)
+	}
+
+	data, err := d.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip, err := ParseShadowHashData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roundTrip, want) {
+		t.Errorf("have %+v, want %+v", roundTrip, want)
+	}
+
+	for _, data := range []string{
+		"",
+		"not hex",
+		`<plist version="1.0"><dict/></plist>`,
+		`<plist version="1.0"><array/></plist>`,
+	} {
+		if _, err := ParseShadowHashData([]byte(data)); err == nil {
+			t.Errorf("%q: expected an error", data)
+		}
+	}
+	if _, err := (ShadowHashDictionary{}).Marshal(); err == nil {
+		t.Error("expected an error for an empty dictionary")
+	}
+}
+
+func TestSRPVerifierRFC5054(t *testing.T) {
+	// the test vector of RFC 5054, appendix B, which uses the 1024-bit group
+	// and SHA-1.
+	group := newSRPGroup(""+
+		"EEAF0AB9ADB38DD69C33F80AFA8FC5E86072618775FF3C0B9EA2314C9C256576"+
+		"D674DF7496EA81D3383B4813D692C6E0E0D5D8E250B98BE48E495C1D6089DAD1"+
+		"5DC7D7B46154D6B6CE8EF4AD69B15D4982559B297BCF1885C529F566660E57EC"+
+		"68EDBC3C05726CC02FD4CBF4976EAA9AFD5138FE8376435B9FC61D2FC0EB06E3", 2)
+	salt, _ := hex.DecodeString("BEB25379D1A8581EB5A727673A2441EE")
+	want := "" +
+		"7E273DE8696FFC4F4E337D05B4B375BEB0DDE1569E8FA00A9886D8129BADA1F1" +
+		"822223CA1A605B530E379BA4729FDC59F105B4787E5186F5C671085A1447B52A" +
+		"48CF1970B4FB6F8400BBF4CEBFBB168152E08AB5EA53D15C1AFF87B2B9DA6E04" +
+		"E058AD51CC72BFC9033B564E26480D78E955A5E29E7AB245DB2BE315E2099AFB"
+	have := group.verifier(sha1.New, []byte("alice"), []byte("password123"), salt)
+	if !strings.EqualFold(hex.EncodeToString(have), want) {
+		t.Errorf("have %X, want %s", have, want)
+	}
+}
+
+func TestSRPRFC5054(t *testing.T) {
+	// the verifier computed step by step: the password is derived to a 128
+	// byte key with PBKDF2-SHA512, which is the SRP password of an empty
+	// identity, with the same salt. This repeats the derivation of
+	// srpVerifier, so it catches regressions but not a wrong derivation:
+	// only TestSRPRFC5054MacOS checks it against macOS.
+	salt := make([]byte, 32)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	key := pbkdf2.Key([]byte("password"), salt, 1000, 128, sha512.New)
+	inner := sha512.Sum512(append([]byte(":"), key...))
+	x := sha512.Sum512(append(append([]byte(nil), salt...), inner[:]...))
+	v := new(big.Int).Exp(big.NewInt(5), new(big.Int).SetBytes(x[:]), rfc5054Group4096.n)
+	want := v.FillBytes(make([]byte, 512))
+	if have := srpVerifier("password", salt, 1000); !bytes.Equal(have, want) {
+		t.Errorf("have %x, want %x", have, want)
+	}
+
+	d, err := SRPRFC5054("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Salt) != 32 || len(d.Verifier) != 512 {
+		t.Errorf("have salt of %d bytes and verifier of %d bytes, want 32 and 512", len(d.Salt), len(d.Verifier))
+	}
+	if !bytes.Equal(d.Verifier, srpVerifier("password", d.Salt, d.Iterations)) {
+		t.Error("verifier doesn't match the password")
+	}
+	if bytes.Equal(d.Verifier, srpVerifier("wrong", d.Salt, d.Iterations)) {
+		t.Error("verifier matches a wrong password")
+	}
+}
+
+// TestSRPRFC5054MacOS checks the verifier against the ShadowHashData of a
+// real macOS account, which must hold the SRP-RFC5054-4096-SHA512-PBKDF2
+// hash. Set MACKIT_SHADOWHASHDATA to the output of
+// dscl . -read /Users/name ShadowHashData, and
+// MACKIT_SHADOWHASHDATA_PASSWORD to the password of the account.
+func TestSRPRFC5054MacOS(t *testing.T) {
+	data, password := os.Getenv("MACKIT_SHADOWHASHDATA"), os.Getenv("MACKIT_SHADOWHASHDATA_PASSWORD")
+	if data == "" || password == "" {
+		t.Skip("MACKIT_SHADOWHASHDATA and MACKIT_SHADOWHASHDATA_PASSWORD are not set")
+	}
+	d, err := ParseShadowHashData([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.SRP == nil {
+		t.Fatal("no SRP-RFC5054-4096-SHA512-PBKDF2 hash in ShadowHashData")
+	}
+	if have := srpVerifier(password, d.SRP.Salt, d.SRP.Iterations); !bytes.Equal(have, d.SRP.Verifier) {
+		t.Errorf("have verifier %x, want %x", have, d.SRP.Verifier)
+	}
+}
+
+func TestSaltedSHA512PBKDF2Options(t *testing.T) {
+	tests := []struct {
+		opts       []Option
+		saltLen    int
+		minIter    int
+		maxIter    int
+		entropyLen int
+	}{
+		{nil, 32, 20000, 40000, 128},
+		{[]Option{WithIterations(1000)}, 32, 1000, 1000, 128},
+		{[]Option{WithIterationRange(1000, 1010), WithSaltLength(16), WithKeyLength(64)}, 16, 1000, 1010, 64},
+	}
+	for _, tt := range tests {
+		h, err := SaltedSHA512PBKDF2("password", tt.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(h.Salt) != tt.saltLen {
+			t.Errorf("have salt of %d bytes, want %d", len(h.Salt), tt.saltLen)
+		}
+		if h.Iterations < tt.minIter || h.Iterations > tt.maxIter {
+			t.Errorf("have %d iterations, want between %d and %d", h.Iterations, tt.minIter, tt.maxIter)
+		}
+		if len(h.Entropy) != tt.entropyLen {
+			t.Errorf("have entropy of %d bytes, want %d", len(h.Entropy), tt.entropyLen)
+		}
+		if err := Verify("password", h); err != nil {
+			t.Error(err)
+		}
+		if err := Verify("passwore", h); err != ErrNoMatch {
+			t.Errorf("have %v, want %v", err, ErrNoMatch)
+		}
+	}
+
+	for _, opts := range [][]Option{
+		{WithSaltLength(8)},
+		{WithIterations(0)},
+		{WithIterationRange(2000, 1000)},
+		{WithKeyLength(16)},
+	} {
+		if _, err := SaltedSHA512PBKDF2("password", opts...); err == nil {
+			t.Error("expected an error for invalid options")
+		}
+		if _, err := SRPRFC5054("password", opts...); err == nil {
+			t.Error("expected an error for invalid options")
+		}
+	}
+
+	d, err := SRPRFC5054("password", WithIterations(1000), WithSaltLength(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Iterations != 1000 || len(d.Salt) != 16 {
+		t.Errorf("have %d iterations and a salt of %d bytes, want 1000 and 16", d.Iterations, len(d.Salt))
+	}
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	for _, h := range []SaltedSHA512PBKDF2Dictionary{
+		{},
+		{Iterations: 1000, Salt: []byte("salt")},
+		{Iterations: 0, Salt: []byte("salt"), Entropy: []byte("entropy")},
+	} {
+		if err := Verify("password", h); err == nil || err == ErrNoMatch {
+			t.Errorf("%+v: have %v, want an invalid dictionary error", h, err)
+		}
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	h := SaltedSHA512PBKDF2Dictionary{
+		Iterations: 25000,
+		Salt:       make([]byte, 32),
+		Entropy:    make([]byte, 128),
+	}
+	tests := []struct {
+		policy Policy
+		want   bool
+	}{
+		{Policy{}, false},
+		{Policy{MinIterations: 25000, MinSaltLength: 32, MinKeyLength: 128}, false},
+		{Policy{MinIterations: 25001}, true},
+		{Policy{MinSaltLength: 64}, true},
+		{Policy{MinKeyLength: 256}, true},
+	}
+	for _, tt := range tests {
+		if have := NeedsRehash(h, tt.policy); have != tt.want {
+			t.Errorf("%+v: have %v, want %v", tt.policy, have, tt.want)
+		}
+	}
+}
+
+func Test_secureRandInt(t *testing.T) {
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		n, err := secureRandInt(10, 13)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 10 || n > 13 {
+			t.Fatalf("have %d, want between 10 and 13", n)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 4 {
+		t.Errorf("have values %v, want all of 10 to 13", seen)
+	}
+
+	if n, err := secureRandInt(7, 7); err != nil || n != 7 {
+		t.Errorf("have %d, %v, want 7", n, err)
+	}
+	if _, err := secureRandInt(8, 7); err == nil {
+		t.Error("expected an error for an invalid range")
+	}
+}
@@ -0,0 +1,89 @@
+package password
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/groob/mackit/internal/bplist"
+	"github.com/groob/plist"
+)
+
+// ShadowHashDictionary is the ShadowHashData attribute of a local user
+// record, which holds the hashes of its password. Unknown hash types are
+// dropped.
+type ShadowHashDictionary struct {
+	SaltedSHA512PBKDF2 *SaltedSHA512PBKDF2Dictionary `plist:"SALTED-SHA512-PBKDF2,omitempty"`
+	SRP                *SRPDictionary                `plist:"SRP-RFC5054-4096-SHA512-PBKDF2,omitempty"`
+}
+
+// SRPDictionary is a SRP-RFC5054-4096-SHA512-PBKDF2 dictionary, which holds
+// the SRP verifier used to log in to the account over the network.
+type SRPDictionary struct {
+	Iterations int    `plist:"iterations"`
+	Salt       []byte `plist:"salt"`
+	Verifier   []byte `plist:"verifier"`
+}
+
+// ShadowHashData creates the ShadowHashData of a plaintext password, encoded
+// as a binary plist, like the attribute dscl and dsimport expect. It holds
+// both the SALTED-SHA512-PBKDF2 and the SRP-RFC5054-4096-SHA512-PBKDF2 hashes,
+// like the ShadowHashData of accounts created by macOS. The options apply to
+// both hashes.
+func ShadowHashData(plaintext string, opts ...Option) ([]byte, error) {
+	h, err := SaltedSHA512PBKDF2(plaintext, opts...)
+	if err != nil {
+		return nil, err
+	}
+	srp, err := SRPRFC5054(plaintext, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return ShadowHashDictionary{SaltedSHA512PBKDF2: &h, SRP: &srp}.Marshal()
+}
+
+// Marshal encodes the dictionary as a binary plist.
+func (d ShadowHashDictionary) Marshal() ([]byte, error) {
+	if d.SaltedSHA512PBKDF2 == nil && d.SRP == nil {
+		return nil, errors.New("password: empty ShadowHashData")
+	}
+	return bplist.Marshal(d)
+}
+
+// ParseShadowHashData parses the ShadowHashData of a user record. data is a
+// binary or XML plist, or its hex encoding, as printed by
+// dscl . -read /Users/name ShadowHashData.
+func ParseShadowHashData(data []byte) (*ShadowHashDictionary, error) {
+	if !bytes.HasPrefix(data, []byte("bplist")) && !bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		decoded, err := decodeHex(string(data))
+		if err != nil {
+			return nil, err
+		}
+		data = decoded
+	}
+	var d ShadowHashDictionary
+	if err := plist.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("password: decode ShadowHashData: %w", err)
+	}
+	if d.SaltedSHA512PBKDF2 == nil && d.SRP == nil {
+		return nil, errors.New("password: no known hash in ShadowHashData")
+	}
+	return &d, nil
+}
+
+// decodeHex decodes the hex encoding of dscl, which may be prefixed by the
+// attribute name and split in words and lines.
+func decodeHex(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	for _, prefix := range []string{"dsAttrTypeNative:ShadowHashData:", "ShadowHashData:"} {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	s = strings.Join(strings.Fields(s), "")
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("password: decode ShadowHashData: %w", err)
+	}
+	return data, nil
+}
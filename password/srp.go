@@ -0,0 +1,91 @@
+package password
+
+import (
+	"crypto/sha512"
+	"hash"
+	"math/big"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// srpGroup is an SRP group, a safe prime N and a generator g of the
+// multiplicative group modulo N.
+type srpGroup struct {
+	n, g *big.Int
+}
+
+// rfc5054Group4096 is the 4096-bit group of RFC 5054, appendix A, which is
+// the 4096-bit MODP group of RFC 3526.
+var rfc5054Group4096 = newSRPGroup(""+
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74"+
+	"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437"+
+	"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05"+
+	"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB"+
+	"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B"+
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718"+
+	"3995497CEA956AE515D2261898FA051015728E5A8AAAC42DAD33170D04507A33"+
+	"A85521ABDF1CBA64ECFB850458DBEF0A8AEA71575D060C7DB3970F85A6E1E4C7"+
+	"ABF5AE8CDB0933D71E8C94E04A25619DCEE3D2261AD2EE6BF12FFA06D98A0864"+
+	"D87602733EC86A64521F2B18177B200CBBE117577A615D6C770988C0BAD946E2"+
+	"08E24FA074E5AB3143DB5BFCE0FD108E4B82D120A92108011A723C12A787E6D7"+
+	"88719A10BDBA5B2699C327186AF4E23C1A946834B6150BDA2583E9CA2AD44CE8"+
+	"DBBBC2DB04DE8EF92E8EFC141FBECAA6287C59474E6BC05D99B2964FA090C3A2"+
+	"233BA186515BE7ED1F612970CEE2D7AFB81BDD762170481CD0069127D5B05AA9"+
+	"93B4EA988D8FDDC186FFB7DC90A6C08F4DF435C934063199FFFFFFFFFFFFFFFF", 5)
+
+func newSRPGroup(n string, g int64) srpGroup {
+	N, ok := new(big.Int).SetString(n, 16)
+	if !ok {
+		panic("password: invalid SRP group")
+	}
+	return srpGroup{n: N, g: big.NewInt(g)}
+}
+
+// verifier returns the SRP verifier v = g^x mod N, with
+// x = H(salt | H(identity | ":" | password)) as defined by RFC 5054. v is
+// padded to the length of N.
+func (group srpGroup) verifier(h func() hash.Hash, identity, password, salt []byte) []byte {
+	inner := h()
+	inner.Write(identity)
+	inner.Write([]byte(":"))
+	inner.Write(password)
+
+	outer := h()
+	outer.Write(salt)
+	outer.Write(inner.Sum(nil))
+	x := new(big.Int).SetBytes(outer.Sum(nil))
+
+	v := new(big.Int).Exp(group.g, x, group.n)
+	padded := make([]byte, (group.n.BitLen()+7)/8)
+	return v.FillBytes(padded)
+}
+
+// SRPRFC5054 creates a SRP-RFC5054-4096-SHA512-PBKDF2 dictionary from a
+// plaintext password. The password is derived with PBKDF2-SHA512 to a 128
+// byte key, which is the SRP password of an empty identity in the 4096-bit
+// group of RFC 5054, hashed with SHA-512. The salt length and the iterations
+// are set by the options, like for SaltedSHA512PBKDF2.
+//
+// This derivation hasn't been checked against the ShadowHashData of a real
+// macOS account yet, so macOS may not accept the verifier.
+func SRPRFC5054(plaintext string, opts ...Option) (SRPDictionary, error) {
+	p, err := newParams(opts...)
+	if err != nil {
+		return SRPDictionary{}, err
+	}
+	salt, iterations, err := p.salt()
+	if err != nil {
+		return SRPDictionary{}, err
+	}
+	return SRPDictionary{
+		Iterations: iterations,
+		Salt:       salt,
+		Verifier:   srpVerifier(plaintext, salt, iterations),
+	}, nil
+}
+
+func srpVerifier(plaintext string, salt []byte, iterations int) []byte {
+	key := pbkdf2.Key([]byte(plaintext), salt, iterations, macKeyLen, sha512.New)
+	return rfc5054Group4096.verifier(sha512.New, nil, key, salt)
+}
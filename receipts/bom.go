@@ -0,0 +1,247 @@
+package receipts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"path"
+)
+
+// A bom file is a small block store. The header points to an index of blocks
+// and to a list of named variables, each pointing to a block. The Paths
+// variable holds a B+ tree of the files in the bom.
+//
+// All integers are big endian.
+
+const bomMagic = "BOMStore"
+
+var errBomCorrupt = errors.New("receipts: corrupt bom file")
+
+type bom struct {
+	data   []byte
+	blocks []bomBlock
+	vars   map[string]uint32
+}
+
+type bomBlock struct {
+	offset uint32
+	length uint32
+}
+
+func parseBom(data []byte) (*bom, error) {
+	if len(data) < 32 || string(data[:8]) != bomMagic {
+		return nil, errors.New("receipts: not a bom file")
+	}
+	b := &bom{data: data, vars: make(map[string]uint32)}
+	indexOffset := binary.BigEndian.Uint32(data[16:])
+	varsOffset := binary.BigEndian.Uint32(data[24:])
+
+	index, err := b.slice(indexOffset, 4)
+	if err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(index)
+	table, err := b.slice(indexOffset+4, count*8)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < count; i++ {
+		b.blocks = append(b.blocks, bomBlock{
+			offset: binary.BigEndian.Uint32(table[i*8:]),
+			length: binary.BigEndian.Uint32(table[i*8+4:]),
+		})
+	}
+
+	vars, err := b.slice(varsOffset, 4)
+	if err != nil {
+		return nil, err
+	}
+	count = binary.BigEndian.Uint32(vars)
+	offset := varsOffset + 4
+	for i := uint32(0); i < count; i++ {
+		v, err := b.slice(offset, 5)
+		if err != nil {
+			return nil, err
+		}
+		nameLen := uint32(v[4])
+		name, err := b.slice(offset+5, nameLen)
+		if err != nil {
+			return nil, err
+		}
+		b.vars[string(name)] = binary.BigEndian.Uint32(v)
+		offset += 5 + nameLen
+	}
+	return b, nil
+}
+
+func (b *bom) slice(offset, length uint32) ([]byte, error) {
+	end := uint64(offset) + uint64(length)
+	if end > uint64(len(b.data)) {
+		return nil, errBomCorrupt
+	}
+	return b.data[offset:end], nil
+}
+
+func (b *bom) block(i uint32) ([]byte, error) {
+	if i >= uint32(len(b.blocks)) {
+		return nil, errBomCorrupt
+	}
+	return b.slice(b.blocks[i].offset, b.blocks[i].length)
+}
+
+// bomPathInfo is the metadata bom files store for every path.
+type bomPathInfo struct {
+	Type     uint8
+	_        uint8
+	Arch     uint16
+	Mode     uint16
+	UID      uint32
+	GID      uint32
+	ModTime  uint32
+	Size     uint32
+	_        uint8
+	Checksum uint32
+	LinkLen  uint32
+}
+
+// paths walks the Paths tree of the bom, returning the files in tree order.
+func (b *bom) paths() ([]File, error) {
+	root, ok := b.vars["Paths"]
+	if !ok {
+		return nil, errors.New("receipts: bom has no Paths")
+	}
+	tree, err := b.block(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(tree) < 21 || string(tree[:4]) != "tree" {
+		return nil, errBomCorrupt
+	}
+	node := binary.BigEndian.Uint32(tree[8:])
+
+	type entry struct {
+		parent uint32
+		name   string
+	}
+	entries := make(map[uint32]entry)
+	var ids []uint32
+	var infos []bomPathInfo
+	var links []string
+
+	// descend to the leftmost leaf, then follow the forward links.
+	seen := make(map[uint32]bool)
+	for {
+		if seen[node] {
+			return nil, errBomCorrupt
+		}
+		seen[node] = true
+		paths, err := b.block(node)
+		if err != nil {
+			return nil, err
+		}
+		if len(paths) < 12 {
+			return nil, errBomCorrupt
+		}
+		isLeaf := binary.BigEndian.Uint16(paths) != 0
+		count := uint32(binary.BigEndian.Uint16(paths[2:]))
+		forward := binary.BigEndian.Uint32(paths[4:])
+		if uint32(len(paths)) < 12+count*8 {
+			return nil, errBomCorrupt
+		}
+		if !isLeaf {
+			if count == 0 {
+				return nil, errBomCorrupt
+			}
+			node = binary.BigEndian.Uint32(paths[12:])
+			continue
+		}
+
+		for i := uint32(0); i < count; i++ {
+			infoIdx := binary.BigEndian.Uint32(paths[12+i*8:])
+			fileIdx := binary.BigEndian.Uint32(paths[16+i*8:])
+
+			file, err := b.block(fileIdx)
+			if err != nil {
+				return nil, err
+			}
+			if len(file) < 4 {
+				return nil, errBomCorrupt
+			}
+			name := file[4:]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+
+			info1, err := b.block(infoIdx)
+			if err != nil {
+				return nil, err
+			}
+			if len(info1) < 8 {
+				return nil, errBomCorrupt
+			}
+			id := binary.BigEndian.Uint32(info1)
+			info2, err := b.block(binary.BigEndian.Uint32(info1[4:]))
+			if err != nil {
+				return nil, err
+			}
+			var info bomPathInfo
+			if err := binary.Read(bytes.NewReader(info2), binary.BigEndian, &info); err != nil {
+				return nil, errBomCorrupt
+			}
+			var link string
+			if info.Type == uint8(TypeSymlink) && info.LinkLen > 0 {
+				l := info2[31:]
+				if uint32(len(l)) < info.LinkLen {
+					return nil, errBomCorrupt
+				}
+				link = string(bytes.TrimRight(l[:info.LinkLen], "\x00"))
+			}
+
+			entries[id] = entry{parent: binary.BigEndian.Uint32(file), name: string(name)}
+			ids = append(ids, id)
+			infos = append(infos, info)
+			links = append(links, link)
+		}
+		if forward == 0 {
+			break
+		}
+		node = forward
+	}
+
+	var fullPath func(id uint32, depth int) (string, error)
+	fullPath = func(id uint32, depth int) (string, error) {
+		e, ok := entries[id]
+		if !ok || depth > len(entries) {
+			return "", errBomCorrupt
+		}
+		if e.parent == 0 {
+			return e.name, nil
+		}
+		parent, err := fullPath(e.parent, depth+1)
+		if err != nil {
+			return "", err
+		}
+		return path.Join(parent, e.name), nil
+	}
+
+	files := make([]File, 0, len(ids))
+	for i, id := range ids {
+		p, err := fullPath(id, 0)
+		if err != nil {
+			return nil, fmt.Errorf("receipts: resolve bom path %d: %s", id, err)
+		}
+		info := infos[i]
+		files = append(files, File{
+			Path:     path.Clean(p),
+			Type:     FileType(info.Type),
+			Mode:     info.Mode,
+			UID:      info.UID,
+			GID:      info.GID,
+			Size:     info.Size,
+			Checksum: info.Checksum,
+			LinkName: links[i],
+		})
+	}
+	return files, nil
+}
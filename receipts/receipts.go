@@ -0,0 +1,209 @@
+// Package receipts reads the macOS package receipts database.
+//
+// The installer records every package it installs in /var/db/receipts, using
+// a plist with the package info and a bom file listing the installed files.
+// The package provides the same queries as pkgutil.
+package receipts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/groob/plist"
+)
+
+// Option customizes the receipts database.
+type Option func(*database)
+
+type database struct {
+	root   string
+	dryRun bool
+}
+
+func newDatabase(opts ...Option) *database {
+	db := &database{root: "/"}
+	for _, opt := range opts {
+		opt(db)
+	}
+	return db
+}
+
+// WithRoot reads the receipts of the volume mounted at root, instead of the
+// receipts of the boot volume.
+func WithRoot(root string) Option {
+	return func(db *database) {
+		db.root = root
+	}
+}
+
+// DryRun makes Uninstall and Forget report what they would remove, without
+// removing anything or forgetting the receipt.
+func DryRun() Option {
+	return func(db *database) {
+		db.dryRun = true
+	}
+}
+
+func (db *database) dir() string {
+	return filepath.Join(db.root, "var/db/receipts")
+}
+
+// Receipt is the package info stored when a package is installed.
+type Receipt struct {
+	PackageIdentifier  string    `plist:"PackageIdentifier"`
+	PackageVersion     string    `plist:"PackageVersion"`
+	PackageFileName    string    `plist:"PackageFileName"`
+	InstallDate        time.Time `plist:"InstallDate"`
+	InstallPrefixPath  string    `plist:"InstallPrefixPath"`
+	InstallProcessName string    `plist:"InstallProcessName"`
+}
+
+// FileType is the type of a file in a receipt.
+type FileType uint8
+
+// File types.
+const (
+	TypeFile    FileType = 1
+	TypeDir     FileType = 2
+	TypeSymlink FileType = 3
+	TypeDevice  FileType = 4
+)
+
+// File is a file installed by a package.
+type File struct {
+	// Path is relative to the install prefix of the package.
+	Path     string
+	Type     FileType
+	Mode     uint16
+	UID      uint32
+	GID      uint32
+	Size     uint32
+	Checksum uint32
+	LinkName string
+}
+
+// Packages returns the identifiers of all the installed packages, sorted.
+func Packages(opts ...Option) ([]string, error) {
+	return newDatabase(opts...).packages()
+}
+
+func (db *database) packages() ([]string, error) {
+	entries, err := ioutil.ReadDir(db.dir())
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".plist" {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(e.Name(), ".plist"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Info returns the receipt of an installed package.
+func Info(pkgID string, opts ...Option) (*Receipt, error) {
+	return newDatabase(opts...).info(pkgID)
+}
+
+func (db *database) info(pkgID string) (*Receipt, error) {
+	if err := validID(pkgID); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(db.dir(), pkgID+".plist"))
+	if err != nil {
+		return nil, err
+	}
+	var r Receipt
+	if err := plist.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("receipts: decode %s: %s", pkgID, err)
+	}
+	return &r, nil
+}
+
+// Files returns the files installed by a package, in the order they are
+// listed in the bom. Paths are relative to the install prefix of the package.
+func Files(pkgID string, opts ...Option) ([]File, error) {
+	return newDatabase(opts...).files(pkgID)
+}
+
+func (db *database) files(pkgID string) ([]File, error) {
+	if err := validID(pkgID); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(db.dir(), pkgID+".bom"))
+	if err != nil {
+		return nil, err
+	}
+	b, err := parseBom(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", pkgID, err)
+	}
+	paths, err := b.paths()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", pkgID, err)
+	}
+	files := paths[:0]
+	for _, f := range paths {
+		if f.Path == "." {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// Owners returns the identifiers of the packages which installed the file at
+// path. Most files have a single owner, but directories are often shared.
+// The path must be absolute, relative to the root of the volume.
+func Owners(filePath string, opts ...Option) ([]string, error) {
+	db := newDatabase(opts...)
+	ids, err := db.packages()
+	if err != nil {
+		return nil, err
+	}
+	filePath = path.Clean("/" + filePath)
+
+	var owners []string
+	for _, id := range ids {
+		r, err := db.info(id)
+		if err != nil {
+			return nil, err
+		}
+		files, err := db.files(id)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if r.Path(f) == filePath {
+				owners = append(owners, id)
+				break
+			}
+		}
+	}
+	return owners, nil
+}
+
+// Path returns the absolute path of a file installed by the package.
+func (r *Receipt) Path(f File) string {
+	return path.Join("/", r.InstallPrefixPath, f.Path)
+}
+
+// validID rejects identifiers which would resolve outside of the receipts
+// directory.
+func validID(pkgID string) error {
+	if pkgID == "" || strings.ContainsAny(pkgID, "/\x00") || pkgID == "." || pkgID == ".." {
+		return fmt.Errorf("receipts: invalid package identifier %q", pkgID)
+	}
+	return nil
+}
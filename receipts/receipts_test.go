@@ -0,0 +1,488 @@
+package receipts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/groob/plist"
+)
+
+func TestReceipts(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root)
+
+	installed := time.Date(2017, time.March, 1, 10, 0, 0, 0, time.UTC)
+	writeReceipt(t, root, Receipt{
+		PackageIdentifier: "com.example.foo",
+		PackageVersion:    "1.2.3",
+		InstallDate:       installed,
+		InstallPrefixPath: "/",
+	}, []testFile{
+		{path: "Applications", typ: TypeDir, mode: 040775},
+		{path: "Applications/Foo.app", typ: TypeDir, mode: 040755},
+		{path: "Applications/Foo.app/Contents", typ: TypeDir, mode: 040755},
+		{path: "Applications/Foo.app/Contents/Info.plist", typ: TypeFile, mode: 0100644},
+		{path: "Applications/Foo.app/Contents/Current", typ: TypeSymlink, mode: 0120755, link: "Info.plist"},
+	})
+	writeReceipt(t, root, Receipt{
+		PackageIdentifier: "com.example.bar",
+		PackageVersion:    "2.0",
+		InstallDate:       installed,
+		InstallPrefixPath: "usr/local",
+	}, []testFile{
+		{path: "bin", typ: TypeDir, mode: 040755},
+		{path: "bin/bar", typ: TypeFile, mode: 0100755},
+	})
+	writeReceipt(t, root, Receipt{
+		PackageIdentifier: "com.example.shared",
+		PackageVersion:    "1.0",
+		InstallDate:       installed,
+	}, []testFile{
+		{path: "Applications", typ: TypeDir, mode: 040775},
+	})
+
+	ids, err := Packages(WithRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"com.example.bar", "com.example.foo", "com.example.shared"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("have packages %v, want %v", ids, want)
+	}
+
+	r, err := Info("com.example.foo", WithRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := r.PackageVersion, "1.2.3"; have != want {
+		t.Errorf("have version %s, want %s", have, want)
+	}
+	if !r.InstallDate.Equal(installed) {
+		t.Errorf("have install date %s, want %s", r.InstallDate, installed)
+	}
+
+	files, err := Files("com.example.foo", WithRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	wantPaths := []string{
+		"Applications",
+		"Applications/Foo.app",
+		"Applications/Foo.app/Contents",
+		"Applications/Foo.app/Contents/Info.plist",
+		"Applications/Foo.app/Contents/Current",
+	}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("have files %v, want %v", paths, wantPaths)
+	}
+	if have, want := files[4].LinkName, "Info.plist"; have != want {
+		t.Errorf("have link %q, want %q", have, want)
+	}
+	if have, want := files[3].Type, TypeFile; have != want {
+		t.Errorf("have type %d, want %d", have, want)
+	}
+	if have, want := files[1].Mode, uint16(040755); have != want {
+		t.Errorf("have mode %o, want %o", have, want)
+	}
+
+	owners := []struct {
+		path string
+		want []string
+	}{
+		{"/Applications/Foo.app/Contents/Info.plist", []string{"com.example.foo"}},
+		{"/Applications", []string{"com.example.foo", "com.example.shared"}},
+		{"/usr/local/bin/bar", []string{"com.example.bar"}},
+		{"/usr/local/bin/baz", nil},
+	}
+	for _, tt := range owners {
+		have, err := Owners(tt.path, WithRoot(root))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%s: have owners %v, want %v", tt.path, have, tt.want)
+		}
+	}
+
+	if _, err := Info("../../etc/passwd", WithRoot(root)); err == nil {
+		t.Error("expected error for invalid package identifier")
+	}
+}
+
+func TestParseBomCorrupt(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root)
+	writeReceipt(t, root, Receipt{PackageIdentifier: "com.example.foo"}, []testFile{
+		{path: "Applications", typ: TypeDir, mode: 040775},
+		{path: "Applications/Foo.app", typ: TypeDir, mode: 040755},
+	})
+	data, err := ioutil.ReadFile(filepath.Join(root, "var/db/receipts/com.example.foo.bom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// truncating or flipping bytes must never panic.
+	for i := 0; i < len(data); i++ {
+		b, err := parseBom(data[:i])
+		if err == nil {
+			b.paths()
+		}
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0xff
+		if b, err := parseBom(corrupt); err == nil {
+			b.paths()
+		}
+	}
+}
+
+func testRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "mackit-receipts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "var/db/receipts"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+type testFile struct {
+	path string
+	typ  FileType
+	mode uint16
+	link string
+}
+
+// writeReceipt writes the plist and bom of a package receipt under root.
+func writeReceipt(t *testing.T, root string, r Receipt, files []testFile) {
+	dir := filepath.Join(root, "var/db/receipts")
+	data, err := plist.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, r.PackageIdentifier+".plist"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, r.PackageIdentifier+".bom"), buildBom(files), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// buildBom creates a bom file listing files. The leaves of the Paths tree only
+// hold two paths each, to exercise walking the tree.
+func buildBom(files []testFile) []byte {
+	var blocks [][]byte
+	addBlock := func(b []byte) uint32 {
+		blocks = append(blocks, b)
+		return uint32(len(blocks))
+	}
+	be := binary.BigEndian
+
+	all := append([]testFile{{path: ".", typ: TypeDir, mode: 040755}}, files...)
+	ids := map[string]uint32{}
+	type pathIndices struct{ info, file uint32 }
+	var indices []pathIndices
+	for i, f := range all {
+		id := uint32(i + 1)
+		ids[f.path] = id
+
+		var info bytes.Buffer
+		binary.Write(&info, be, bomPathInfo{
+			Type:    uint8(f.typ),
+			Arch:    3,
+			Mode:    f.mode,
+			UID:     0,
+			GID:     80,
+			ModTime: 1488362400,
+			LinkLen: uint32(len(f.link) + 1),
+		})
+		if f.link != "" {
+			info.WriteString(f.link + "\x00")
+		}
+		info1 := make([]byte, 8)
+		be.PutUint32(info1, id)
+		be.PutUint32(info1[4:], addBlock(info.Bytes()))
+
+		var parent uint32
+		if f.path != "." {
+			parent = ids[path.Dir(f.path)]
+		}
+		file := make([]byte, 4)
+		be.PutUint32(file, parent)
+		file = append(file, path.Base(f.path)+"\x00"...)
+		indices = append(indices, pathIndices{addBlock(info1), addBlock(file)})
+	}
+
+	// reserve the leaf blocks so they can link to each other.
+	var leaves []uint32
+	for i := 0; i < len(indices); i += 2 {
+		leaves = append(leaves, addBlock(nil))
+	}
+	for n, leaf := range leaves {
+		entries := indices[n*2:]
+		if len(entries) > 2 {
+			entries = entries[:2]
+		}
+		b := make([]byte, 12)
+		be.PutUint16(b, 1)
+		be.PutUint16(b[2:], uint16(len(entries)))
+		if n+1 < len(leaves) {
+			be.PutUint32(b[4:], leaves[n+1])
+		}
+		if n > 0 {
+			be.PutUint32(b[8:], leaves[n-1])
+		}
+		for _, e := range entries {
+			var entry [8]byte
+			be.PutUint32(entry[:], e.info)
+			be.PutUint32(entry[4:], e.file)
+			b = append(b, entry[:]...)
+		}
+		blocks[leaf-1] = b
+	}
+	branch := make([]byte, 12)
+	be.PutUint16(branch[2:], uint16(len(leaves)))
+	for _, leaf := range leaves {
+		var entry [8]byte
+		be.PutUint32(entry[:], leaf)
+		branch = append(branch, entry[:]...)
+	}
+	branchIdx := addBlock(branch)
+
+	tree := make([]byte, 21)
+	copy(tree, "tree")
+	be.PutUint32(tree[4:], 1)
+	be.PutUint32(tree[8:], branchIdx)
+	be.PutUint32(tree[12:], 4096)
+	be.PutUint32(tree[16:], uint32(len(all)))
+	treeIdx := addBlock(tree)
+
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 512))
+	offsets := make([]uint32, len(blocks))
+	for i, b := range blocks {
+		offsets[i] = uint32(buf.Len())
+		buf.Write(b)
+	}
+
+	indexOffset := uint32(buf.Len())
+	binary.Write(&buf, be, uint32(len(blocks)+1))
+	binary.Write(&buf, be, [2]uint32{}) // block 0 is always null.
+	for i, b := range blocks {
+		binary.Write(&buf, be, [2]uint32{offsets[i], uint32(len(b))})
+	}
+	indexLength := uint32(buf.Len()) - indexOffset
+
+	varsOffset := uint32(buf.Len())
+	binary.Write(&buf, be, uint32(1))
+	binary.Write(&buf, be, treeIdx)
+	buf.WriteByte(byte(len("Paths")))
+	buf.WriteString("Paths")
+	varsLength := uint32(buf.Len()) - varsOffset
+
+	data := buf.Bytes()
+	copy(data, bomMagic)
+	be.PutUint32(data[8:], 1)
+	be.PutUint32(data[12:], uint32(len(blocks)+1))
+	be.PutUint32(data[16:], indexOffset)
+	be.PutUint32(data[20:], indexLength)
+	be.PutUint32(data[24:], varsOffset)
+	be.PutUint32(data[28:], varsLength)
+	return data
+}
+
+func TestUninstall(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root)
+
+	writeReceipt(t, root, Receipt{
+		PackageIdentifier: "com.example.foo",
+		InstallPrefixPath: "/",
+	}, []testFile{
+		{path: "Applications", typ: TypeDir, mode: 040775},
+		{path: "Applications/Foo.app", typ: TypeDir, mode: 040755},
+		{path: "Applications/Foo.app/Contents", typ: TypeDir, mode: 040755},
+		{path: "Applications/Foo.app/Contents/Info.plist", typ: TypeFile, mode: 0100644},
+		{path: "Applications/Foo.app/Contents/Current", typ: TypeSymlink, mode: 0120755, link: "Info.plist"},
+		{path: "Library", typ: TypeDir, mode: 040755},
+		{path: "Library/Foo", typ: TypeDir, mode: 040755},
+		{path: "Library/Foo/shared.conf", typ: TypeFile, mode: 0100644},
+		{path: "Library/Foo/foo.conf", typ: TypeFile, mode: 0100644},
+		{path: "Library/Foo/missing.conf", typ: TypeFile, mode: 0100644},
+	})
+	writeReceipt(t, root, Receipt{
+		PackageIdentifier: "com.example.bar",
+		InstallPrefixPath: "/",
+	}, []testFile{
+		{path: "Library", typ: TypeDir, mode: 040755},
+		{path: "Library/Foo", typ: TypeDir, mode: 040755},
+		{path: "Library/Foo/shared.conf", typ: TypeFile, mode: 0100644},
+	})
+
+	for _, dir := range []string{"Applications/Foo.app/Contents", "Library/Foo"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{
+		"Applications/Foo.app/Contents/Info.plist",
+		"Library/Foo/shared.conf",
+		"Library/Foo/foo.conf",
+		"Applications/Other.app",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(root, file), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("Info.plist", filepath.Join(root, "Applications/Foo.app/Contents/Current")); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"/Applications/Foo.app/Contents/Current",
+		"/Applications/Foo.app/Contents/Info.plist",
+		"/Library/Foo/foo.conf",
+		"/Applications/Foo.app/Contents",
+		"/Applications/Foo.app",
+	}
+
+	removed, err := Uninstall("com.example.foo", WithRoot(root), DryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("dry run: have removed %v, want %v", removed, want)
+	}
+	for _, p := range want {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("dry run removed %s: %s", p, err)
+		}
+	}
+	if _, err := Info("com.example.foo", WithRoot(root)); err != nil {
+		t.Errorf("dry run forgot receipt: %s", err)
+	}
+
+	removed, err = Uninstall("com.example.foo", WithRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("have removed %v, want %v", removed, want)
+	}
+	for _, p := range want {
+		if _, err := os.Lstat(filepath.Join(root, p)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", p, err)
+		}
+	}
+	for _, p := range []string{"Applications/Other.app", "Library/Foo/shared.conf"} {
+		if _, err := os.Lstat(filepath.Join(root, p)); err != nil {
+			t.Errorf("expected %s to be kept: %s", p, err)
+		}
+	}
+
+	ids, err := Packages(WithRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"com.example.bar"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("have packages %v, want %v", ids, want)
+	}
+}
+
+func TestUninstallSystemDirs(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "mackit-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	writeReceipt(t, root, Receipt{
+		PackageIdentifier: "com.example.tool",
+		InstallPrefixPath: "/",
+	}, []testFile{
+		{path: "usr", typ: TypeDir, mode: 040755},
+		{path: "usr/local", typ: TypeDir, mode: 040755},
+		{path: "usr/local/bin", typ: TypeDir, mode: 040755},
+		{path: "usr/local/bin/tool", typ: TypeFile, mode: 0100755},
+		{path: "opt", typ: TypeDir, mode: 040755},
+		{path: "opt/tool", typ: TypeDir, mode: 040755},
+		{path: "opt/tool/tool.conf", typ: TypeFile, mode: 0100644},
+	})
+	if err := os.MkdirAll(filepath.Join(root, "usr/local/bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "opt"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// opt/tool was replaced by a symlink to a directory the receipt doesn't
+	// list.
+	if err := os.Symlink(outside, filepath.Join(root, "opt/tool")); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{
+		filepath.Join(root, "usr/local/bin/tool"),
+		filepath.Join(outside, "tool.conf"),
+	} {
+		if err := ioutil.WriteFile(file, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := Uninstall("com.example.tool", WithRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/usr/local/bin/tool"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("have removed %v, want %v", removed, want)
+	}
+	for _, p := range []string{
+		filepath.Join(root, "usr/local/bin"),
+		filepath.Join(root, "opt/tool"),
+		filepath.Join(outside, "tool.conf"),
+	} {
+		if _, err := os.Lstat(p); err != nil {
+			t.Errorf("expected %s to be kept: %s", p, err)
+		}
+	}
+}
+
+func TestForget(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root)
+	writeReceipt(t, root, Receipt{PackageIdentifier: "com.example.foo", InstallPrefixPath: "/"}, nil)
+
+	want := []string{"/var/db/receipts/com.example.foo.bom", "/var/db/receipts/com.example.foo.plist"}
+	removed, err := Forget("com.example.foo", WithRoot(root), DryRun())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("dry run: have removed %v, want %v", removed, want)
+	}
+	if _, err := Info("com.example.foo", WithRoot(root)); err != nil {
+		t.Errorf("dry run forgot receipt: %s", err)
+	}
+
+	removed, err = Forget("com.example.foo", WithRoot(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("have removed %v, want %v", removed, want)
+	}
+	if _, err := Info("com.example.foo", WithRoot(root)); !os.IsNotExist(err) {
+		t.Errorf("expected the receipt to be forgotten, got %v", err)
+	}
+}
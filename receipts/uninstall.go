@@ -0,0 +1,324 @@
+package receipts
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Uninstall removes the files installed by a package and forgets its receipt.
+// It returns the paths which were removed, relative to the root of the volume.
+//
+// Only files which no other receipt lists are removed. Files, symlinks and
+// devices are removed first, followed by the directories, deepest first.
+// Directories are only removed if they are empty once the files of the package
+// are gone, and system directories, such as /Applications or /usr/local/bin,
+// are never removed. Files which no longer exist, and files below a directory
+// which was replaced by a symlink, are skipped.
+func Uninstall(pkgID string, opts ...Option) (removed []string, err error) {
+	db := newDatabase(opts...)
+	r, err := db.info(pkgID)
+	if err != nil {
+		return nil, err
+	}
+	files, err := db.files(pkgID)
+	if err != nil {
+		return nil, err
+	}
+
+	shared, err := db.sharedPaths(pkgID)
+	if err != nil {
+		return nil, err
+	}
+	protected := map[string]bool{"/": true}
+	for p := path.Join("/", r.InstallPrefixPath); p != "/"; p = path.Dir(p) {
+		protected[p] = true
+	}
+
+	var others, dirs []string
+	for _, f := range files {
+		p := r.Path(f)
+		if shared[p] || protected[p] || systemDirs[p] {
+			continue
+		}
+		if f.Type == TypeDir {
+			dirs = append(dirs, p)
+		} else {
+			others = append(others, p)
+		}
+	}
+	sort.Sort(byDepth(others))
+	sort.Sort(byDepth(dirs))
+
+	gone := make(map[string]bool)
+	for _, p := range others {
+		if ok, err := db.inTree(p); err != nil {
+			return removed, err
+		} else if !ok {
+			continue
+		}
+		if _, err := os.Lstat(db.path(p)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if err := db.remove(p); err != nil {
+			return removed, err
+		}
+		gone[p] = true
+		removed = append(removed, p)
+	}
+	for _, p := range dirs {
+		if ok, err := db.inTree(p); err != nil {
+			return removed, err
+		} else if !ok {
+			continue
+		}
+		fi, err := os.Lstat(db.path(p))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+		empty, err := db.isEmpty(p, gone)
+		if err != nil {
+			return removed, err
+		}
+		if !empty {
+			continue
+		}
+		if err := db.remove(p); err != nil {
+			return removed, err
+		}
+		gone[p] = true
+		removed = append(removed, p)
+	}
+
+	if db.dryRun {
+		return removed, nil
+	}
+	_, err = db.forget(pkgID)
+	return removed, err
+}
+
+// Forget removes the receipt of a package, without removing its files. It
+// returns the paths of the removed receipt files, relative to the root of the
+// volume. With DryRun, it returns the receipt files it would remove.
+func Forget(pkgID string, opts ...Option) (removed []string, err error) {
+	return newDatabase(opts...).forget(pkgID)
+}
+
+func (db *database) forget(pkgID string) ([]string, error) {
+	if err := validID(pkgID); err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, ext := range []string{".bom", ".plist"} {
+		p := path.Join("/var/db/receipts", pkgID+ext)
+		if _, err := os.Lstat(db.path(p)); os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if err := db.remove(p); err != nil {
+			return removed, err
+		}
+		removed = append(removed, p)
+	}
+	return removed, nil
+}
+
+// systemDirs are the directories of macOS which are never removed, even if
+// they are empty and no other receipt lists them. The receipts of the system
+// itself aren't in /var/db/receipts, so they don't protect them.
+var systemDirs = map[string]bool{
+	"/Applications":                             true,
+	"/Applications/Utilities":                   true,
+	"/Library":                                  true,
+	"/Library/Application Support":              true,
+	"/Library/Audio":                            true,
+	"/Library/Audio/Plug-Ins":                   true,
+	"/Library/Audio/Plug-Ins/Components":        true,
+	"/Library/Audio/Plug-Ins/HAL":               true,
+	"/Library/Caches":                           true,
+	"/Library/ColorSync":                        true,
+	"/Library/ColorSync/Profiles":               true,
+	"/Library/Components":                       true,
+	"/Library/Documentation":                    true,
+	"/Library/DriverExtensions":                 true,
+	"/Library/Extensions":                       true,
+	"/Library/Filesystems":                      true,
+	"/Library/Fonts":                            true,
+	"/Library/Frameworks":                       true,
+	"/Library/Input Methods":                    true,
+	"/Library/Internet Plug-Ins":                true,
+	"/Library/Keyboard Layouts":                 true,
+	"/Library/LaunchAgents":                     true,
+	"/Library/LaunchDaemons":                    true,
+	"/Library/Logs":                             true,
+	"/Library/Managed Preferences":              true,
+	"/Library/PreferencePanes":                  true,
+	"/Library/Preferences":                      true,
+	"/Library/Printers":                         true,
+	"/Library/Printers/PPDs":                    true,
+	"/Library/Printers/PPDs/Contents":           true,
+	"/Library/Printers/PPDs/Contents/Resources": true,
+	"/Library/PrivilegedHelperTools":            true,
+	"/Library/QuickLook":                        true,
+	"/Library/Receipts":                         true,
+	"/Library/Screen Savers":                    true,
+	"/Library/Scripts":                          true,
+	"/Library/Security":                         true,
+	"/Library/Security/SecurityAgentPlugins":    true,
+	"/Library/Services":                         true,
+	"/Library/Spotlight":                        true,
+	"/Library/StartupItems":                     true,
+	"/Library/SystemExtensions":                 true,
+	"/Library/User Template":                    true,
+	"/Library/WebServer":                        true,
+	"/Library/WebServer/Documents":              true,
+	"/System":                                   true,
+	"/Users":                                    true,
+	"/Users/Shared":                             true,
+	"/bin":                                      true,
+	"/cores":                                    true,
+	"/etc":                                      true,
+	"/opt":                                      true,
+	"/private":                                  true,
+	"/private/etc":                              true,
+	"/private/etc/paths.d":                      true,
+	"/private/etc/manpaths.d":                   true,
+	"/private/tmp":                              true,
+	"/private/var":                              true,
+	"/private/var/db":                           true,
+	"/private/var/db/receipts":                  true,
+	"/private/var/root":                         true,
+	"/sbin":                                     true,
+	"/tmp":                                      true,
+	"/usr":                                      true,
+	"/usr/bin":                                  true,
+	"/usr/lib":                                  true,
+	"/usr/libexec":                              true,
+	"/usr/local":                                true,
+	"/usr/local/bin":                            true,
+	"/usr/local/etc":                            true,
+	"/usr/local/include":                        true,
+	"/usr/local/lib":                            true,
+	"/usr/local/libexec":                        true,
+	"/usr/local/sbin":                           true,
+	"/usr/local/share":                          true,
+	"/usr/local/share/doc":                      true,
+	"/usr/local/share/man":                      true,
+	"/usr/local/share/man/man1":                 true,
+	"/usr/local/share/man/man3":                 true,
+	"/usr/local/share/man/man5":                 true,
+	"/usr/local/share/man/man8":                 true,
+	"/usr/sbin":                                 true,
+	"/usr/share":                                true,
+	"/var":                                      true,
+	"/var/db":                                   true,
+	"/var/db/receipts":                          true,
+	"/var/root":                                 true,
+	"/Volumes":                                  true,
+}
+
+// inTree reports whether none of the parent directories of p, below the root,
+// is a symlink, so that removing p can't follow a symlink out of the paths
+// of the receipt.
+func (db *database) inTree(p string) (bool, error) {
+	dir := path.Dir(p)
+	var parents []string
+	for ; dir != "/" && dir != "."; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(db.path(parents[i]))
+		if os.IsNotExist(err) {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sharedPaths returns the paths listed by the receipts of all the packages
+// other than pkgID.
+func (db *database) sharedPaths(pkgID string) (map[string]bool, error) {
+	ids, err := db.packages()
+	if err != nil {
+		return nil, err
+	}
+	shared := make(map[string]bool)
+	for _, id := range ids {
+		if id == pkgID {
+			continue
+		}
+		r, err := db.info(id)
+		if err != nil {
+			return nil, err
+		}
+		files, err := db.files(id)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			shared[r.Path(f)] = true
+		}
+	}
+	return shared, nil
+}
+
+// path returns the location of p on disk.
+func (db *database) path(p string) string {
+	return filepath.Join(db.root, filepath.FromSlash(p))
+}
+
+func (db *database) remove(p string) error {
+	if db.dryRun {
+		return nil
+	}
+	return os.Remove(db.path(p))
+}
+
+// isEmpty reports whether the directory p only holds paths which are gone.
+func (db *database) isEmpty(p string, gone map[string]bool) (bool, error) {
+	f, err := os.Open(db.path(p))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return false, err
+	}
+	for _, name := range names {
+		if !gone[path.Join(p, name)] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// byDepth sorts paths with the deepest paths first.
+type byDepth []string
+
+func (a byDepth) Len() int      { return len(a) }
+func (a byDepth) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byDepth) Less(i, j int) bool {
+	di, dj := strings.Count(a[i], "/"), strings.Count(a[j], "/")
+	if di != dj {
+		return di > dj
+	}
+	return a[i] < a[j]
+}